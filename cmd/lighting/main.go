@@ -2,21 +2,48 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"github.com/juju/errors"
 	"github.com/lerencao/tidb-light/config"
+	"github.com/lerencao/tidb-light/mockimporter"
 	"github.com/lerencao/tidb-light/server"
+	"github.com/satori/go.uuid"
 	"github.com/sirupsen/logrus"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 	"time"
 )
 
 func main() {
+	args := os.Args[1:]
 	cfg := config.NewConfig()
-	err := cfg.Parse(os.Args[1:])
+
+	// `lighting import --dir=...` imports a mydumper/dumpling directory and exits.
+	var importParam *server.JobParam
+	if len(args) > 0 && args[0] == "import" {
+		importParam = &server.JobParam{}
+		cfg.FlagSet.StringVar(&importParam.Dir, "dir", "", "mydumper/dumpling directory to import")
+		cfg.FlagSet.BoolVar(&importParam.CSVHeader, "csv-header", false, "csv data files have a header row")
+		cfg.FlagSet.IntVar(&importParam.Concurrency, "concurrency", 1, "number of tables imported concurrently")
+		args = args[1:]
+	}
+
+	// `lighting replay --dir=...` replays sink files of an engine to importer and exits.
+	var replay *replayParam
+	if len(args) > 0 && args[0] == "replay" {
+		replay = &replayParam{}
+		cfg.FlagSet.StringVar(&replay.dir, "dir", "", "sink dir of an engine, which is <sink-dir>/<engine id>")
+		cfg.FlagSet.StringVar(&replay.engine, "engine", "", "engine id to replay to, the name of dir if it's empty")
+		cfg.FlagSet.BoolVar(&replay.importEngine, "import", false, "import the engine into the tikv cluster of pd-addr after replay")
+		args = args[1:]
+	}
+
+	err := cfg.Parse(args)
 	switch errors.Cause(err) {
 	case nil:
 	case flag.ErrHelp:
@@ -26,14 +53,46 @@ func main() {
 		os.Exit(2)
 	}
 
-	if err = cfg.Validate(); err != nil {
+	// replay only talks to importer, so tidb is not needed
+	if replay != nil {
+		err = replay.validate(cfg)
+	} else {
+		err = cfg.Validate()
+	}
+	if err != nil {
 		logrus.Error(err)
 		os.Exit(2)
 	}
 
+	// `--importer-addr=mock://[host:port]` runs an in-memory importer in process
+	mock, err := startMockImporter(cfg)
+	if err != nil {
+		logrus.Errorf("fail to start mock importer, error: %v", err)
+		os.Exit(1)
+	}
+
 	svr := server.NewServer(cfg)
+	if replay != nil {
+		code := runReplay(svr, cfg, replay)
+		if mock != nil {
+			mock.Stop()
+		}
+		os.Exit(code)
+	}
 	if err := svr.Start(); err != nil {
 		logrus.Errorf("fail to create server service, error: %v", err)
+		if mock != nil {
+			mock.Stop()
+		}
+		os.Exit(1)
+	}
+
+	if importParam != nil {
+		code := runImport(svr, importParam)
+		if mock != nil {
+			mock.Stop()
+		}
+		os.Exit(code)
 	}
 
 	handler := server.NewHandler(svr)
@@ -68,7 +127,126 @@ func main() {
 	if err != nil {
 		logrus.Errorf("fail to close server, err: %v", err)
 	}
+	if mock != nil {
+		mock.Stop()
+	}
+}
+
+type replayParam struct {
+	dir          string
+	engine       string
+	importEngine bool
+}
+
+func (p *replayParam) validate(cfg *config.Config) error {
+	if p.dir == "" {
+		return errors.Errorf("dir should not be empty")
+	}
+	if p.engine == "" {
+		p.engine = filepath.Base(filepath.Clean(p.dir))
+	}
+	if _, err := uuid.FromString(p.engine); err != nil {
+		return errors.Annotatef(err, "invalid engine id %s", p.engine)
+	}
+	if cfg.ImporterAddr == "" {
+		return errors.Errorf("import-addr should not be empty")
+	}
+	if p.importEngine && cfg.PdAddr == "" {
+		return errors.Errorf("pd-addr should not be empty to import engine")
+	}
+	if cfg.WriteStreams <= 0 || cfg.BatchBytes <= 0 || cfg.BatchKvs <= 0 {
+		return errors.Errorf("write-streams, batch-bytes and batch-kvs should be positive")
+	}
+	return nil
+}
 
+func runReplay(svr *server.Server, cfg *config.Config, param *replayParam) int {
+	defer func() {
+		if err := svr.Close(); err != nil {
+			logrus.Errorf("fail to close server, err: %v", err)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-c
+		logrus.Warnf("cancel replay of engine %s", param.engine)
+		cancel()
+	}()
+
+	engineId := uuid.FromStringOrNil(param.engine)
+	result, err := svr.ReplayEngine(ctx, engineId, param.dir, cfg.WriteStreams)
+	if err != nil {
+		logrus.Errorf("fail to replay %s to engine %s, err: %v", param.dir, param.engine, err)
+		return 1
+	}
+	if param.importEngine {
+		if err = svr.ImportEngine(ctx, engineId, cfg.PdAddr); err != nil {
+			logrus.Errorf("fail to import engine %s, err: %v", param.engine, err)
+			return 1
+		}
+	}
+
+	data, _ := json.MarshalIndent(result, "", "  ")
+	fmt.Println(string(data))
+	return 0
+}
+
+// startMockImporter starts a mock importer if the importer address is a mock one,
+// and points the importer address to it.
+func startMockImporter(cfg *config.Config) (*mockimporter.Server, error) {
+	listenAddr, ok := mockimporter.ParseAddr(cfg.ImporterAddr)
+	if !ok {
+		return nil, nil
+	}
+	mock := mockimporter.New()
+	addr, err := mock.Start(listenAddr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	cfg.ImporterAddr = addr
+	return mock, nil
+}
+
+func runImport(svr *server.Server, param *server.JobParam) int {
+	defer func() {
+		if err := svr.Close(); err != nil {
+			logrus.Errorf("fail to close server, err: %v", err)
+		}
+	}()
+
+	job, err := svr.SubmitJob(param)
+	if err != nil {
+		logrus.Errorf("fail to submit import job, err: %v", err)
+		return 2
+	}
+
+	done := make(chan struct{})
+	go func() {
+		job.Wait()
+		close(done)
+	}()
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case <-c:
+		logrus.Warnf("cancel import job %s", job.Status().Id)
+		job.Cancel()
+		<-done
+	case <-done:
+	}
+
+	status := job.Status()
+	data, _ := json.MarshalIndent(status, "", "  ")
+	fmt.Println(string(data))
+	if status.State != server.JobFinished {
+		return 1
+	}
+	return 0
 }
 
 // func main() {
@@ -5,6 +5,32 @@ import (
 	"fmt"
 	"github.com/BurntSushi/toml"
 	"github.com/pkg/errors"
+	"time"
+)
+
+const (
+	// OracleAuto uses pd tso when pd-addr is set, and falls back to local oracle when pd is unavailable.
+	OracleAuto = "auto"
+	// OraclePd always uses pd tso.
+	OraclePd = "pd"
+	// OracleLocal uses local clock of lighting host.
+	OracleLocal = "local"
+)
+
+const (
+	// CheckpointNone disables session checkpoints.
+	CheckpointNone = "none"
+	// CheckpointFile saves session checkpoints in local files.
+	CheckpointFile = "file"
+	// CheckpointTiDB saves session checkpoints in a tidb table.
+	CheckpointTiDB = "tidb"
+)
+
+const (
+	// SinkFormatKV writes sink files as length prefixed kv records.
+	SinkFormatKV = "kv"
+	// SinkFormatSST writes sink files as goleveldb tables.
+	SinkFormatSST = "sst"
 )
 
 func NewConfig() *Config {
@@ -12,11 +38,48 @@ func NewConfig() *Config {
 	cfg.FlagSet = flag.NewFlagSet("light", flag.ContinueOnError)
 
 	cfg.FlagSet.StringVar(&cfg.Addr, "addr", "localhost:20280", "listening addr")
-	cfg.FlagSet.StringVar(&cfg.ImporterAddr, "importer-addr", "", "importer listen address")
+	cfg.FlagSet.StringVar(&cfg.ImporterAddr, "importer-addr", "", "importer listen address, mock://[host:port] runs an in-memory importer, empty means only sessions with file sink are accepted")
 	cfg.FlagSet.StringVar(&cfg.TiDBAddr, "tidb-addr", "", "tidb tcp addr")
 	cfg.FlagSet.StringVar(&cfg.TiDBUser, "tidb-user", "root", "tidb user")
 	cfg.FlagSet.StringVar(&cfg.TiDBPass, "tidb-password", "root", "tidb password")
 	cfg.FlagSet.StringVar(&cfg.TiDBHttpAddr, "tidb-http-addr", "", "tidb http addr")
+	cfg.FlagSet.StringVar(&cfg.SchemaCatalog, "schema-catalog", "", "toml or json catalog of table schemas, used instead of tidb to encode offline")
+	cfg.FlagSet.StringVar(&cfg.PdAddr, "pd-addr", "", "pd addr, used to get commit ts from pd tso")
+	cfg.FlagSet.StringVar(&cfg.Oracle, "oracle", OracleAuto, "timestamp oracle, one of auto|pd|local")
+	cfg.FlagSet.Int64Var(&cfg.IdStep, "id-step", 10000, "number of row ids reserved for a session each time")
+	cfg.FlagSet.Var(&cfg.SessionTTL, "session-ttl", "lease ttl of session, idle sessions are closed after it, 0 disables it")
+	cfg.FlagSet.StringVar(&cfg.Checkpoint, "checkpoint", CheckpointNone, "session checkpoint backend, one of none|file|tidb")
+	cfg.FlagSet.StringVar(&cfg.CheckpointDir, "checkpoint-dir", "checkpoints", "dir of session checkpoint files")
+	cfg.FlagSet.StringVar(&cfg.CheckpointSchema, "checkpoint-schema", "lighting_checkpoint", "tidb schema of session checkpoint table")
+	cfg.FlagSet.IntVar(&cfg.BatchBytes, "batch-bytes", 8*1024*1024, "max bytes of a write batch sent to importer")
+	cfg.FlagSet.IntVar(&cfg.BatchKvs, "batch-kvs", 16384, "max kv pairs of a write batch sent to importer")
+	cfg.FlagSet.IntVar(&cfg.WriteStreams, "write-streams", 1, "default number of write streams of a session, each on a different connection to importer")
+	cfg.FlagSet.IntVar(&cfg.EncodeWorkers, "encode-workers", 1, "number of encoders of a session, which encode a write in parallel")
+	cfg.FlagSet.IntVar(&cfg.CoalesceBytes, "coalesce-bytes", 0, "coalesce small writes of a session until the size is reached, 0 to disable")
+	cfg.CoalesceInterval = Duration{100 * time.Millisecond}
+	cfg.FlagSet.Var(&cfg.CoalesceInterval, "coalesce-interval", "max time coalesced writes wait before sent to importer")
+	cfg.FlagSet.BoolVar(&cfg.AckWrites, "ack-writes", false, "finish writes only after importer acknowledges them")
+	cfg.AckInterval = Duration{200 * time.Millisecond}
+	cfg.FlagSet.Var(&cfg.AckInterval, "ack-interval", "max time a write waits for acknowledgement of importer when ack-writes is enabled")
+	cfg.FlagSet.IntVar(&cfg.AckBytes, "ack-bytes", 16*1024*1024, "bytes sent to importer before waiting for acknowledgement when ack-writes is enabled")
+	cfg.FlagSet.IntVar(&cfg.RetryBufferBytes, "retry-buffer-bytes", 64*1024*1024, "max bytes of unacknowledged batches kept to replay on a new write stream")
+	cfg.FlagSet.IntVar(&cfg.RetryLimit, "retry-limit", 5, "max retries to reconnect write stream of importer")
+	cfg.RetryBackoff = Duration{500 * time.Millisecond}
+	cfg.FlagSet.Var(&cfg.RetryBackoff, "retry-backoff", "initial wait before reconnecting write stream, it doubles on each retry")
+	cfg.RetryMaxBackoff = Duration{10 * time.Second}
+	cfg.FlagSet.Var(&cfg.RetryMaxBackoff, "retry-max-backoff", "max wait before reconnecting write stream")
+	cfg.FlagSet.IntVar(&cfg.QueueBytes, "queue-bytes", 64*1024*1024, "max bytes of batches queued in a write stream, writes are rejected when it's full")
+	cfg.EnqueueTimeout = Duration{5 * time.Second}
+	cfg.FlagSet.Var(&cfg.EnqueueTimeout, "enqueue-timeout", "max time a batch waits for room in the write queue before the write is rejected")
+	cfg.FlagSet.StringVar(&cfg.SpillDir, "spill-dir", "", "dir to spill batches when importer is slower than encoding, empty to disable")
+	cfg.FlagSet.IntVar(&cfg.SpillBytes, "spill-bytes", 32*1024*1024, "queued bytes of a write stream above which batches are spilled to spill-dir")
+	cfg.FlagSet.IntVar(&cfg.SpillSegmentBytes, "spill-segment-bytes", 64*1024*1024, "size of a spill segment file")
+	cfg.ImportModeInterval = Duration{time.Minute}
+	cfg.FlagSet.Var(&cfg.ImportModeInterval, "import-mode-interval", "interval to re-assert import mode of tikv while jobs or engines are importing")
+	cfg.FlagSet.StringVar(&cfg.ImportModeState, "import-mode-state", "import_mode.json", "file of tikv clusters in import mode, they are switched back to normal mode after restart")
+	cfg.FlagSet.StringVar(&cfg.SinkDir, "sink-dir", "sink", "dir of kv files written by sessions with file sink, files of an engine are in a sub dir named by engine id")
+	cfg.FlagSet.StringVar(&cfg.SinkFormat, "sink-format", SinkFormatKV, "format of sink files, one of kv|sst")
+	cfg.FlagSet.IntVar(&cfg.SinkFileBytes, "sink-file-bytes", 256*1024*1024, "kv bytes buffered by a session before written to a sorted sink file")
 	cfg.FlagSet.StringVar(&cfg.configFile, "config", "", "toml config file path")
 	// cfg.FlagSet.StringVar(&cfg.StoreCfg.Path, "store", "", "pd path")
 	return cfg
@@ -31,7 +94,68 @@ type Config struct {
 	TiDBUser     string `toml:"tidb-user" json:"tidb_user"`
 	TiDBPass     string `toml:"tidb-pass" json:"tidb_pass"`
 	TiDBHttpAddr string `toml:"tidb-http-addr" json:"tidb_http_addr"`
+	PdAddr       string `toml:"pd-addr" json:"pd_addr"`
+	Oracle       string `toml:"oracle" json:"oracle"`
+	IdStep       int64  `toml:"id-step" json:"id_step"`
 	configFile   string
+
+	// SessionTTL is the lease of sessions, which is extended by writes and heartbeats.
+	// It's 0 by default, sessions never expire unless it's set.
+	SessionTTL Duration `toml:"session-ttl" json:"session_ttl"`
+	// Checkpoint is the backend of session checkpoints, which are used to restore sessions after restart.
+	Checkpoint       string `toml:"checkpoint" json:"checkpoint"`
+	CheckpointDir    string `toml:"checkpoint-dir" json:"checkpoint_dir"`
+	CheckpointSchema string `toml:"checkpoint-schema" json:"checkpoint_schema"`
+	// BatchBytes and BatchKvs limit the size of a write batch, a kv pair larger than the limit is sent alone.
+	BatchBytes int `toml:"batch-bytes" json:"batch_bytes"`
+	BatchKvs   int `toml:"batch-kvs" json:"batch_kvs"`
+	// CoalesceBytes enables merging small writes into large batches, which are sent when
+	// the size is reached or CoalesceInterval passed.
+	CoalesceBytes    int      `toml:"coalesce-bytes" json:"coalesce_bytes"`
+	CoalesceInterval Duration `toml:"coalesce-interval" json:"coalesce_interval"`
+	// EncodeWorkers is the size of encoder pool of a session, encoders are created from the same ddl.
+	EncodeWorkers int `toml:"encode-workers" json:"encode_workers"`
+	// WriteStreams is the default number of write streams of a session, it can be set when opening a session.
+	WriteStreams int `toml:"write-streams" json:"write_streams"`
+	// AckWrites makes writes committed only after importer acknowledges them, the write stream is
+	// completed to get the response every AckInterval or when AckBytes are sent.
+	AckWrites   bool     `toml:"ack-writes" json:"ack_writes"`
+	AckInterval Duration `toml:"ack-interval" json:"ack_interval"`
+	AckBytes    int      `toml:"ack-bytes" json:"ack_bytes"`
+	// RetryBufferBytes bounds batches kept to replay when the write stream reconnects.
+	RetryBufferBytes int      `toml:"retry-buffer-bytes" json:"retry_buffer_bytes"`
+	RetryLimit       int      `toml:"retry-limit" json:"retry_limit"`
+	RetryBackoff     Duration `toml:"retry-backoff" json:"retry_backoff"`
+	RetryMaxBackoff  Duration `toml:"retry-max-backoff" json:"retry_max_backoff"`
+
+	// QueueBytes bounds batches queued in a write stream, a write waits EnqueueTimeout for room in
+	// the queue, and is rejected with 429, or 503 if the importer is unreachable.
+	QueueBytes     int      `toml:"queue-bytes" json:"queue_bytes"`
+	EnqueueTimeout Duration `toml:"enqueue-timeout" json:"enqueue_timeout"`
+
+	// SpillDir enables spilling batches to local segment files when more than SpillBytes are queued
+	// in a write stream, so writes are accepted while the importer is slow or restarting.
+	// Spilled batches don't survive a restart of lighting, spill queues left in it are removed at startup,
+	// so it should not be shared by lighting instances. It can't be used with AckWrites.
+	SpillDir          string `toml:"spill-dir" json:"spill_dir"`
+	SpillBytes        int    `toml:"spill-bytes" json:"spill_bytes"`
+	SpillSegmentBytes int    `toml:"spill-segment-bytes" json:"spill_segment_bytes"`
+
+	// ImportModeInterval is the interval to re-assert import mode of tikv clusters held by jobs,
+	// importing engines or client, since tikv drops out of import mode after a timeout.
+	ImportModeInterval Duration `toml:"import-mode-interval" json:"import_mode_interval"`
+	// ImportModeState saves clusters in import mode, so they are restored if lighting crashes.
+	ImportModeState string `toml:"import-mode-state" json:"import_mode_state"`
+
+	// SchemaCatalog is a local toml or json catalog of table ids and ddls, which is used instead of
+	// tidb to get table schemas, so tables can be encoded without tidb.
+	SchemaCatalog string `toml:"schema-catalog" json:"schema_catalog"`
+
+	// SinkDir is where sessions with file sink write sorted kv files, instead of streaming to importer.
+	// The files of an engine are replayed to importer by `lighting replay`.
+	SinkDir       string `toml:"sink-dir" json:"sink_dir"`
+	SinkFormat    string `toml:"sink-format" json:"sink_format"`
+	SinkFileBytes int    `toml:"sink-file-bytes" json:"sink_file_bytes"`
 }
 
 func (c *Config) String() string {
@@ -73,16 +197,100 @@ func (c *Config) Validate() error {
 		return errors.Errorf("addr should not be empty")
 	}
 
-	if c.ImporterAddr == "" {
-		return errors.Errorf("import-addr should not be empty")
+	if c.SchemaCatalog == "" {
+		if c.TiDBHttpAddr == "" {
+			return errors.Errorf("tidb-http-addr should not be empty")
+		}
+
+		if c.TiDBAddr == "" {
+			return errors.Errorf("tidb-addr should not be empty")
+		}
+	}
+
+	if c.SessionTTL.Duration < 0 {
+		return errors.Errorf("session-ttl should not be negative")
+	}
+
+	switch c.Checkpoint {
+	case CheckpointNone:
+	case CheckpointTiDB:
+		if c.TiDBAddr == "" {
+			return errors.Errorf("tidb-addr should not be empty when checkpoint is %s", CheckpointTiDB)
+		}
+	case CheckpointFile:
+		if c.CheckpointDir == "" {
+			return errors.Errorf("checkpoint-dir should not be empty")
+		}
+	default:
+		return errors.Errorf("invalid checkpoint %s, should be one of %s|%s|%s", c.Checkpoint, CheckpointNone, CheckpointFile, CheckpointTiDB)
+	}
+
+	if c.IdStep <= 0 {
+		return errors.Errorf("id-step should be positive")
+	}
+	if c.BatchBytes <= 0 || c.BatchKvs <= 0 {
+		return errors.Errorf("batch-bytes and batch-kvs should be positive")
+	}
+	if c.EncodeWorkers <= 0 {
+		return errors.Errorf("encode-workers should be positive")
+	}
+	if c.WriteStreams <= 0 {
+		return errors.Errorf("write-streams should be positive")
+	}
+	if c.CoalesceBytes < 0 || c.CoalesceBytes > c.BatchBytes {
+		return errors.Errorf("coalesce-bytes should be in [0, batch-bytes]")
+	}
+	if c.CoalesceBytes > 0 && c.CoalesceInterval.Duration <= 0 {
+		return errors.Errorf("coalesce-interval should be positive")
+	}
+	if c.AckWrites && (c.AckInterval.Duration <= 0 || c.AckBytes <= 0) {
+		return errors.Errorf("ack-interval and ack-bytes should be positive")
+	}
+	if c.RetryBufferBytes < c.BatchBytes {
+		return errors.Errorf("retry-buffer-bytes should not be less than batch-bytes")
+	}
+	if c.RetryLimit < 0 || c.RetryBackoff.Duration <= 0 || c.RetryMaxBackoff.Duration < c.RetryBackoff.Duration {
+		return errors.Errorf("invalid retry policy, retry-limit: %d, retry-backoff: %v, retry-max-backoff: %v",
+			c.RetryLimit, c.RetryBackoff, c.RetryMaxBackoff)
+	}
+	if c.QueueBytes < c.BatchBytes {
+		return errors.Errorf("queue-bytes should not be less than batch-bytes")
+	}
+	if c.EnqueueTimeout.Duration <= 0 {
+		return errors.Errorf("enqueue-timeout should be positive")
+	}
+	if c.ImportModeInterval.Duration <= 0 {
+		return errors.Errorf("import-mode-interval should be positive")
+	}
+	if c.SpillDir != "" {
+		if c.AckWrites {
+			return errors.Errorf("spill-dir can't be used with ack-writes, spilled writes are finished before they are acknowledged")
+		}
+		if c.SpillBytes <= 0 || c.SpillBytes > c.QueueBytes {
+			return errors.Errorf("spill-bytes should be in (0, queue-bytes]")
+		}
+		if c.SpillSegmentBytes <= 0 {
+			return errors.Errorf("spill-segment-bytes should be positive")
+		}
 	}
 
-	if c.TiDBHttpAddr == "" {
-		return errors.Errorf("tidb-http-addr should not be empty")
+	switch c.SinkFormat {
+	case SinkFormatKV, SinkFormatSST:
+	default:
+		return errors.Errorf("invalid sink-format %s, should be one of %s|%s", c.SinkFormat, SinkFormatKV, SinkFormatSST)
+	}
+	if c.SinkDir == "" || c.SinkFileBytes <= 0 {
+		return errors.Errorf("sink-dir should not be empty, and sink-file-bytes should be positive")
 	}
 
-	if c.TiDBAddr == "" {
-		return errors.Errorf("tidb-addr should not be empty")
+	switch c.Oracle {
+	case OracleAuto, OracleLocal:
+	case OraclePd:
+		if c.PdAddr == "" {
+			return errors.Errorf("pd-addr should not be empty when oracle is %s", OraclePd)
+		}
+	default:
+		return errors.Errorf("invalid oracle %s, should be one of %s|%s|%s", c.Oracle, OracleAuto, OraclePd, OracleLocal)
 	}
 	return nil
 }
@@ -92,3 +300,25 @@ func (c *Config) configFromFile(path string) error {
 	_, err := toml.DecodeFile(path, c)
 	return errors.WithStack(err)
 }
+
+// Duration is a time.Duration which can be set by flag or toml string like "10m".
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) Set(s string) error {
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	d.Duration = duration
+	return nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	return d.Set(string(text))
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.Duration.String()), nil
+}
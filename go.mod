@@ -76,9 +76,9 @@ require (
 	github.com/onsi/gomega v1.4.1 // indirect
 	github.com/opentracing/opentracing-go v1.0.2 // indirect
 	github.com/pingcap/check v0.0.0-20171206051426-1c287c953996 // indirect
-	github.com/pingcap/goleveldb v0.0.0-20171020122428-b9ff6c35079e // indirect
+	github.com/pingcap/goleveldb v0.0.0-20171020122428-b9ff6c35079e
 	github.com/pingcap/kvproto v0.0.0-20180817014909-279515615485
-	github.com/pingcap/pd v2.0.5+incompatible // indirect
+	github.com/pingcap/pd v2.0.5+incompatible
 	github.com/pingcap/tidb v2.0.6+incompatible
 	github.com/pingcap/tipb v0.0.0-20180327062906-2d5073e5521a // indirect
 	github.com/pkg/errors v0.8.0
@@ -0,0 +1,389 @@
+// Package mockimporter is an in-memory ImportKV server for tests and local development.
+//
+// Engines are kept as sorted kv stores, and every mutation received is recorded, so tests can
+// assert exactly what arrived. Faults like dropped write streams, EngineNotFound and delays can
+// be injected.
+package mockimporter
+
+import (
+	"context"
+	"github.com/pingcap/kvproto/pkg/import_kvpb"
+	"github.com/pingcap/kvproto/pkg/import_sstpb"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type EngineState string
+
+const (
+	EngineOpened   EngineState = "opened"
+	EngineClosed   EngineState = "closed"
+	EngineImported EngineState = "imported"
+)
+
+// KV is a kv pair in engine.
+type KV struct {
+	Key   []byte
+	Value []byte
+}
+
+// EngineStats is the statistics of write streams of engine.
+type EngineStats struct {
+	// Batches is the number of batches received.
+	Batches int
+	// Streams is the number of write streams completed.
+	Streams int
+}
+
+type engine struct {
+	state EngineState
+	// keys is sorted, values are in kvs.
+	keys      []string
+	kvs       map[string][]byte
+	mutations []*import_kvpb.Mutation
+	stats     EngineStats
+}
+
+func newEngine() *engine {
+	return &engine{state: EngineOpened, kvs: make(map[string][]byte)}
+}
+
+func (e *engine) apply(m *import_kvpb.Mutation) {
+	key := string(m.Key)
+	_, exists := e.kvs[key]
+	i := sort.SearchStrings(e.keys, key)
+	switch m.Op {
+	case import_kvpb.Mutation_Put:
+		if !exists {
+			e.keys = append(e.keys, "")
+			copy(e.keys[i+1:], e.keys[i:])
+			e.keys[i] = key
+		}
+		e.kvs[key] = m.Value
+	default:
+		if exists {
+			e.keys = append(e.keys[:i], e.keys[i+1:]...)
+			delete(e.kvs, key)
+		}
+	}
+	e.mutations = append(e.mutations, m)
+}
+
+// Faults are failures injected into following requests, they are consumed as they are used.
+type Faults struct {
+	// DropStreams is the number of following write streams which are broken after DropAfterBatches batches.
+	DropStreams      int
+	DropAfterBatches int
+	// EngineNotFound is the number of following write streams answered with EngineNotFound when completed.
+	EngineNotFound int
+	// CloseErrors and ImportErrors are the number of following close and import requests which fail.
+	CloseErrors  int
+	ImportErrors int
+	// Delay is the wait before handling each request and batch.
+	Delay time.Duration
+}
+
+// Server implements import_kvpb.ImportKVServer in memory.
+type Server struct {
+	// ImportKVServer is embedded for methods added to the service later, they panic if called.
+	import_kvpb.ImportKVServer
+
+	mu          sync.Mutex
+	engines     map[string]*engine
+	modes       map[string][]import_sstpb.SwitchMode
+	compactions int
+	faults      Faults
+
+	grpcServer *grpc.Server
+	addr       string
+}
+
+func New() *Server {
+	return &Server{
+		engines: make(map[string]*engine),
+		modes:   make(map[string][]import_sstpb.SwitchMode),
+	}
+}
+
+// Start serves on addr, and returns the address listened, addr may have port 0.
+func (s *Server) Start(addr string) (string, error) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	s.grpcServer = grpc.NewServer()
+	import_kvpb.RegisterImportKVServer(s.grpcServer, s)
+	s.addr = lis.Addr().String()
+	go func() {
+		if err := s.grpcServer.Serve(lis); err != nil {
+			logrus.Errorf("[mock_importer] serve error: %v", err)
+		}
+	}()
+	logrus.Infof("[mock_importer] listen on %s", s.addr)
+	return s.addr, nil
+}
+
+// Stop stops the server at once, write streams in progress are broken.
+func (s *Server) Stop() {
+	if s.grpcServer != nil {
+		s.grpcServer.Stop()
+	}
+}
+
+func (s *Server) Addr() string {
+	return s.addr
+}
+
+// InjectFaults replaces faults injected before.
+func (s *Server) InjectFaults(faults Faults) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = faults
+}
+
+func (s *Server) delay() {
+	s.mu.Lock()
+	delay := s.faults.Delay
+	s.mu.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// engineKey is the key of engine in map, engine ids are raw bytes which are usually uuids.
+func engineKey(id []byte) string {
+	return string(id)
+}
+
+func engineNotFound(id []byte) *import_kvpb.Error {
+	return &import_kvpb.Error{EngineNotFound: &import_kvpb.Error_EngineNotFound{Uuid: id}}
+}
+
+// EngineState returns the state of engine, ok is false if the engine is not exist.
+func (s *Server) EngineState(id []byte) (state EngineState, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.engines[engineKey(id)]
+	if !ok {
+		return "", false
+	}
+	return e.state, true
+}
+
+// Mutations returns mutations received by engine in order.
+func (s *Server) Mutations(id []byte) []*import_kvpb.Mutation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.engines[engineKey(id)]
+	if !ok {
+		return nil
+	}
+	return append([]*import_kvpb.Mutation(nil), e.mutations...)
+}
+
+// KVs returns kv pairs of engine in key order.
+func (s *Server) KVs(id []byte) []KV {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.engines[engineKey(id)]
+	if !ok {
+		return nil
+	}
+	kvs := make([]KV, 0, len(e.keys))
+	for _, key := range e.keys {
+		kvs = append(kvs, KV{Key: []byte(key), Value: e.kvs[key]})
+	}
+	return kvs
+}
+
+// Get returns the value of key in engine.
+func (s *Server) Get(id []byte, key []byte) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.engines[engineKey(id)]
+	if !ok {
+		return nil, false
+	}
+	value, ok := e.kvs[string(key)]
+	return value, ok
+}
+
+func (s *Server) EngineStats(id []byte) EngineStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.engines[engineKey(id)]
+	if !ok {
+		return EngineStats{}
+	}
+	return e.stats
+}
+
+// Modes returns modes switched for the tikv cluster of pdAddr in order.
+func (s *Server) Modes(pdAddr string) []import_sstpb.SwitchMode {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]import_sstpb.SwitchMode(nil), s.modes[pdAddr]...)
+}
+
+// Compactions returns the number of compact requests.
+func (s *Server) Compactions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.compactions
+}
+
+func (s *Server) SwitchMode(ctx context.Context, req *import_kvpb.SwitchModeRequest) (*import_kvpb.SwitchModeResponse, error) {
+	s.delay()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.modes[req.PdAddr] = append(s.modes[req.PdAddr], req.GetRequest().GetMode())
+	return &import_kvpb.SwitchModeResponse{}, nil
+}
+
+func (s *Server) OpenEngine(ctx context.Context, req *import_kvpb.OpenEngineRequest) (*import_kvpb.OpenEngineResponse, error) {
+	s.delay()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := engineKey(req.Uuid)
+	e, ok := s.engines[key]
+	if !ok {
+		s.engines[key] = newEngine()
+		return &import_kvpb.OpenEngineResponse{}, nil
+	}
+	if e.state != EngineOpened {
+		return nil, status.Errorf(codes.FailedPrecondition, "engine %x is %s", req.Uuid, e.state)
+	}
+	return &import_kvpb.OpenEngineResponse{}, nil
+}
+
+func (s *Server) WriteEngine(stream import_kvpb.ImportKV_WriteEngineServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	head := req.GetHead()
+	if head == nil {
+		return status.Errorf(codes.InvalidArgument, "write head is missing")
+	}
+	s.delay()
+
+	s.mu.Lock()
+	dropAfter := -1
+	if s.faults.DropStreams > 0 {
+		s.faults.DropStreams--
+		dropAfter = s.faults.DropAfterBatches
+	}
+	s.mu.Unlock()
+
+	batches := 0
+	for {
+		req, err = stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if batches == dropAfter {
+			return status.Errorf(codes.Unavailable, "write stream is dropped after %d batches", batches)
+		}
+		batches++
+		s.delay()
+
+		s.mu.Lock()
+		if e, ok := s.engines[engineKey(head.Uuid)]; ok && e.state == EngineOpened {
+			e.stats.Batches++
+			for _, m := range req.GetBatch().GetMutations() {
+				e.apply(m)
+			}
+		}
+		s.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.engines[engineKey(head.Uuid)]
+	if !ok || e.state != EngineOpened || s.faults.EngineNotFound > 0 {
+		if s.faults.EngineNotFound > 0 {
+			s.faults.EngineNotFound--
+		}
+		return stream.SendAndClose(&import_kvpb.WriteEngineResponse{Error: engineNotFound(head.Uuid)})
+	}
+	e.stats.Streams++
+	return stream.SendAndClose(&import_kvpb.WriteEngineResponse{})
+}
+
+func (s *Server) CloseEngine(ctx context.Context, req *import_kvpb.CloseEngineRequest) (*import_kvpb.CloseEngineResponse, error) {
+	s.delay()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.faults.CloseErrors > 0 {
+		s.faults.CloseErrors--
+		return nil, status.Errorf(codes.Unavailable, "injected close error")
+	}
+	e, ok := s.engines[engineKey(req.Uuid)]
+	if !ok {
+		return &import_kvpb.CloseEngineResponse{Error: engineNotFound(req.Uuid)}, nil
+	}
+	if e.state == EngineOpened {
+		e.state = EngineClosed
+	}
+	return &import_kvpb.CloseEngineResponse{}, nil
+}
+
+func (s *Server) ImportEngine(ctx context.Context, req *import_kvpb.ImportEngineRequest) (*import_kvpb.ImportEngineResponse, error) {
+	s.delay()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.faults.ImportErrors > 0 {
+		s.faults.ImportErrors--
+		return nil, status.Errorf(codes.Unavailable, "injected import error")
+	}
+	key := engineKey(req.Uuid)
+	e, ok := s.engines[key]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "engine %x is not found", req.Uuid)
+	}
+	if e.state == EngineOpened {
+		return nil, status.Errorf(codes.FailedPrecondition, "engine %x is not closed", req.Uuid)
+	}
+	e.state = EngineImported
+	return &import_kvpb.ImportEngineResponse{}, nil
+}
+
+func (s *Server) CleanupEngine(ctx context.Context, req *import_kvpb.CleanupEngineRequest) (*import_kvpb.CleanupEngineResponse, error) {
+	s.delay()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.engines, engineKey(req.Uuid))
+	return &import_kvpb.CleanupEngineResponse{}, nil
+}
+
+func (s *Server) CompactCluster(ctx context.Context, req *import_kvpb.CompactClusterRequest) (*import_kvpb.CompactClusterResponse, error) {
+	s.delay()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.compactions++
+	return &import_kvpb.CompactClusterResponse{}, nil
+}
+
+// ParseAddr returns the listen address of a mock:// importer address, ok is false if addr is not a mock one.
+// An empty address listens on a random local port.
+func ParseAddr(addr string) (listenAddr string, ok bool) {
+	if !strings.HasPrefix(addr, "mock://") {
+		return "", false
+	}
+	listenAddr = strings.TrimPrefix(addr, "mock://")
+	if listenAddr == "" {
+		listenAddr = "127.0.0.1:0"
+	}
+	return listenAddr, true
+}
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/meta"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"sort"
+	"sync"
+)
+
+// idReserver reserves row ids of a table from a global source.
+type idReserver interface {
+	// Reserve reserves n ids of table, ids in (base, base+n] are reserved.
+	Reserve(dbId, tableId, n int64) (base int64, err error)
+	// Rebase makes sure following reserved ids are greater than newBase.
+	// Ids reserved before are not affected, they may be allocated by other sessions.
+	Rebase(dbId, tableId, newBase int64) error
+}
+
+// metaIdReserver reserves ids from tidb auto id meta, so ids are disjoint with
+// the ones allocated by tidb and other lighting instances.
+type metaIdReserver struct {
+	store kv.Storage
+}
+
+func (r *metaIdReserver) Reserve(dbId, tableId, n int64) (int64, error) {
+	var end int64
+	err := kv.RunInNewTxn(r.store, true, func(txn kv.Transaction) error {
+		var err error
+		end, err = meta.NewMeta(txn).GenAutoTableID(dbId, tableId, n)
+		return err
+	})
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return end - n, nil
+}
+
+func (r *metaIdReserver) Rebase(dbId, tableId, newBase int64) error {
+	return RebaseAutoId(r.store, dbId, tableId, newBase)
+}
+
+// localIdReserver reserves ids in memory, ids are only disjoint in this process, and the reserved
+// ranges are lost after restart, so a restored session may collide with sessions opened after restart.
+type localIdReserver struct {
+	sync.Mutex
+	bases map[int64]int64
+}
+
+func (r *localIdReserver) Reserve(dbId, tableId, n int64) (int64, error) {
+	r.Lock()
+	defer r.Unlock()
+	base := r.bases[tableId]
+	r.bases[tableId] = base + n
+	return base, nil
+}
+
+func (r *localIdReserver) Rebase(dbId, tableId, newBase int64) error {
+	r.Lock()
+	defer r.Unlock()
+	if newBase > r.bases[tableId] {
+		r.bases[tableId] = newBase
+	}
+	return nil
+}
+
+// idRange is a range of row ids, ids in (base, end] are in it.
+type idRange struct {
+	base int64
+	end  int64
+}
+
+// idRanges is sorted disjoint id ranges.
+type idRanges []idRange
+
+// contains returns whether id is in one of the ranges.
+func (r idRanges) contains(id int64) bool {
+	i := sort.Search(len(r), func(i int) bool { return r[i].end >= id })
+	return i < len(r) && r[i].base < id
+}
+
+// add inserts rg into the ranges, and merges it with adjacent ones.
+func (r idRanges) add(rg idRange) idRanges {
+	i := sort.Search(len(r), func(i int) bool { return r[i].base >= rg.base })
+	r = append(r, idRange{})
+	copy(r[i+1:], r[i:])
+	r[i] = rg
+	if i+1 < len(r) && r[i].end >= r[i+1].base {
+		if r[i+1].end > r[i].end {
+			r[i].end = r[i+1].end
+		}
+		r = append(r[:i+1], r[i+2:]...)
+	}
+	if i > 0 && r[i-1].end >= r[i].base {
+		if r[i].end > r[i-1].end {
+			r[i-1].end = r[i].end
+		}
+		r = append(r[:i], r[i+1:]...)
+	}
+	return r
+}
+
+// TableAllocators is the registry of row id allocators shared by sessions of the same table.
+// Each session reserves disjoint id ranges from it.
+type TableAllocators struct {
+	reserver idReserver
+	step     int64
+
+	mu sync.Mutex
+	// reserved is the id ranges reserved by sessions of this process, keyed by table id.
+	reserved map[int64]idRanges
+}
+
+func NewTableAllocators(store kv.Storage, step int64) *TableAllocators {
+	var reserver idReserver
+	if store != nil {
+		reserver = &metaIdReserver{store: store}
+	} else {
+		logrus.Warnf("store is not opened, row ids are only reserved in memory")
+		reserver = &localIdReserver{bases: make(map[int64]int64)}
+	}
+	return &TableAllocators{
+		reserver: reserver,
+		step:     step,
+		reserved: make(map[int64]idRanges),
+	}
+}
+
+// reserve reserves a range of step ids of table, and returns its base.
+func (t *TableAllocators) reserve(dbId, tableId int64) (int64, error) {
+	base, err := t.reserver.Reserve(dbId, tableId, t.step)
+	if err != nil {
+		return 0, err
+	}
+	t.track(tableId, idRange{base: base, end: base + t.step})
+	return base, nil
+}
+
+// track records rg as reserved by a session of table.
+func (t *TableAllocators) track(tableId int64, rg idRange) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.reserved[tableId] = t.reserved[tableId].add(rg)
+}
+
+// checkExplicitId returns an error if an explicit id of table is in the ranges reserved by sessions,
+// whose ids may be allocated to other rows.
+func (t *TableAllocators) checkExplicitId(tableId, id int64) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.reserved[tableId].contains(id) {
+		return errors.Errorf("explicit row id %d of table %d collides with ids reserved by sessions", id, tableId)
+	}
+	return nil
+}
+
+// NewSessionAllocator creates an allocator for a session, which allocates ids of table tableId.
+func (t *TableAllocators) NewSessionAllocator(dbId, tableId int64) *SessionAllocator {
+	return &SessionAllocator{
+		registry: t,
+		dbId:     dbId,
+		tableId:  tableId,
+	}
+}
+
+// SessionAllocator implements autoid.Allocator, it allocates ids from ranges reserved for the session.
+// The table id passed by kvencoder is the id of the mocked table, so it's ignored.
+type SessionAllocator struct {
+	sync.Mutex
+	registry *TableAllocators
+	dbId     int64
+	tableId  int64
+
+	// ids in (base, end] can be allocated, and (start, end] is the current reserved range.
+	start int64
+	base  int64
+	end   int64
+}
+
+func (a *SessionAllocator) Alloc(_ int64) (int64, error) {
+	a.Lock()
+	defer a.Unlock()
+	if a.base >= a.end {
+		base, err := a.registry.reserve(a.dbId, a.tableId)
+		if err != nil {
+			return 0, err
+		}
+		logrus.Infof("reserve row ids (%d, %d] of table %d", base, base+a.registry.step, a.tableId)
+		a.start, a.base, a.end = base, base, base+a.registry.step
+	}
+	a.base++
+	return a.base, nil
+}
+
+// Rebase is called when a row is inserted with an explicit auto id.
+// Ids not greater than newBase will not be allocated by this session after rebase, and newly reserved
+// ranges of all sessions are after newBase. An explicit id out of the current range of session is
+// rejected if it's in a range reserved by sessions of this process, as it may collide with their ids.
+func (a *SessionAllocator) Rebase(_ int64, newBase int64, _ bool) error {
+	a.Lock()
+	defer a.Unlock()
+	if newBase > a.start && newBase <= a.end {
+		if newBase > a.base {
+			a.base = newBase
+		}
+		return nil
+	}
+	if err := a.registry.checkExplicitId(a.tableId, newBase); err != nil {
+		return err
+	}
+	if newBase <= a.base {
+		return nil
+	}
+	if err := a.registry.reserver.Rebase(a.dbId, a.tableId, newBase); err != nil {
+		return err
+	}
+	// drop the current range, next alloc reserves a new one after newBase.
+	a.start, a.base, a.end = newBase, newBase, newBase
+	return nil
+}
+
+// Restore resets the reserved id range, it's used to restore a session from checkpoint.
+func (a *SessionAllocator) Restore(base, end int64) {
+	a.Lock()
+	defer a.Unlock()
+	a.start, a.base, a.end = base, base, end
+	if base < end {
+		a.registry.track(a.tableId, idRange{base: base, end: end})
+	}
+}
+
+// Base returns the last allocated id.
+func (a *SessionAllocator) Base() int64 {
+	a.Lock()
+	defer a.Unlock()
+	return a.base
+}
+
+// End returns the end of reserved id range.
+func (a *SessionAllocator) End() int64 {
+	a.Lock()
+	defer a.Unlock()
+	return a.end
+}
+
+func (a *SessionAllocator) NextGlobalAutoID(_ int64) (int64, error) {
+	a.Lock()
+	defer a.Unlock()
+	return a.base + 1, nil
+}
@@ -0,0 +1,90 @@
+package server_test
+
+import (
+	"github.com/lerencao/tidb-light/server"
+	"testing"
+)
+
+func TestSessionAllocator_Disjoint(t *testing.T) {
+	allocators := server.NewTableAllocators(nil, 10)
+	a1 := allocators.NewSessionAllocator(1, 100)
+	a2 := allocators.NewSessionAllocator(1, 100)
+
+	ids := make(map[int64]bool)
+	for i := 0; i < 25; i++ {
+		for _, a := range []*server.SessionAllocator{a1, a2} {
+			id, err := a.Alloc(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ids[id] {
+				t.Fatalf("id %d is allocated twice", id)
+			}
+			ids[id] = true
+		}
+	}
+}
+
+func TestSessionAllocator_Rebase(t *testing.T) {
+	allocators := server.NewTableAllocators(nil, 10)
+	a1 := allocators.NewSessionAllocator(1, 100)
+	a2 := allocators.NewSessionAllocator(1, 100)
+
+	if _, err := a1.Alloc(0); err != nil {
+		t.Fatal(err)
+	}
+	// rebase out of the reserved range
+	if err := a1.Rebase(0, 100, false); err != nil {
+		t.Fatal(err)
+	}
+	id, err := a2.Alloc(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id <= 100 {
+		t.Fatalf("id should be greater than rebased base 100, got %d", id)
+	}
+	id, err = a1.Alloc(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id <= 100 {
+		t.Fatalf("id should be greater than rebased base 100, got %d", id)
+	}
+}
+
+func TestSessionAllocator_RebaseIntoOthers(t *testing.T) {
+	allocators := server.NewTableAllocators(nil, 10)
+	a1 := allocators.NewSessionAllocator(1, 100)
+	a2 := allocators.NewSessionAllocator(1, 100)
+
+	// a1 reserves (0, 10], a2 reserves (10, 20]
+	for _, a := range []*server.SessionAllocator{a1, a2} {
+		if _, err := a.Alloc(0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// rebase within the own range
+	if err := a1.Rebase(0, 10, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := a1.Rebase(0, 15, false); err == nil {
+		t.Fatal("rebase into the range of another session should fail")
+	}
+	if err := a2.Rebase(0, 5, false); err == nil {
+		t.Fatal("an explicit id below the own range in the range of another session should be rejected")
+	}
+	if err := a1.Rebase(0, 25, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// explicit ids of sessions which don't allocate ids never collide with reserved ranges
+	a3 := allocators.NewSessionAllocator(1, 200)
+	a4 := allocators.NewSessionAllocator(1, 200)
+	if err := a3.Rebase(0, 1000, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := a4.Rebase(0, 500, false); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,27 @@
+package server
+
+import (
+	"fmt"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/meta/autoid"
+	"github.com/pingcap/tidb/store/tikv"
+	"github.com/pkg/errors"
+)
+
+var errNoStore = errors.New("tikv store is not opened, pd-addr should be set")
+
+// OpenStore opens tikv storage through pd, it's used to update tidb meta, such as auto id.
+func OpenStore(pdAddr string) (kv.Storage, error) {
+	store, err := tikv.Driver{}.Open(fmt.Sprintf("tikv://%s?disableGC=true", pdAddr))
+	return store, errors.WithStack(err)
+}
+
+// RebaseAutoId rebases the auto id allocator of table in tidb to newBase,
+// so that the following inserts through tidb will not reuse ids allocated by lighting.
+func RebaseAutoId(store kv.Storage, dbId, tableId, newBase int64) error {
+	if store == nil {
+		return errNoStore
+	}
+	alloc := autoid.NewAllocator(store, dbId)
+	return errors.WithStack(alloc.Rebase(tableId, newBase, false))
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/meta"
+	"github.com/pingcap/tidb/model"
+	"github.com/pingcap/tidb/store/mockstore"
+	"testing"
+)
+
+// newMetaStore creates a mock tikv store with table test.t of id 45 in schema of id 1.
+func newMetaStore(t *testing.T) kv.Storage {
+	store, err := mockstore.NewMockTikvStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = kv.RunInNewTxn(store, false, func(txn kv.Transaction) error {
+		m := meta.NewMeta(txn)
+		if err := m.CreateDatabase(&model.DBInfo{ID: 1, Name: model.NewCIStr("test")}); err != nil {
+			return err
+		}
+		return m.CreateTable(1, &model.TableInfo{ID: 45, Name: model.NewCIStr("t")})
+	})
+	if err != nil {
+		store.Close()
+		t.Fatal(err)
+	}
+	return store
+}
+
+// autoIdOf returns the auto id of table in tidb meta.
+func autoIdOf(t *testing.T, store kv.Storage, dbId, tableId int64) int64 {
+	var id int64
+	err := kv.RunInNewTxn(store, false, func(txn kv.Transaction) error {
+		var err error
+		id, err = meta.NewMeta(txn).GetAutoTableID(dbId, tableId)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestRebaseAutoId(t *testing.T) {
+	store := newMetaStore(t)
+	defer store.Close()
+
+	if err := RebaseAutoId(store, 1, 45, 100); err != nil {
+		t.Fatal(err)
+	}
+	if id := autoIdOf(t, store, 1, 45); id != 100 {
+		t.Fatalf("expect auto id rebased to 100, got %d", id)
+	}
+	// rebasing to a smaller base is a no-op
+	if err := RebaseAutoId(store, 1, 45, 50); err != nil {
+		t.Fatal(err)
+	}
+	if id := autoIdOf(t, store, 1, 45); id != 100 {
+		t.Fatalf("expect auto id kept at 100, got %d", id)
+	}
+
+	if err := RebaseAutoId(store, 2, 45, 200); err == nil {
+		t.Fatal("rebase of an unknown schema id should fail")
+	}
+	if err := RebaseAutoId(store, 1, 46, 200); err == nil {
+		t.Fatal("rebase of an unknown table id should fail")
+	}
+	if err := RebaseAutoId(nil, 1, 45, 200); err != errNoStore {
+		t.Fatalf("expect %v, got %v", errNoStore, err)
+	}
+}
+
+func TestSessionAllocator_MetaRebaseIntoOthers(t *testing.T) {
+	store := newMetaStore(t)
+	defer store.Close()
+	allocators := NewTableAllocators(store, 10)
+	a1 := allocators.NewSessionAllocator(1, 45)
+	a2 := allocators.NewSessionAllocator(1, 45)
+
+	// a1 reserves (0, 10], a2 reserves (10, 20] from tidb meta
+	for _, a := range []*SessionAllocator{a1, a2} {
+		if _, err := a.Alloc(0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a1.Rebase(0, 15, false); err == nil {
+		t.Fatal("rebase into the range of another session should fail")
+	}
+	if err := a1.Rebase(0, 25, false); err != nil {
+		t.Fatal(err)
+	}
+	if id := autoIdOf(t, store, 1, 45); id != 25 {
+		t.Fatalf("expect auto id of tidb rebased to 25, got %d", id)
+	}
+	// a restored range is reserved too
+	a3 := allocators.NewSessionAllocator(1, 45)
+	a3.Restore(100, 110)
+	if err := a1.Rebase(0, 105, false); err == nil {
+		t.Fatal("rebase into the range of a restored session should fail")
+	}
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/lerencao/tidb-light/config"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// SessionCheckpoint is the durable state of a session, which is used to restore the session after restart.
+type SessionCheckpoint struct {
+	SessionId  string `json:"session_id"`
+	EngineId   string `json:"engine_id"`
+	SchemaName string `json:"schema_name"`
+	TableName  string `json:"table_name"`
+	DbId       int64  `json:"db_id"`
+	TableId    int64  `json:"table_id"`
+	DDL        string `json:"ddl"`
+	Streams    int    `json:"streams"`
+	Sink       string `json:"sink,omitempty"`
+	// AllocatorBase and AllocatorEnd is the row id range of allocator, ids in (base, end] are reserved.
+	AllocatorBase int64 `json:"allocator_base"`
+	AllocatorEnd  int64 `json:"allocator_end"`
+	// Seq is the last acknowledged write sequence of client.
+	Seq       uint64    `json:"seq"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// CheckpointStore saves session checkpoints durably.
+type CheckpointStore interface {
+	Save(cp *SessionCheckpoint) error
+	Remove(sessionId string) error
+	LoadAll() ([]*SessionCheckpoint, error)
+	Close() error
+}
+
+// NewCheckpointStore creates checkpoint store by config, it returns nil if checkpoint is disabled.
+func NewCheckpointStore(cfg *config.Config, db *sql.DB) (CheckpointStore, error) {
+	switch cfg.Checkpoint {
+	case config.CheckpointNone:
+		return nil, nil
+	case config.CheckpointFile:
+		return NewFileCheckpointStore(cfg.CheckpointDir)
+	case config.CheckpointTiDB:
+		return NewTableCheckpointStore(db, cfg.CheckpointSchema)
+	default:
+		return nil, errors.Errorf("unknown checkpoint backend %s", cfg.Checkpoint)
+	}
+}
+
+// FileCheckpointStore saves each checkpoint in a json file of dir.
+type FileCheckpointStore struct {
+	dir string
+}
+
+func NewFileCheckpointStore(dir string) (*FileCheckpointStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &FileCheckpointStore{dir: dir}, nil
+}
+
+func (s *FileCheckpointStore) path(sessionId string) string {
+	// session id is hex encoded, so that it's a valid file name
+	return filepath.Join(s.dir, hex.EncodeToString([]byte(sessionId))+".json")
+}
+
+// Save writes checkpoint to a temp file and renames it, so the checkpoint file is always complete.
+func (s *FileCheckpointStore) Save(cp *SessionCheckpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	path := s.path(cp.SessionId)
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		return errors.WithStack(err)
+	}
+	return s.syncDir()
+}
+
+func (s *FileCheckpointStore) syncDir() error {
+	dir, err := os.Open(s.dir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer dir.Close()
+	return errors.WithStack(dir.Sync())
+}
+
+func (s *FileCheckpointStore) Remove(sessionId string) error {
+	err := os.Remove(s.path(sessionId))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func (s *FileCheckpointStore) LoadAll() ([]*SessionCheckpoint, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	cps := make([]*SessionCheckpoint, 0, len(files))
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(s.dir, f.Name()))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		cp := &SessionCheckpoint{}
+		if err = json.Unmarshal(data, cp); err != nil {
+			return nil, errors.Wrapf(err, "invalid checkpoint file %s", f.Name())
+		}
+		cps = append(cps, cp)
+	}
+	return cps, nil
+}
+
+func (s *FileCheckpointStore) Close() error {
+	return nil
+}
+
+// TableCheckpointStore saves checkpoints in a tidb table.
+type TableCheckpointStore struct {
+	db    *sql.DB
+	table string
+}
+
+func NewTableCheckpointStore(db *sql.DB, schema string) (*TableCheckpointStore, error) {
+	if _, err := db.Exec(fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s", quoteName(schema))); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	table := fmt.Sprintf("%s.%s", quoteName(schema), quoteName("session_checkpoints"))
+	_, err := db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		session_id varchar(255) NOT NULL PRIMARY KEY,
+		checkpoint longtext NOT NULL,
+		update_time timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+	)`, table))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &TableCheckpointStore{db: db, table: table}, nil
+}
+
+func (s *TableCheckpointStore) Save(cp *SessionCheckpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = s.db.Exec(fmt.Sprintf("REPLACE INTO %s (session_id, checkpoint) VALUES (?, ?)", s.table), cp.SessionId, string(data))
+	return errors.WithStack(err)
+}
+
+func (s *TableCheckpointStore) Remove(sessionId string) error {
+	_, err := s.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE session_id = ?", s.table), sessionId)
+	return errors.WithStack(err)
+}
+
+func (s *TableCheckpointStore) LoadAll() ([]*SessionCheckpoint, error) {
+	rows, err := s.db.Query(fmt.Sprintf("SELECT checkpoint FROM %s", s.table))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+
+	cps := make([]*SessionCheckpoint, 0)
+	for rows.Next() {
+		var data string
+		if err = rows.Scan(&data); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		cp := &SessionCheckpoint{}
+		if err = json.Unmarshal([]byte(data), cp); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		cps = append(cps, cp)
+	}
+	return cps, errors.WithStack(rows.Err())
+}
+
+func (s *TableCheckpointStore) Close() error {
+	return nil
+}
@@ -0,0 +1,64 @@
+package server_test
+
+import (
+	"github.com/lerencao/tidb-light/server"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestFileCheckpointStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := server.NewFileCheckpointStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp := &server.SessionCheckpoint{
+		SessionId:     "db1/t1:0",
+		EngineId:      "6ba7b810-9dad-11d1-80b4-00c04fd430c8",
+		SchemaName:    "db1",
+		TableName:     "t1",
+		TableId:       42,
+		AllocatorBase: 10,
+		AllocatorEnd:  100,
+		Seq:           3,
+	}
+	if err = store.Save(cp); err != nil {
+		t.Fatal(err)
+	}
+	cp.Seq = 4
+	if err = store.Save(cp); err != nil {
+		t.Fatal(err)
+	}
+
+	// reopen the store, as it's done after restart
+	store, err = server.NewFileCheckpointStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cps, err := store.LoadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cps) != 1 {
+		t.Fatalf("expect 1 checkpoint, got %d", len(cps))
+	}
+	if cps[0].SessionId != cp.SessionId || cps[0].Seq != 4 || cps[0].AllocatorEnd != 100 {
+		t.Fatalf("unexpected checkpoint %+v", cps[0])
+	}
+
+	if err = store.Remove(cp.SessionId); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.Remove(cp.SessionId); err != nil {
+		t.Fatal(err)
+	}
+	if cps, err = store.LoadAll(); err != nil || len(cps) != 0 {
+		t.Fatalf("expect no checkpoint, got %v, error: %v", cps, err)
+	}
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bufio"
+	"github.com/pkg/errors"
+	"io"
+)
+
+// CSVOptions is the format of csv data.
+type CSVOptions struct {
+	// Delimiter separates fields, it's ',' for csv and '\t' for tsv.
+	Delimiter byte
+	// Quote encloses a field, 0 means fields are not quoted.
+	Quote byte
+	// Escape escapes the following char, 0 means no escape char.
+	Escape byte
+	// Null is the marker of NULL value, it's only recognized in unquoted fields.
+	Null string
+	// Header means the first row is column names.
+	Header bool
+}
+
+func DefaultCSVOptions() *CSVOptions {
+	return &CSVOptions{
+		Delimiter: ',',
+		Quote:     '"',
+		Escape:    '\\',
+		Null:      `\N`,
+	}
+}
+
+// CSVParser reads rows from a stream one by one.
+type CSVParser struct {
+	opts *CSVOptions
+	r    *bufio.Reader
+	line int
+
+	field []byte
+	// raw is the field content before unescaping, which is used to recognize null marker.
+	raw []byte
+}
+
+func NewCSVParser(r io.Reader, opts *CSVOptions) *CSVParser {
+	return &CSVParser{
+		opts: opts,
+		r:    bufio.NewReaderSize(r, 64*1024),
+	}
+}
+
+// Line returns the line number of last read row.
+func (p *CSVParser) Line() int {
+	return p.line
+}
+
+// ReadRow reads the next row, a value is nil if it's the null marker, or string otherwise.
+// It returns io.EOF when there is no more rows.
+func (p *CSVParser) ReadRow() ([]interface{}, error) {
+	var row []interface{}
+	inQuote, quoted, started := false, false, false
+	// cr is true if the last char is an unquoted '\r'
+	cr := false
+	p.field, p.raw = p.field[:0], p.raw[:0]
+
+	finishField := func() {
+		if !quoted && p.opts.Null != "" && string(p.raw) == p.opts.Null {
+			row = append(row, nil)
+		} else {
+			row = append(row, string(p.field))
+		}
+		inQuote, quoted, started = false, false, false
+		p.field, p.raw = p.field[:0], p.raw[:0]
+	}
+
+	p.line++
+	for {
+		c, err := p.r.ReadByte()
+		if err == io.EOF {
+			if inQuote {
+				return nil, errors.New("unterminated quoted field")
+			}
+			if row == nil && !started {
+				return nil, io.EOF
+			}
+			finishField()
+			return row, nil
+		}
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		lastCR := cr
+		cr = false
+
+		switch {
+		case p.opts.Escape != 0 && c == p.opts.Escape:
+			next, err := p.r.ReadByte()
+			if err != nil {
+				return nil, errors.New("unexpected end after escape char")
+			}
+			p.raw = append(p.raw, c, next)
+			p.field = append(p.field, unescapeChar(next))
+			started = true
+		case inQuote:
+			if c != p.opts.Quote {
+				if c == '\n' {
+					p.line++
+				}
+				p.field = append(p.field, c)
+				continue
+			}
+			next, err := p.r.Peek(1)
+			if err == nil && next[0] == p.opts.Quote {
+				// doubled quote in quoted field
+				p.r.ReadByte()
+				p.field = append(p.field, c)
+			} else {
+				inQuote = false
+			}
+		case p.opts.Quote != 0 && c == p.opts.Quote && !quoted && len(p.raw) == 0:
+			inQuote, quoted, started = true, true, true
+		case c == p.opts.Delimiter:
+			finishField()
+			// a delimiter means there is a following field
+			started = true
+		case c == '\n':
+			if row == nil && !started {
+				// skip empty line
+				p.line++
+				continue
+			}
+			if lastCR {
+				p.raw = p.raw[:len(p.raw)-1]
+				p.field = p.field[:len(p.field)-1]
+			}
+			finishField()
+			return row, nil
+		default:
+			p.raw = append(p.raw, c)
+			p.field = append(p.field, c)
+			started = true
+			cr = c == '\r'
+		}
+	}
+}
+
+func unescapeChar(c byte) byte {
+	switch c {
+	case 'n':
+		return '\n'
+	case 't':
+		return '\t'
+	case 'r':
+		return '\r'
+	case '0':
+		return 0
+	case 'b':
+		return '\b'
+	case 'Z':
+		return 26
+	default:
+		return c
+	}
+}
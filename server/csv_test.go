@@ -0,0 +1,56 @@
+package server_test
+
+import (
+	"github.com/lerencao/tidb-light/server"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func readAllRows(t *testing.T, data string, opts *server.CSVOptions) [][]interface{} {
+	parser := server.NewCSVParser(strings.NewReader(data), opts)
+	var rows [][]interface{}
+	for {
+		row, err := parser.ReadRow()
+		if err == io.EOF {
+			return rows
+		}
+		if err != nil {
+			t.Fatalf("line %d: %v", parser.Line(), err)
+		}
+		rows = append(rows, row)
+	}
+}
+
+func TestCSVParser(t *testing.T) {
+	data := "1,\"a,b\",\\N\r\n\n2,\"say \"\"hi\"\"\",\"\\N\"\n3,x\\ny,\n"
+	rows := readAllRows(t, data, server.DefaultCSVOptions())
+	expected := [][]interface{}{
+		{"1", "a,b", nil},
+		{"2", `say "hi"`, "N"},
+		{"3", "x\ny", ""},
+	}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Fatalf("expected %q, got %q", expected, rows)
+	}
+}
+
+func TestCSVParser_TSV(t *testing.T) {
+	opts := &server.CSVOptions{Delimiter: '\t', Null: "NULL"}
+	rows := readAllRows(t, "1\t\"a\"\tNULL\n2\t\t", opts)
+	expected := [][]interface{}{
+		{"1", `"a"`, nil},
+		{"2", "", ""},
+	}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Fatalf("expected %q, got %q", expected, rows)
+	}
+}
+
+func TestCSVParser_Unterminated(t *testing.T) {
+	parser := server.NewCSVParser(strings.NewReader("1,\"abc\n"), server.DefaultCSVOptions())
+	if _, err := parser.ReadRow(); err == nil {
+		t.Fatalf("unterminated quoted field should fail")
+	}
+}
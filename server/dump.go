@@ -0,0 +1,146 @@
+package server
+
+import (
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DumpSchema is a schema in a mydumper/dumpling directory.
+type DumpSchema struct {
+	Name string `json:"name"`
+	// CreateFile is the `{schema}-schema-create.sql` file, it may be empty.
+	CreateFile string       `json:"create_file"`
+	Tables     []*DumpTable `json:"tables"`
+	// Views are names of views, which have `{schema}.{view}-schema-view.sql` files. Views are not
+	// imported, and the placeholder tables dumped for them are not in Tables.
+	Views []string `json:"views"`
+	// SkippedFiles are triggers, routines and sequences, which are not imported.
+	SkippedFiles []string `json:"skipped_files"`
+}
+
+// DumpTable is a table in a mydumper/dumpling directory.
+type DumpTable struct {
+	Schema string `json:"schema"`
+	Name   string `json:"name"`
+	// SchemaFile is the `{schema}.{table}-schema.sql` file, it may be empty.
+	SchemaFile string `json:"schema_file"`
+	// DataFiles are `{schema}.{table}[.{n}].sql` and `{schema}.{table}[.{n}].csv` files.
+	DataFiles []string `json:"data_files"`
+}
+
+// skippedSchemaSuffixes are suffixes of schema files dumped besides tables and views,
+// `{schema}.{table}-schema-triggers.sql`, `{schema}-schema-post.sql` and `{schema}.{sequence}-schema-sequence.sql`.
+var skippedSchemaSuffixes = []string{"-schema-triggers.sql", "-schema-post.sql", "-schema-sequence.sql"}
+
+// ScanDumpDir collects schemas, tables and data files of a mydumper/dumpling directory.
+// Schema files other than those of schemas, tables and views are reported in SkippedFiles.
+func ScanDumpDir(dir string) ([]*DumpSchema, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	schemas := make(map[string]*DumpSchema)
+	tables := make(map[string]*DumpTable)
+	getSchema := func(name string) *DumpSchema {
+		schema, ok := schemas[name]
+		if !ok {
+			schema = &DumpSchema{Name: name}
+			schemas[name] = schema
+		}
+		return schema
+	}
+	getTable := func(schemaName, tableName string) *DumpTable {
+		key := schemaName + "." + tableName
+		table, ok := tables[key]
+		if !ok {
+			table = &DumpTable{Schema: schemaName, Name: tableName}
+			tables[key] = table
+			schema := getSchema(schemaName)
+			schema.Tables = append(schema.Tables, table)
+		}
+		return table
+	}
+
+	views := make(map[string]bool)
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		name := f.Name()
+		path := filepath.Join(dir, name)
+		if suffix := skippedSchemaSuffix(name); suffix != "" {
+			schema := getSchema(strings.SplitN(strings.TrimSuffix(name, suffix), ".", 2)[0])
+			schema.SkippedFiles = append(schema.SkippedFiles, path)
+			continue
+		}
+		switch {
+		case strings.HasSuffix(name, "-schema-view.sql"):
+			parts := strings.SplitN(strings.TrimSuffix(name, "-schema-view.sql"), ".", 2)
+			if len(parts) != 2 {
+				return nil, errors.Errorf("invalid view schema file %s", name)
+			}
+			views[parts[0]+"."+parts[1]] = true
+			schema := getSchema(parts[0])
+			schema.Views = append(schema.Views, parts[1])
+		case strings.HasSuffix(name, "-schema-create.sql"):
+			getSchema(strings.TrimSuffix(name, "-schema-create.sql")).CreateFile = path
+		case strings.HasSuffix(name, "-schema.sql"):
+			parts := strings.SplitN(strings.TrimSuffix(name, "-schema.sql"), ".", 2)
+			if len(parts) != 2 {
+				return nil, errors.Errorf("invalid schema file %s", name)
+			}
+			getTable(parts[0], parts[1]).SchemaFile = path
+		case strings.Contains(name, "-schema-") && strings.HasSuffix(name, ".sql"):
+			return nil, errors.Errorf("unknown schema file %s", name)
+		case strings.HasSuffix(name, ".sql"), strings.HasSuffix(name, ".csv"):
+			// {schema}.{table}.sql or {schema}.{table}.{n}.sql
+			parts := strings.Split(strings.TrimSuffix(name, filepath.Ext(name)), ".")
+			if len(parts) < 2 || len(parts) > 3 {
+				return nil, errors.Errorf("invalid data file %s", name)
+			}
+			table := getTable(parts[0], parts[1])
+			table.DataFiles = append(table.DataFiles, path)
+		}
+	}
+
+	result := make([]*DumpSchema, 0, len(schemas))
+	for _, schema := range schemas {
+		tables := schema.Tables[:0]
+		for _, table := range schema.Tables {
+			if views[table.Schema+"."+table.Name] {
+				if len(table.DataFiles) != 0 {
+					return nil, errors.Errorf("view %s.%s has data files", table.Schema, table.Name)
+				}
+				continue
+			}
+			tables = append(tables, table)
+		}
+		schema.Tables = tables
+		sort.Strings(schema.Views)
+		sort.Strings(schema.SkippedFiles)
+		sort.Slice(schema.Tables, func(i, j int) bool {
+			return schema.Tables[i].Name < schema.Tables[j].Name
+		})
+		for _, table := range schema.Tables {
+			sort.Strings(table.DataFiles)
+		}
+		result = append(result, schema)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
+
+func skippedSchemaSuffix(name string) string {
+	for _, suffix := range skippedSchemaSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return suffix
+		}
+	}
+	return ""
+}
@@ -0,0 +1,136 @@
+package server_test
+
+import (
+	"github.com/lerencao/tidb-light/server"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestScanDumpDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{
+		"metadata",
+		"db1-schema-create.sql",
+		"db1.t1-schema.sql",
+		"db1.t1.sql",
+		"db1.t2-schema.sql",
+		"db1.t2.000000001.csv",
+		"db1.t2.000000000.csv",
+	} {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	schemas, err := server.ScanDumpDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(schemas) != 1 || schemas[0].Name != "db1" || len(schemas[0].Tables) != 2 {
+		t.Fatalf("unexpected schemas %+v", schemas)
+	}
+	if schemas[0].CreateFile != filepath.Join(dir, "db1-schema-create.sql") {
+		t.Fatalf("unexpected create file %s", schemas[0].CreateFile)
+	}
+	t2 := schemas[0].Tables[1]
+	expected := []string{filepath.Join(dir, "db1.t2.000000000.csv"), filepath.Join(dir, "db1.t2.000000001.csv")}
+	if t2.Name != "t2" || t2.SchemaFile != filepath.Join(dir, "db1.t2-schema.sql") || !reflect.DeepEqual(t2.DataFiles, expected) {
+		t.Fatalf("unexpected table %+v", t2)
+	}
+}
+
+func TestScanDumpDir_Dumpling(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// files dumped by dumpling with views, triggers, routines and sequences
+	names := []string{
+		"metadata",
+		"test-schema-create.sql",
+		"test-schema-post.sql",
+		"test.t-schema.sql",
+		"test.t-schema-triggers.sql",
+		"test.t.000000000.sql",
+		"test.t.000000001.sql",
+		"test.v-schema.sql",
+		"test.v-schema-view.sql",
+		"test.s-schema-sequence.sql",
+	}
+	for _, name := range names {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	schemas, err := server.ScanDumpDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(schemas) != 1 || len(schemas[0].Tables) != 1 || schemas[0].Tables[0].Name != "t" {
+		t.Fatalf("expect only table t in test, got %+v", schemas)
+	}
+	if files := schemas[0].Tables[0].DataFiles; len(files) != 2 {
+		t.Fatalf("expect 2 data files of t, got %v", files)
+	}
+	if views := schemas[0].Views; !reflect.DeepEqual(views, []string{"v"}) {
+		t.Fatalf("expect view v, got %v", views)
+	}
+	skipped := []string{
+		filepath.Join(dir, "test-schema-post.sql"),
+		filepath.Join(dir, "test.s-schema-sequence.sql"),
+		filepath.Join(dir, "test.t-schema-triggers.sql"),
+	}
+	if !reflect.DeepEqual(schemas[0].SkippedFiles, skipped) {
+		t.Fatalf("expect skipped files %v, got %v", skipped, schemas[0].SkippedFiles)
+	}
+
+	// unknown schema files are not taken as data files
+	if err = ioutil.WriteFile(filepath.Join(dir, "test.t-schema-unknown.sql"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = server.ScanDumpDir(dir); err == nil {
+		t.Fatal("unknown schema file should be rejected")
+	}
+}
+
+func TestSQLReader(t *testing.T) {
+	data := "/*!40101 SET NAMES binary*/;\n" +
+		"/*/ a; */ SELECT 1;\n" +
+		"-- comment;\n" +
+		"INSERT INTO `t;` VALUES (1,'a;\\'b'),(2,\"c;\");\n" +
+		"INSERT INTO t VALUES (3, 'd') ;\n"
+	reader := server.NewSQLReader(strings.NewReader(data))
+	var stmts []string
+	for {
+		stmt, err := reader.ReadStmt()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		stmts = append(stmts, stmt)
+	}
+	expected := []string{
+		"/*!40101 SET NAMES binary*/",
+		"/*/ a; */ SELECT 1",
+		"-- comment;\nINSERT INTO `t;` VALUES (1,'a;\\'b'),(2,\"c;\")",
+		"INSERT INTO t VALUES (3, 'd')",
+	}
+	if !reflect.DeepEqual(stmts, expected) {
+		t.Fatalf("expected %q, got %q", expected, stmts)
+	}
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"fmt"
+	"github.com/pingcap/kvproto/pkg/import_kvpb"
+	"github.com/pingcap/tidb/meta/autoid"
+	"github.com/pingcap/tidb/util/kvencoder"
+	"github.com/pkg/errors"
+	"strings"
+	"sync"
+)
+
+// encodeChunkSize is the number of inputs encoded by a worker in one task.
+const encodeChunkSize = 32
+
+// sessionEncoder is an encoder in the pool of a session.
+type sessionEncoder struct {
+	kvenc.KvEncoder
+	// idx is the index of encoder in pool.
+	idx int
+	// stmts caches prepared insert stmt ids of encoder, keyed by column list.
+	stmts map[string]uint32
+}
+
+// newEncoderPool creates size encoders of ddl, which share the allocator.
+func newEncoderPool(schemaName, ddl string, allocator autoid.Allocator, size int) ([]*sessionEncoder, error) {
+	encoders := make([]*sessionEncoder, 0, size)
+	for i := 0; i < size; i++ {
+		encoder, err := kvenc.New(schemaName, allocator)
+		if err == nil {
+			if err = encoder.ExecDDLSQL(ddl); err != nil {
+				encoder.Close()
+			}
+		}
+		if err != nil {
+			closeEncoders(encoders)
+			return nil, err
+		}
+		encoders = append(encoders, &sessionEncoder{KvEncoder: encoder, idx: i, stmts: make(map[string]uint32)})
+	}
+	return encoders, nil
+}
+
+func closeEncoders(encoders []*sessionEncoder) error {
+	var err error
+	for _, encoder := range encoders {
+		if closeErr := encoder.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// prepareInsert prepares an insert stmt of columns in encoder.
+func (e *sessionEncoder) prepareInsert(schemaName, tableName string, columns []string) (uint32, error) {
+	quoted := make([]string, 0, len(columns))
+	for _, name := range columns {
+		quoted = append(quoted, quoteName(name))
+	}
+	key := strings.Join(quoted, ",")
+	if stmtId, ok := e.stmts[key]; ok {
+		return stmtId, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(columns)), ",")
+	query := fmt.Sprintf("INSERT INTO %s.%s (%s) VALUES (%s)", quoteName(schemaName), quoteName(tableName), key, placeholders)
+	stmtId, err := e.PrepareStmt(query)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	e.stmts[key] = stmtId
+	return stmtId, nil
+}
+
+// encodedChunk is the output of encoding a chunk of inputs.
+type encodedChunk struct {
+	kvs    []*import_kvpb.Mutation
+	result *WriteResult
+	err    error
+	done   chan struct{}
+}
+
+// encodeParallel encodes n inputs in chunks with the encoders of session, chunks are encoded
+// in parallel and returned in order by the channel. The caller must call stop when it's done
+// with the chunks, stop waits until encoders are idle.
+func (s *WriteSession) encodeParallel(n int, encode encodeFunc) (<-chan *encodedChunk, func()) {
+	chunks := make([]*encodedChunk, 0, (n+encodeChunkSize-1)/encodeChunkSize)
+	tasks := make(chan int, cap(chunks))
+	for start := 0; start < n; start += encodeChunkSize {
+		tasks <- len(chunks)
+		chunks = append(chunks, &encodedChunk{done: make(chan struct{})})
+	}
+	close(tasks)
+
+	workers := len(s.encoders)
+	if workers > len(chunks) {
+		workers = len(chunks)
+	}
+	quit := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(encoder *sessionEncoder) {
+			defer wg.Done()
+			for c := range tasks {
+				select {
+				case <-quit:
+					return
+				default:
+				}
+				end := (c + 1) * encodeChunkSize
+				if end > n {
+					end = n
+				}
+				s.encodeChunk(encoder, chunks[c], c*encodeChunkSize, end, encode)
+				close(chunks[c].done)
+			}
+		}(s.encoders[w])
+	}
+
+	out := make(chan *encodedChunk)
+	go func() {
+		defer close(out)
+		for _, chunk := range chunks {
+			select {
+			case <-chunk.done:
+			case <-quit:
+				return
+			}
+			select {
+			case out <- chunk:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() { close(quit) })
+		wg.Wait()
+	}
+	return out, stop
+}
+
+func (s *WriteSession) encodeChunk(encoder *sessionEncoder, chunk *encodedChunk, start, end int, encode encodeFunc) {
+	chunk.result = &WriteResult{Indexes: make(map[string]uint64, len(s.indexes))}
+	chunk.kvs = make([]*import_kvpb.Mutation, 0, end-start)
+	for i := start; i < end; i++ {
+		kvPairs, affectedRows, err := encode(encoder, i)
+		if err != nil {
+			chunk.err = errors.WithStack(err)
+			return
+		}
+		chunk.result.Rows += affectedRows
+
+		for _, pair := range kvPairs {
+			key, err := s.checkKey(pair.Key, chunk.result)
+			if err != nil {
+				chunk.err = err
+				return
+			}
+			chunk.kvs = append(chunk.kvs, &import_kvpb.Mutation{
+				Op:    import_kvpb.Mutation_Put,
+				Key:   key,
+				Value: pair.Val,
+			})
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"github.com/pingcap/tidb/tablecodec"
+	"strings"
+	"testing"
+)
+
+// encodeHandle encodes sql by encoder, and returns the handle of the inserted row.
+func encodeHandle(t *testing.T, encoder *sessionEncoder, sql string) int64 {
+	kvs, _, err := encoder.Encode(sql, 45)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pair := range kvs {
+		if handle, err := tablecodec.DecodeRowKey(pair.Key); err == nil {
+			return handle
+		}
+	}
+	t.Fatalf("no row key is encoded by %s", sql)
+	return 0
+}
+
+func TestEncoderPool(t *testing.T) {
+	ddl := "CREATE TABLE t (id bigint AUTO_INCREMENT, name varchar(16), PRIMARY KEY (id))"
+	allocators := NewTableAllocators(nil, 10)
+	pool1, err := newEncoderPool("test", ddl, allocators.NewSessionAllocator(1, 45), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeEncoders(pool1)
+
+	// an insert stmt is prepared once for each column list in an encoder
+	stmtId, err := pool1[0].prepareInsert("test", "t", []string{"name"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := pool1[0].prepareInsert("test", "t", []string{"name"}); err != nil || id != stmtId {
+		t.Fatalf("expect stmt %d reused, got %d, %v", stmtId, id, err)
+	}
+	if id, err := pool1[0].prepareInsert("test", "t", []string{"id", "name"}); err != nil || id == stmtId {
+		t.Fatalf("expect a new stmt of another column list, got %d, %v", id, err)
+	}
+
+	// encoders of a session share the allocator of session
+	if err = pool1[0].SetSystemVariable("sql_mode", "ANSI_QUOTES"); err != nil {
+		t.Fatal(err)
+	}
+	h1 := encodeHandle(t, pool1[0], "INSERT INTO t (name) VALUES ('a')")
+	h2 := encodeHandle(t, pool1[1], "INSERT INTO t (name) VALUES ('b')")
+	if h1 != 1 || h2 != 2 {
+		t.Fatalf("expect handles 1 and 2 of session 1, got %d and %d", h1, h2)
+	}
+
+	// encoders of another session of the same table have their own allocator and variables
+	pool2, err := newEncoderPool("test", ddl, allocators.NewSessionAllocator(1, 45), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeEncoders(pool2)
+	if mode, _ := pool2[0].GetSystemVariable("sql_mode"); strings.Contains(mode, "ANSI_QUOTES") {
+		t.Fatalf("sql mode of session 1 leaks to session 2: %s", mode)
+	}
+	if h := encodeHandle(t, pool2[0], "INSERT INTO t (name) VALUES ('c')"); h != 11 {
+		t.Fatalf("expect handle 11 from the range of session 2, got %d", h)
+	}
+	// an explicit id rebases the allocator of its session only
+	encodeHandle(t, pool1[0], "INSERT INTO t VALUES (5, 'd')")
+	if h := encodeHandle(t, pool1[1], "INSERT INTO t (name) VALUES ('e')"); h != 6 {
+		t.Fatalf("expect handle 6 after rebase of session 1, got %d", h)
+	}
+	if h := encodeHandle(t, pool2[0], "INSERT INTO t (name) VALUES ('f')"); h != 12 {
+		t.Fatalf("expect handle 12 of session 2, got %d", h)
+	}
+}
@@ -14,21 +14,42 @@ type EngineHandler struct {
 	svr *Server
 }
 
-func (s *EngineHandler) Open(w http.ResponseWriter, r *http.Request) {
+// engineErrorStatus returns 409 for illegal engine state transitions, and 500 for other errors.
+func engineErrorStatus(err error) int {
+	if _, ok := errors.Cause(err).(*EngineStateError); ok {
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+func (s *EngineHandler) List(w http.ResponseWriter, r *http.Request) {
+	s.r.JSON(w, http.StatusOK, s.svr.Engines().List())
+}
+
+func (s *EngineHandler) Get(w http.ResponseWriter, r *http.Request) {
 	engineid := mux.Vars(r)["engineid"]
 	engineId, err := uuid.FromString(engineid)
 	if err != nil {
-		s.r.JSON(w, http.StatusBadRequest, err)
+		s.r.JSON(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	importClient, err := s.svr.GetImportClient()
-	if err != nil {
-		s.r.JSON(w, http.StatusInternalServerError, err)
+	info := s.svr.Engines().Get(engineId)
+	if info == nil {
+		s.r.JSON(w, http.StatusNotFound, "engine is not exist")
 		return
 	}
-	err = importClient.OpenEngine(r.Context(), engineId.Bytes())
+	s.r.JSON(w, http.StatusOK, info)
+}
+
+func (s *EngineHandler) Open(w http.ResponseWriter, r *http.Request) {
+	engineid := mux.Vars(r)["engineid"]
+	engineId, err := uuid.FromString(engineid)
 	if err != nil {
-		s.r.JSON(w, http.StatusInternalServerError, err)
+		s.r.JSON(w, http.StatusBadRequest, err)
+		return
+	}
+	if err = s.svr.OpenEngine(r.Context(), engineId); err != nil {
+		s.r.JSON(w, engineErrorStatus(err), err.Error())
 		return
 	}
 
@@ -42,14 +63,8 @@ func (s *EngineHandler) Close(w http.ResponseWriter, r *http.Request) {
 		s.r.JSON(w, http.StatusBadRequest, err)
 		return
 	}
-	importClient, err := s.svr.GetImportClient()
-	if err != nil {
-		s.r.JSON(w, http.StatusInternalServerError, err)
-		return
-	}
-	err = importClient.CloseEngine(r.Context(), engineId.Bytes())
-	if err != nil {
-		s.r.JSON(w, http.StatusInternalServerError, err)
+	if err = s.svr.CloseEngine(r.Context(), engineId); err != nil {
+		s.r.JSON(w, engineErrorStatus(err), err.Error())
 		return
 	}
 
@@ -75,14 +90,8 @@ func (s *EngineHandler) Import(w http.ResponseWriter, r *http.Request) {
 		s.r.JSON(w, http.StatusBadRequest, errors.Errorf("pd_addr is missing"))
 	}
 
-	importClient, err := s.svr.GetImportClient()
-	if err != nil {
-		s.r.JSON(w, http.StatusInternalServerError, err)
-		return
-	}
-	err = importClient.ImportEngine(r.Context(), engineId.Bytes(), pdAddr)
-	if err != nil {
-		s.r.JSON(w, http.StatusInternalServerError, err)
+	if err = s.svr.ImportEngine(r.Context(), engineId, pdAddr); err != nil {
+		s.r.JSON(w, engineErrorStatus(err), err.Error())
 		return
 	}
 
@@ -97,14 +106,8 @@ func (s *EngineHandler) Cleanup(w http.ResponseWriter, r *http.Request) {
 		s.r.JSON(w, http.StatusBadRequest, err)
 		return
 	}
-	importClient, err := s.svr.GetImportClient()
-	if err != nil {
-		s.r.JSON(w, http.StatusInternalServerError, err)
-		return
-	}
-	err = importClient.CleanupEngine(r.Context(), engineId.Bytes())
-	if err != nil {
-		s.r.JSON(w, http.StatusInternalServerError, err)
+	if err = s.svr.CleanupEngine(r.Context(), engineId); err != nil {
+		s.r.JSON(w, engineErrorStatus(err), err.Error())
 		return
 	}
 
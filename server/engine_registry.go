@@ -0,0 +1,263 @@
+package server
+
+import (
+	"fmt"
+	"github.com/satori/go.uuid"
+	"sort"
+	"sync"
+	"time"
+)
+
+type EngineState string
+
+const (
+	EngineOpened    EngineState = "opened"
+	EngineWriting   EngineState = "writing"
+	EngineClosed    EngineState = "closed"
+	EngineImporting EngineState = "importing"
+	EngineImported  EngineState = "imported"
+	EngineCleaned   EngineState = "cleaned"
+	EngineFailed    EngineState = "failed"
+
+	// engineUnknown is the state of engines unknown to the registry, e.g. opened before restart.
+	engineUnknown EngineState = ""
+)
+
+type engineOp string
+
+const (
+	engineOpOpen    engineOp = "open"
+	engineOpAttach  engineOp = "attach session to"
+	engineOpClose   engineOp = "close"
+	engineOpImport  engineOp = "import"
+	engineOpCleanup engineOp = "cleanup"
+)
+
+// engineTransitions is the states from which an operation is legal.
+// An unknown engine should be closed before import, which is a no-op if it's closed before restart.
+var engineTransitions = map[engineOp][]EngineState{
+	engineOpOpen:    {engineUnknown, EngineOpened, EngineWriting, EngineCleaned},
+	engineOpAttach:  {engineUnknown, EngineOpened, EngineWriting},
+	engineOpClose:   {engineUnknown, EngineOpened, EngineWriting, EngineClosed},
+	engineOpImport:  {EngineClosed},
+	engineOpCleanup: {engineUnknown, EngineClosed, EngineImported, EngineCleaned},
+}
+
+// engineRetries is the operations legal in failed state, keyed by the failed operation.
+// A failed operation can be retried, and a failed engine can always be cleaned up.
+var engineRetries = map[engineOp][]engineOp{
+	engineOpClose:   {engineOpClose, engineOpCleanup},
+	engineOpImport:  {engineOpImport, engineOpCleanup},
+	engineOpCleanup: {engineOpCleanup},
+}
+
+// EngineStateError is returned when an operation is illegal in the current state of engine.
+type EngineStateError struct {
+	EngineId string
+	State    EngineState
+	Op       string
+	// Reason is set if the operation is illegal for other reason than state.
+	Reason string
+}
+
+func (e *EngineStateError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("can't %s engine %s: %s", e.Op, e.EngineId, e.Reason)
+	}
+	return fmt.Sprintf("can't %s engine %s in state %s", e.Op, e.EngineId, e.State)
+}
+
+// EngineInfo is the snapshot of an engine in registry.
+type EngineInfo struct {
+	Id        string      `json:"id"`
+	State     EngineState `json:"state"`
+	Sessions  int         `json:"sessions"`
+	OpenedAt  time.Time   `json:"opened_at"`
+	UpdatedAt time.Time   `json:"updated_at"`
+	Error     string      `json:"error,omitempty"`
+	// FailedOp is the operation failed in failed state.
+	FailedOp string `json:"failed_op,omitempty"`
+}
+
+type engineEntry struct {
+	info EngineInfo
+	// pending is the operation in progress on importer, other operations are rejected until it finishes.
+	pending engineOp
+}
+
+// EngineRegistry tracks engines through their lifecycle, and rejects illegal transitions.
+type EngineRegistry struct {
+	sync.Mutex
+	engines map[string]*engineEntry
+}
+
+func NewEngineRegistry() *EngineRegistry {
+	return &EngineRegistry{engines: make(map[string]*engineEntry)}
+}
+
+func (r *EngineRegistry) entry(id uuid.UUID, now time.Time) *engineEntry {
+	e, ok := r.engines[id.String()]
+	if !ok {
+		e = &engineEntry{info: EngineInfo{Id: id.String(), OpenedAt: now, UpdatedAt: now}}
+		r.engines[id.String()] = e
+	}
+	return e
+}
+
+// check returns an error if op is illegal for e, it should be called with lock held.
+func (r *EngineRegistry) check(e *engineEntry, op engineOp) error {
+	if e.pending != "" {
+		return &EngineStateError{
+			EngineId: e.info.Id,
+			State:    e.info.State,
+			Op:       string(op),
+			Reason:   fmt.Sprintf("%s is in progress", e.pending),
+		}
+	}
+	if e.info.State == EngineFailed {
+		for _, retry := range engineRetries[engineOp(e.info.FailedOp)] {
+			if op == retry {
+				return nil
+			}
+		}
+		return &EngineStateError{
+			EngineId: e.info.Id,
+			State:    e.info.State,
+			Op:       string(op),
+			Reason:   fmt.Sprintf("%s failed", e.info.FailedOp),
+		}
+	}
+	for _, state := range engineTransitions[op] {
+		if e.info.State == state {
+			return nil
+		}
+	}
+	return &EngineStateError{EngineId: e.info.Id, State: e.info.State, Op: string(op)}
+}
+
+// begin marks op in progress on engine, finish must be called after op is done on importer.
+func (r *EngineRegistry) begin(id uuid.UUID, op engineOp) error {
+	r.Lock()
+	defer r.Unlock()
+	now := time.Now()
+	e := r.entry(id, now)
+	if err := r.check(e, op); err != nil {
+		if e.info.State == engineUnknown {
+			delete(r.engines, id.String())
+		}
+		return err
+	}
+	if op == engineOpClose && e.info.Sessions > 0 {
+		return &EngineStateError{
+			EngineId: e.info.Id,
+			State:    e.info.State,
+			Op:       string(op),
+			Reason:   fmt.Sprintf("%d sessions are still writing", e.info.Sessions),
+		}
+	}
+	e.pending = op
+	if op == engineOpImport {
+		e.info.State = EngineImporting
+		e.info.UpdatedAt = now
+	}
+	return nil
+}
+
+// finish moves engine to the next state of op, or to failed state if op failed.
+// A failed open leaves the engine as it was before.
+func (r *EngineRegistry) finish(id uuid.UUID, op engineOp, err error) {
+	r.Lock()
+	defer r.Unlock()
+	e, ok := r.engines[id.String()]
+	if !ok {
+		return
+	}
+	e.pending = ""
+	now := time.Now()
+	if err != nil {
+		if op == engineOpOpen {
+			if e.info.State == engineUnknown {
+				delete(r.engines, id.String())
+			}
+			return
+		}
+		e.info.State = EngineFailed
+		e.info.FailedOp = string(op)
+		e.info.Error = err.Error()
+		e.info.UpdatedAt = now
+		return
+	}
+
+	switch op {
+	case engineOpOpen:
+		if e.info.State == EngineCleaned || e.info.State == engineUnknown {
+			e.info.State = EngineOpened
+			e.info.OpenedAt = now
+		}
+	case engineOpClose:
+		e.info.State = EngineClosed
+	case engineOpImport:
+		e.info.State = EngineImported
+	case engineOpCleanup:
+		e.info.State = EngineCleaned
+	}
+	e.info.Error = ""
+	e.info.FailedOp = ""
+	e.info.UpdatedAt = now
+}
+
+// attach registers a session writing to engine.
+func (r *EngineRegistry) attach(id uuid.UUID) error {
+	r.Lock()
+	defer r.Unlock()
+	now := time.Now()
+	e := r.entry(id, now)
+	if err := r.check(e, engineOpAttach); err != nil {
+		if e.info.State == engineUnknown {
+			delete(r.engines, id.String())
+		}
+		return err
+	}
+	e.info.Sessions++
+	if e.info.State != EngineWriting {
+		e.info.State = EngineWriting
+		e.info.UpdatedAt = now
+	}
+	return nil
+}
+
+// detach unregisters a session of engine.
+func (r *EngineRegistry) detach(id uuid.UUID) {
+	r.Lock()
+	defer r.Unlock()
+	if e, ok := r.engines[id.String()]; ok && e.info.Sessions > 0 {
+		e.info.Sessions--
+	}
+}
+
+// Get returns the info of engine, it returns nil if the engine is unknown.
+func (r *EngineRegistry) Get(id uuid.UUID) *EngineInfo {
+	r.Lock()
+	defer r.Unlock()
+	e, ok := r.engines[id.String()]
+	if !ok {
+		return nil
+	}
+	info := e.info
+	return &info
+}
+
+// List returns infos of all engines in opened order.
+func (r *EngineRegistry) List() []*EngineInfo {
+	r.Lock()
+	defer r.Unlock()
+	infos := make([]*EngineInfo, 0, len(r.engines))
+	for _, e := range r.engines {
+		info := e.info
+		infos = append(infos, &info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].OpenedAt.Before(infos[j].OpenedAt)
+	})
+	return infos
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"github.com/pkg/errors"
+	"github.com/satori/go.uuid"
+	"testing"
+	"time"
+)
+
+func TestEngineRegistry_Transitions(t *testing.T) {
+	cases := []struct {
+		state    EngineState
+		failedOp engineOp
+		op       engineOp
+		ok       bool
+	}{
+		{engineUnknown, "", engineOpOpen, true},
+		{engineUnknown, "", engineOpAttach, true},
+		{engineUnknown, "", engineOpClose, true},
+		{engineUnknown, "", engineOpImport, false},
+		{engineUnknown, "", engineOpCleanup, true},
+		{EngineOpened, "", engineOpAttach, true},
+		{EngineOpened, "", engineOpImport, false},
+		{EngineWriting, "", engineOpOpen, true},
+		{EngineWriting, "", engineOpClose, true},
+		{EngineWriting, "", engineOpCleanup, false},
+		{EngineClosed, "", engineOpAttach, false},
+		{EngineClosed, "", engineOpClose, true},
+		{EngineClosed, "", engineOpImport, true},
+		{EngineImported, "", engineOpImport, false},
+		{EngineImported, "", engineOpCleanup, true},
+		{EngineCleaned, "", engineOpOpen, true},
+		{EngineCleaned, "", engineOpImport, false},
+		// a failed operation can be retried, and a failed engine can be cleaned up
+		{EngineFailed, engineOpClose, engineOpClose, true},
+		{EngineFailed, engineOpClose, engineOpImport, false},
+		{EngineFailed, engineOpClose, engineOpCleanup, true},
+		{EngineFailed, engineOpImport, engineOpImport, true},
+		{EngineFailed, engineOpImport, engineOpClose, false},
+		{EngineFailed, engineOpImport, engineOpCleanup, true},
+		{EngineFailed, engineOpCleanup, engineOpImport, false},
+		{EngineFailed, engineOpCleanup, engineOpCleanup, true},
+	}
+	for _, c := range cases {
+		r := NewEngineRegistry()
+		id := uuid.NewV4()
+		if c.state != engineUnknown {
+			e := r.entry(id, time.Now())
+			e.info.State = c.state
+			e.info.FailedOp = string(c.failedOp)
+		}
+		err := r.begin(id, c.op)
+		if c.ok && err != nil {
+			t.Fatalf("%s should be legal in state %s(%s), got %v", c.op, c.state, c.failedOp, err)
+		}
+		if !c.ok {
+			if _, ok := err.(*EngineStateError); !ok {
+				t.Fatalf("%s should be illegal in state %s(%s), got %v", c.op, c.state, c.failedOp, err)
+			}
+			if c.state == engineUnknown && r.Get(id) != nil {
+				t.Fatalf("unknown engine should not be registered by illegal %s", c.op)
+			}
+		}
+	}
+}
+
+func TestEngineRegistry_FailedOp(t *testing.T) {
+	r := NewEngineRegistry()
+	id := uuid.NewV4()
+	failed := errors.New("failed")
+	for _, op := range []engineOp{engineOpOpen, engineOpClose} {
+		if err := r.begin(id, op); err != nil {
+			t.Fatal(err)
+		}
+		r.finish(id, op, nil)
+	}
+
+	if err := r.begin(id, engineOpImport); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.begin(id, engineOpCleanup); err == nil {
+		t.Fatal("cleanup should be rejected while import is in progress")
+	}
+	r.finish(id, engineOpImport, failed)
+	if info := r.Get(id); info.State != EngineFailed || info.FailedOp != string(engineOpImport) || info.Error != "failed" {
+		t.Fatalf("expect engine failed by import, got %+v", info)
+	}
+
+	// a retried import clears the failure
+	if err := r.begin(id, engineOpImport); err != nil {
+		t.Fatal(err)
+	}
+	r.finish(id, engineOpImport, nil)
+	if info := r.Get(id); info.State != EngineImported || info.FailedOp != "" || info.Error != "" {
+		t.Fatalf("expect engine imported, got %+v", info)
+	}
+}
@@ -0,0 +1,497 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/lerencao/tidb-light/config"
+	"github.com/pingcap/goleveldb/leveldb/opt"
+	"github.com/pingcap/goleveldb/leveldb/storage"
+	"github.com/pingcap/goleveldb/leveldb/table"
+	"github.com/pingcap/kvproto/pkg/import_kvpb"
+	"github.com/sirupsen/logrus"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// SinkImporter streams encoded kv pairs of a session to importer.
+	SinkImporter = "importer"
+	// SinkFile writes encoded kv pairs of a session to local sorted files, which are replayed to importer later.
+	SinkFile = "file"
+)
+
+// sinkRecordHeaderSize is the size of record header in kv files, which is the length of key and value,
+// the commit ts, and crc32 of key and value.
+const sinkRecordHeaderSize = 20
+
+// sinkKV is a kv pair buffered in FileSink.
+type sinkKV struct {
+	key      []byte
+	value    []byte
+	commitTs uint64
+}
+
+// FileSink is an ImportWriter which writes kv pairs to local files instead of importer. Kv pairs are
+// buffered in memory, and written to a new file sorted by key when FileBytes are buffered or on close.
+// A key written twice in a file keeps the later value. Flush appends buffered kv pairs to the journal
+// `<name>.journal` in kv format and syncs it, so flushed kv pairs are durable without starting a new
+// file. The journal is removed once its kv pairs are in a file, and loaded by a new sink of the same name.
+//
+// Files of a sink are named `<name>-<seq>.<format>` in dir. In kv format, a file is a list of records,
+// each is the record header in big endian followed by the key and value. In sst format, a file is a
+// goleveldb table, whose values are the commit ts in big endian followed by the value.
+type FileSink struct {
+	dir       string
+	name      string
+	format    string
+	fileBytes int
+
+	mu           sync.Mutex
+	pending      []*sinkKV
+	pendingBytes int
+	nextSeq      int
+	files        int
+	lastErr      error
+	lastErrAt    time.Time
+
+	// journal is opened on the first flush after a file is written, the first journaled kv pairs
+	// of pending are in it, which are journalBytes in the file.
+	journal      *os.File
+	journaled    int
+	journalBytes int64
+}
+
+// NewFileSink creates a sink writing files of name to dir, sequences of files continue from the ones
+// left in dir, e.g. by a restored session, and kv pairs in the journal left are buffered again.
+func NewFileSink(dir, name, format string, fileBytes int) (*FileSink, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Trace(err)
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, name+"-*."+format))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	nextSeq := 0
+	for _, path := range paths {
+		var seq int
+		base := strings.TrimPrefix(filepath.Base(path), name+"-")
+		if _, err := fmt.Sscanf(base, "%d."+format, &seq); err == nil && seq >= nextSeq {
+			nextSeq = seq + 1
+		}
+	}
+	sink := &FileSink{
+		dir:       dir,
+		name:      name,
+		format:    format,
+		fileBytes: fileBytes,
+		nextSeq:   nextSeq,
+	}
+	if err = sink.loadJournal(); err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+func (s *FileSink) journalPath() string {
+	return filepath.Join(s.dir, s.name+".journal")
+}
+
+// loadJournal buffers kv pairs in the journal left by a sink of the same name. A record torn by
+// a crash is not flushed, so it's dropped, and the journal is rewritten with the complete ones.
+func (s *FileSink) loadJournal() error {
+	path := s.journalPath()
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	err := readKVFile(path, func(key, value []byte, commitTs uint64) error {
+		s.pending = append(s.pending, &sinkKV{key: key, value: value, commitTs: commitTs})
+		s.pendingBytes += len(key) + len(value)
+		s.journalBytes += int64(sinkRecordHeaderSize + len(key) + len(value))
+		return nil
+	})
+	if err != nil {
+		logrus.Warnf("[file_sink] drop the torn tail of journal %s, error: %v", path, err)
+		tmpPath := path + ".tmp"
+		if err = writeKVFile(tmpPath, s.pending); err == nil {
+			err = errors.Trace(os.Rename(tmpPath, path))
+		}
+		if err != nil {
+			os.Remove(tmpPath)
+			return errors.Annotatef(err, "rewrite journal %s", path)
+		}
+	}
+	s.journaled = len(s.pending)
+	logrus.Infof("[file_sink] load %d kv pairs from journal %s", len(s.pending), path)
+	return nil
+}
+
+func (s *FileSink) Open() {}
+
+// Close writes kv pairs left in buffer to a file.
+func (s *FileSink) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.writeFile(); err != nil {
+		logrus.Errorf("fail to close file sink %s, error: %v", s.name, err)
+	}
+	s.closeJournal()
+}
+
+func (s *FileSink) WriteEngine(ctx context.Context, mutation *import_kvpb.WriteBatch) error {
+	future := newWriteFuture()
+	if err := s.push(ctx, mutation, future); err != nil {
+		return err
+	}
+	return future.Wait(ctx)
+}
+
+// Flush makes buffered kv pairs durable in the journal, they are written to a file later.
+func (s *FileSink) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.syncJournal()
+}
+
+// syncJournal appends kv pairs not in the journal yet, and syncs it. It should be called with mu held.
+func (s *FileSink) syncJournal() error {
+	if s.journaled == len(s.pending) {
+		return nil
+	}
+	path := s.journalPath()
+	if s.journal == nil {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return errors.Annotatef(err, "open journal %s", path)
+		}
+		s.journal = file
+	}
+	kvs := s.pending[s.journaled:]
+	w := bufio.NewWriter(s.journal)
+	writeKVRecords(w, kvs)
+	err := w.Flush()
+	if err == nil {
+		err = s.journal.Sync()
+	}
+	if err != nil {
+		// cut the torn records, or else kv pairs appended after them are lost on load
+		if truncErr := s.journal.Truncate(s.journalBytes); truncErr != nil {
+			logrus.Errorf("[file_sink] fail to truncate journal %s, error: %v", path, truncErr)
+		}
+		s.lastErr, s.lastErrAt = err, time.Now()
+		return errors.Annotatef(err, "sync journal %s", path)
+	}
+	for _, kv := range kvs {
+		s.journalBytes += int64(sinkRecordHeaderSize + len(kv.key) + len(kv.value))
+	}
+	s.journaled = len(s.pending)
+	return nil
+}
+
+// closeJournal closes the journal file, it should be called with mu held.
+func (s *FileSink) closeJournal() {
+	if s.journal != nil {
+		s.journal.Close()
+		s.journal = nil
+	}
+}
+
+// AcksWrites is true since flushed kv pairs are durable in the journal.
+func (s *FileSink) AcksWrites() bool {
+	return true
+}
+
+// Coalesces is true since kv pairs are buffered until flush.
+func (s *FileSink) Coalesces() bool {
+	return true
+}
+
+func (s *FileSink) Stats() EngineWriterStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := EngineWriterStats{Streams: 1, QueueBytes: s.pendingBytes, SinkFiles: s.files}
+	if s.lastErr != nil {
+		stats.LastError = &ErrorInfo{Error: s.lastErr.Error(), Time: s.lastErrAt}
+	}
+	return stats
+}
+
+func (s *FileSink) push(ctx context.Context, mutation *import_kvpb.WriteBatch, future *WriteFuture) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range mutation.Mutations {
+		if m.Op != import_kvpb.Mutation_Put {
+			return errors.Errorf("file sink only accepts put, got %s", m.Op)
+		}
+	}
+	pending, pendingBytes := len(s.pending), s.pendingBytes
+	for _, m := range mutation.Mutations {
+		s.pending = append(s.pending, &sinkKV{key: m.Key, value: m.Value, commitTs: mutation.CommitTs})
+		s.pendingBytes += len(m.Key) + len(m.Value)
+	}
+	var err error
+	if s.pendingBytes >= s.fileBytes {
+		err = s.writeFile()
+	}
+	if err != nil {
+		// the batch fails, drop its kv pairs so that a retry doesn't write them twice
+		s.pending, s.pendingBytes = s.pending[:pending], pendingBytes
+	}
+	future.resolve(err)
+	return nil
+}
+
+// writeFile writes buffered kv pairs to the next file, it should be called with mu held.
+// The file is written to a temp file and renamed, so a file in dir is always complete.
+// Buffered kv pairs are kept in order if it fails.
+func (s *FileSink) writeFile() error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+	kvs := make([]*sinkKV, len(s.pending))
+	copy(kvs, s.pending)
+	sort.SliceStable(kvs, func(i, j int) bool {
+		return string(kvs[i].key) < string(kvs[j].key)
+	})
+	// keep the last value of duplicated keys
+	sorted := kvs[:0]
+	for i, kv := range kvs {
+		if i+1 < len(kvs) && string(kvs[i+1].key) == string(kv.key) {
+			continue
+		}
+		sorted = append(sorted, kv)
+	}
+
+	path := filepath.Join(s.dir, fmt.Sprintf("%s-%06d.%s", s.name, s.nextSeq, s.format))
+	tmpPath := path + ".tmp"
+	write := writeKVFile
+	if s.format == config.SinkFormatSST {
+		write = writeSSTFile
+	}
+	err := write(tmpPath, sorted)
+	if err == nil {
+		err = errors.Trace(os.Rename(tmpPath, path))
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		s.lastErr, s.lastErrAt = err, time.Now()
+		return errors.Annotatef(err, "write sink file %s", path)
+	}
+	logrus.Infof("[file_sink] write %d kv pairs to %s", len(sorted), path)
+	s.nextSeq++
+	s.files++
+	s.pending, s.pendingBytes = nil, 0
+	// kv pairs in the journal are in the file now
+	s.closeJournal()
+	if err = os.Remove(s.journalPath()); err != nil && !os.IsNotExist(err) {
+		logrus.Warnf("[file_sink] fail to remove journal %s, error: %v", s.journalPath(), err)
+	}
+	s.journaled, s.journalBytes = 0, 0
+	return nil
+}
+
+func writeKVFile(path string, kvs []*sinkKV) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	writeKVRecords(w, kvs)
+	if err = w.Flush(); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(file.Sync())
+}
+
+// writeKVRecords writes kvs as records of kv files, errors are returned by flushing w.
+func writeKVRecords(w *bufio.Writer, kvs []*sinkKV) {
+	header := make([]byte, sinkRecordHeaderSize)
+	for _, kv := range kvs {
+		crc := crc32.NewIEEE()
+		crc.Write(kv.key)
+		crc.Write(kv.value)
+		binary.BigEndian.PutUint32(header, uint32(len(kv.key)))
+		binary.BigEndian.PutUint32(header[4:], uint32(len(kv.value)))
+		binary.BigEndian.PutUint64(header[8:], kv.commitTs)
+		binary.BigEndian.PutUint32(header[16:], crc.Sum32())
+		w.Write(header)
+		w.Write(kv.key)
+		w.Write(kv.value)
+	}
+}
+
+func writeSSTFile(path string, kvs []*sinkKV) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer file.Close()
+
+	w := table.NewWriter(file, &opt.Options{})
+	for _, kv := range kvs {
+		value := make([]byte, 8+len(kv.value))
+		binary.BigEndian.PutUint64(value, kv.commitTs)
+		copy(value[8:], kv.value)
+		if err = w.Append(kv.key, value); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(file.Sync())
+}
+
+// readSinkFile calls f with kv pairs of a kv or sst file in key order.
+func readSinkFile(path string, f func(key, value []byte, commitTs uint64) error) error {
+	switch filepath.Ext(path) {
+	case "." + config.SinkFormatKV:
+		return readKVFile(path, f)
+	case "." + config.SinkFormatSST:
+		return readSSTFile(path, f)
+	default:
+		return errors.Errorf("unknown sink file %s", path)
+	}
+}
+
+func readKVFile(path string, f func(key, value []byte, commitTs uint64) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	header := make([]byte, sinkRecordHeaderSize)
+	for offset := int64(0); ; {
+		if _, err = io.ReadFull(r, header); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Annotatef(err, "read sink file %s at %d", path, offset)
+		}
+		data := make([]byte, binary.BigEndian.Uint32(header)+binary.BigEndian.Uint32(header[4:]))
+		if _, err = io.ReadFull(r, data); err != nil {
+			return errors.Annotatef(err, "read sink file %s at %d", path, offset)
+		}
+		if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[16:]) {
+			return errors.Errorf("checksum mismatch in sink file %s at %d", path, offset)
+		}
+		keyLen := binary.BigEndian.Uint32(header)
+		if err = f(data[:keyLen], data[keyLen:], binary.BigEndian.Uint64(header[8:])); err != nil {
+			return err
+		}
+		offset += int64(len(header) + len(data))
+	}
+}
+
+func readSSTFile(path string, f func(key, value []byte, commitTs uint64) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	reader, err := table.NewReader(file, info.Size(), storage.FileDesc{Type: storage.TypeTable}, nil, nil, &opt.Options{})
+	if err != nil {
+		return errors.Annotatef(err, "open sink file %s", path)
+	}
+	defer reader.Release()
+	iter := reader.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		value := iter.Value()
+		if len(value) < 8 {
+			return errors.Errorf("invalid value of key %x in sink file %s", iter.Key(), path)
+		}
+		// the iterator reuses its buffers
+		key := append([]byte(nil), iter.Key()...)
+		if err = f(key, append([]byte(nil), value[8:]...), binary.BigEndian.Uint64(value)); err != nil {
+			return err
+		}
+	}
+	return errors.Annotatef(iter.Error(), "read sink file %s", path)
+}
+
+// ReplayResult is the statistics of replayed sink files.
+type ReplayResult struct {
+	Files int    `json:"files"`
+	Kvs   uint64 `json:"kvs"`
+	Bytes uint64 `json:"bytes"`
+}
+
+// ReplaySinkFiles writes kv pairs of sink files in dir to writer, in batches of at most batchBytes
+// and batchKvs with the same commit ts. Files are replayed in name order.
+// Errors of importer are only returned if writer acknowledges writes.
+func ReplaySinkFiles(ctx context.Context, dir string, writer ImportWriter, batchBytes, batchKvs int) (*ReplayResult, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	result := &ReplayResult{}
+	tunnel := NewWriteTunnel(writer, maxInflightBatches)
+	for _, info := range infos {
+		ext := filepath.Ext(info.Name())
+		if info.IsDir() || (ext != "."+config.SinkFormatKV && ext != "."+config.SinkFormatSST) {
+			continue
+		}
+		path := filepath.Join(dir, info.Name())
+
+		var futures []*WriteFuture
+		batch, size := &import_kvpb.WriteBatch{}, 0
+		push := func() error {
+			if len(batch.Mutations) == 0 {
+				return nil
+			}
+			future, err := tunnel.Push(ctx, batch)
+			if err != nil {
+				return err
+			}
+			futures = append(futures, future)
+			batch, size = &import_kvpb.WriteBatch{}, 0
+			return nil
+		}
+		err = readSinkFile(path, func(key, value []byte, commitTs uint64) error {
+			if len(batch.Mutations) > 0 && (commitTs != batch.CommitTs || size+len(key)+len(value) > batchBytes || len(batch.Mutations) >= batchKvs) {
+				if err := push(); err != nil {
+					return err
+				}
+			}
+			batch.CommitTs = commitTs
+			batch.Mutations = append(batch.Mutations, &import_kvpb.Mutation{Op: import_kvpb.Mutation_Put, Key: key, Value: value})
+			size += len(key) + len(value)
+			result.Kvs++
+			result.Bytes += uint64(len(key) + len(value))
+			return nil
+		})
+		if err == nil {
+			err = push()
+		}
+		for _, future := range futures {
+			if waitErr := future.Wait(ctx); waitErr != nil && err == nil {
+				err = waitErr
+			}
+		}
+		if err != nil {
+			return result, errors.Annotatef(err, "replay sink file %s", path)
+		}
+		result.Files++
+		logrus.Infof("[replay] replay %s, %d kv pairs replayed", path, result.Kvs)
+	}
+	return result, errors.Trace(tunnel.Flush(ctx))
+}
@@ -0,0 +1,188 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"github.com/lerencao/tidb-light/config"
+	"github.com/lerencao/tidb-light/server"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileSink_Replay(t *testing.T) {
+	for _, format := range []string{config.SinkFormatKV, config.SinkFormatSST} {
+		testFileSinkReplay(t, format)
+	}
+}
+
+func testFileSinkReplay(t *testing.T, format string) {
+	dir, err := ioutil.TempDir("", "sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a file is written every 2 batches
+	sink, err := server.NewFileSink(dir, "session", format, 2*len(testBatch(0).Mutations[0].Value)+2*len("key-0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, i := range []int{3, 1, 2, 0} {
+		if err = sink.WriteEngine(ctx, testBatch(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the later value of a key in the same file wins
+	overwrite := testBatch(4)
+	overwrite.CommitTs = 2
+	if err = sink.WriteEngine(ctx, overwrite); err != nil {
+		t.Fatal(err)
+	}
+	overwrite = testBatch(4)
+	overwrite.CommitTs = 2
+	overwrite.Mutations[0].Value = []byte("new")
+	if err = sink.WriteEngine(ctx, overwrite); err != nil {
+		t.Fatal(err)
+	}
+	// flush doesn't start a new file
+	if err = sink.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if stats := sink.Stats(); stats.SinkFiles != 2 || stats.QueueBytes == 0 {
+		t.Fatalf("expect 2 %s files written and the rest buffered, got %d files, %d bytes buffered", format, stats.SinkFiles, stats.QueueBytes)
+	}
+	sink.Close()
+	if stats := sink.Stats(); stats.SinkFiles != 3 || stats.QueueBytes != 0 {
+		t.Fatalf("expect 3 %s files written after close, got %d files, %d bytes buffered", format, stats.SinkFiles, stats.QueueBytes)
+	}
+
+	// a new sink of the same name continues sequences of files
+	sink, err = server.NewFileSink(dir, "session", format, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sink.WriteEngine(ctx, testBatch(5)); err != nil {
+		t.Fatal(err)
+	}
+	sink.Close()
+
+	mock, addr := startMockImporter(t, "127.0.0.1:0")
+	defer mock.Stop()
+	writer, conn := newTestWriter(t, addr, nil)
+	defer conn.Close()
+	writer.Open()
+	result, err := server.ReplaySinkFiles(ctx, dir, writer, 1<<20, 2)
+	writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Files != 4 || result.Kvs != 6 {
+		t.Fatalf("expect 6 kv pairs in 4 %s files replayed, got %d in %d files", format, result.Kvs, result.Files)
+	}
+
+	kvs := mock.KVs(testEngine)
+	if len(kvs) != 6 {
+		t.Fatalf("expect 6 keys after replay, got %d", len(kvs))
+	}
+	for i, kv := range kvs {
+		if !bytes.Equal(kv.Key, testBatch(i).Mutations[0].Key) {
+			t.Fatalf("expect key %d, got %s", i, kv.Key)
+		}
+	}
+	if value, _ := mock.Get(testEngine, testBatch(4).Mutations[0].Key); string(value) != "new" {
+		t.Fatalf("expect the later value of key-4, got %s", value)
+	}
+	// a batch never spans files
+	if _, batches, _ := engineStats(mock); batches != 4 {
+		t.Fatalf("expect 4 batches, got %d", batches)
+	}
+}
+
+func TestFileSink_WriteFileFailed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kvBytes := len(testBatch(0).Mutations[0].Value) + len("key-0")
+	sink, err := server.NewFileSink(dir, "session", config.SinkFormatKV, 2*kvBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	ctx := context.Background()
+	if err = sink.WriteEngine(ctx, testBatch(0)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the file of the second batch can't be created
+	if err = os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err = sink.WriteEngine(ctx, testBatch(1)); err == nil {
+		t.Fatal("write should fail when the sink dir is removed")
+	}
+	if stats := sink.Stats(); stats.QueueBytes != kvBytes || stats.LastError == nil {
+		t.Fatalf("expect the failed batch dropped, got %d bytes buffered", stats.QueueBytes)
+	}
+
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = sink.WriteEngine(ctx, testBatch(1)); err != nil {
+		t.Fatal(err)
+	}
+	if stats := sink.Stats(); stats.SinkFiles != 1 || stats.QueueBytes != 0 {
+		t.Fatalf("expect 1 file written after retry, got %d files, %d bytes buffered", stats.SinkFiles, stats.QueueBytes)
+	}
+}
+
+func TestFileSink_Journal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sink, err := server.NewFileSink(dir, "session", config.SinkFormatSST, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if err = sink.WriteEngine(ctx, testBatch(i)); err != nil {
+			t.Fatal(err)
+		}
+		if err = sink.Flush(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// flushed kv pairs are journaled in a single file, not written to a file per flush
+	buffered := sink.Stats().QueueBytes
+	if stats := sink.Stats(); stats.SinkFiles != 0 {
+		t.Fatalf("expect no file written before sink-file-bytes, got %d files", stats.SinkFiles)
+	}
+	if err = sink.WriteEngine(ctx, testBatch(3)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the sink crashes, a new one of the same name gets flushed kv pairs from journal
+	sink, err = server.NewFileSink(dir, "session", config.SinkFormatSST, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := sink.Stats(); stats.QueueBytes != buffered {
+		t.Fatalf("expect %d bytes loaded from journal, got %d", buffered, stats.QueueBytes)
+	}
+	sink.Close()
+	if stats := sink.Stats(); stats.SinkFiles != 1 || stats.QueueBytes != 0 {
+		t.Fatalf("expect 1 file written on close, got %d files, %d bytes buffered", stats.SinkFiles, stats.QueueBytes)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "session.journal")); !os.IsNotExist(err) {
+		t.Fatalf("journal should be removed after its kv pairs are written to a file, got %v", err)
+	}
+}
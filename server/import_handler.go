@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"github.com/gorilla/mux"
 	"github.com/pingcap/kvproto/pkg/import_sstpb"
-	"github.com/pingcap/tidb/tablecodec"
 	"github.com/satori/go.uuid"
 	"github.com/unrolled/render"
 	"net/http"
@@ -27,20 +26,23 @@ func (c *ImportHandler) SwitchMode(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	importClient, err := c.svr.GetImportClient()
-	if err != nil {
-		c.r.JSON(w, http.StatusInternalServerError, err)
-		return
-	}
-
-	if err = importClient.SwitchMode(r.Context(), param.PdAddr, param.Mode); err != nil {
-		c.r.JSON(w, http.StatusInternalServerError, err)
+	if err := c.svr.Modes().Switch(r.Context(), param.PdAddr, param.Mode); err != nil {
+		status := http.StatusInternalServerError
+		if _, ok := err.(*ImportModeError); ok {
+			status = http.StatusConflict
+		}
+		c.r.JSON(w, status, err.Error())
 		return
 	}
 
 	c.r.JSON(w, http.StatusOK, nil)
 }
 
+// Modes lists tikv clusters held in import mode, or being switched back to normal mode.
+func (c *ImportHandler) Modes(w http.ResponseWriter, r *http.Request) {
+	c.r.JSON(w, http.StatusOK, c.svr.Modes().List())
+}
+
 type ImportEngineParam struct {
 	PdAddr string `json:"pd_addr"`
 }
@@ -60,13 +62,8 @@ func (c *ImportHandler) ImportEngine(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	importClient, err := c.svr.GetImportClient()
-	if err != nil {
-		c.r.JSON(w, http.StatusInternalServerError, err)
-		return
-	}
-	if err = importClient.ImportEngine(r.Context(), engineId.Bytes(), param.PdAddr); err != nil {
-		c.r.JSON(w, http.StatusInternalServerError, err)
+	if err = c.svr.ImportEngine(r.Context(), engineId, param.PdAddr); err != nil {
+		c.r.JSON(w, engineErrorStatus(err), err.Error())
 		return
 	}
 	c.r.JSON(w, http.StatusOK, nil)
@@ -85,22 +82,9 @@ func (c *ImportHandler) CompactTable(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	importClient, err := c.svr.GetImportClient()
-	if err != nil {
+	if err := c.svr.CompactTable(r.Context(), param.PdAddr, param.TableId); err != nil {
 		c.r.JSON(w, http.StatusInternalServerError, err)
 		return
 	}
-	tablePrefix := tablecodec.EncodeTablePrefix(param.TableId)
-	tablePrefixNext := tablePrefix.PrefixNext()
-	req := &import_sstpb.CompactRequest{
-		OutputLevel: -1,
-		Range: &import_sstpb.Range{
-			Start: tablePrefix,
-			End:   tablePrefixNext,
-		},
-	}
-	if err = importClient.CompactCluster(r.Context(), param.PdAddr, req); err != nil {
-		c.r.JSON(w, http.StatusInternalServerError, err)
-	}
 	c.r.JSON(w, http.StatusOK, nil)
 }
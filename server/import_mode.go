@@ -0,0 +1,364 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pingcap/kvproto/pkg/import_sstpb"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// modeSwitchTimeout bounds a switch mode request sent by ModeManager.
+const modeSwitchTimeout = 30 * time.Second
+
+// ModeSwitcher switches the tikv cluster of pdAddr to mode.
+type ModeSwitcher func(ctx context.Context, pdAddr string, mode import_sstpb.SwitchMode) error
+
+// ImportModeError is returned when the tikv cluster can't be switched to normal mode by client,
+// because import mode is still held by jobs or importing engines.
+type ImportModeError struct {
+	PdAddr string
+	Refs   int
+}
+
+func (e *ImportModeError) Error() string {
+	return fmt.Sprintf("import mode of %s is held by %d jobs or engines", e.PdAddr, e.Refs)
+}
+
+// ModeInfo is the import mode status of a tikv cluster.
+type ModeInfo struct {
+	PdAddr string `json:"pd_addr"`
+	// Refs is the number of jobs, importing engines and the client holding import mode.
+	Refs int `json:"refs"`
+	// Manual is set if the client switched the cluster to import mode.
+	Manual bool `json:"manual"`
+	// Importing is set if the cluster may be in import mode.
+	Importing  bool      `json:"importing"`
+	AssertedAt time.Time `json:"asserted_at,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+type pdMode struct {
+	info ModeInfo
+	// asserted is set if the last switch to import mode succeeded, and the cluster is not switched since then.
+	asserted bool
+	// switchMu serializes switch requests of the cluster, which are sent without holding the lock of ModeManager.
+	switchMu sync.Mutex
+}
+
+// ModeManager keeps tikv clusters in import mode while they are held, by re-asserting import mode
+// every interval, since tikv drops out of import mode after a timeout. A cluster is switched back
+// to normal mode when the last holder releases it, and on close.
+//
+// Clusters which may be in import mode are saved in a state file, so those left in import mode by
+// a crash are switched back after restart.
+type ModeManager struct {
+	sync.Mutex
+	switcher  ModeSwitcher
+	interval  time.Duration
+	statePath string
+	pds       map[string]*pdMode
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewModeManager(switcher ModeSwitcher, interval time.Duration, statePath string) *ModeManager {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &ModeManager{
+		switcher:  switcher,
+		interval:  interval,
+		statePath: statePath,
+		pds:       make(map[string]*pdMode),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+}
+
+// Start restores clusters left in import mode by last run, and starts re-asserting import mode.
+func (m *ModeManager) Start() error {
+	leftover, err := m.loadState()
+	if err != nil {
+		return err
+	}
+	m.Lock()
+	for _, pdAddr := range leftover {
+		logrus.Warnf("[import_mode] %s was left in import mode, switch it back to normal mode", pdAddr)
+		m.entry(pdAddr).info.Importing = true
+	}
+	m.Unlock()
+	m.syncAll(false)
+
+	m.wg.Add(1)
+	go m.loop()
+	return nil
+}
+
+// Close stops re-asserting import mode, and switches all clusters back to normal mode.
+func (m *ModeManager) Close() {
+	m.cancel()
+	m.wg.Wait()
+
+	m.Lock()
+	for _, pd := range m.pds {
+		pd.info.Refs, pd.info.Manual = 0, false
+	}
+	m.Unlock()
+	m.syncAll(false)
+}
+
+func (m *ModeManager) loop() {
+	defer m.wg.Done()
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.syncAll(true)
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
+
+// entry returns the mode of pdAddr, it should be called with lock held.
+func (m *ModeManager) entry(pdAddr string) *pdMode {
+	pd, ok := m.pds[pdAddr]
+	if !ok {
+		pd = &pdMode{info: ModeInfo{PdAddr: pdAddr}}
+		m.pds[pdAddr] = pd
+	}
+	return pd
+}
+
+// remove drops pd if it's neither held nor in import mode, it should be called with lock held.
+func (m *ModeManager) remove(pdAddr string, pd *pdMode) {
+	if pd.info.Refs > 0 || pd.info.Importing || m.pds[pdAddr] != pd {
+		return
+	}
+	delete(m.pds, pdAddr)
+	if err := m.saveState(); err != nil {
+		logrus.Errorf("[import_mode] fail to save state, error: %v", err)
+	}
+}
+
+// syncAll syncs modes of all clusters, a cluster failed to switch is retried in the next round.
+func (m *ModeManager) syncAll(assert bool) error {
+	m.Lock()
+	pds := make(map[string]*pdMode, len(m.pds))
+	for pdAddr, pd := range m.pds {
+		pds[pdAddr] = pd
+	}
+	m.Unlock()
+
+	var err error
+	for pdAddr, pd := range pds {
+		if syncErr := m.sync(m.ctx, pdAddr, pd, assert); syncErr != nil {
+			err = syncErr
+		}
+	}
+	return err
+}
+
+// sync switches pdAddr to the mode required by its holds. A held cluster is switched to import mode
+// if it's not asserted yet or assert is set, otherwise a cluster which may be in import mode is
+// switched back to normal mode, which is not canceled by ctx.
+// The switch request is sent without holding the lock, requests of pdAddr are serialized by its switchMu.
+func (m *ModeManager) sync(ctx context.Context, pdAddr string, pd *pdMode, assert bool) error {
+	pd.switchMu.Lock()
+	defer pd.switchMu.Unlock()
+
+	m.Lock()
+	mode := import_sstpb.SwitchMode_Normal
+	if pd.info.Refs > 0 {
+		mode = import_sstpb.SwitchMode_Import
+		if pd.asserted && !assert {
+			m.Unlock()
+			return nil
+		}
+		if !pd.info.Importing {
+			pd.info.Importing = true
+			// save the state before switching, so the cluster is restored if we crash in the middle
+			if err := m.saveState(); err != nil {
+				logrus.Errorf("[import_mode] fail to save state, error: %v", err)
+			}
+		}
+	} else if !pd.info.Importing {
+		m.remove(pdAddr, pd)
+		m.Unlock()
+		return nil
+	}
+	m.Unlock()
+
+	if mode == import_sstpb.SwitchMode_Normal {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithTimeout(ctx, modeSwitchTimeout)
+	err := m.switcher(ctx, pdAddr, mode)
+	cancel()
+
+	m.Lock()
+	defer m.Unlock()
+	if err != nil {
+		logrus.Errorf("[import_mode] fail to switch %s to %s mode, error: %v", pdAddr, mode, err)
+		pd.info.Error = err.Error()
+		pd.asserted = false
+		return err
+	}
+	pd.info.Error = ""
+	if mode == import_sstpb.SwitchMode_Import {
+		pd.info.AssertedAt = time.Now()
+		pd.asserted = true
+		return nil
+	}
+	logrus.Infof("[import_mode] %s is switched back to normal mode", pdAddr)
+	pd.info.Importing, pd.asserted = false, false
+	m.remove(pdAddr, pd)
+	return nil
+}
+
+// Acquire holds pdAddr in import mode until Release is called.
+func (m *ModeManager) Acquire(ctx context.Context, pdAddr string) error {
+	return m.acquire(ctx, pdAddr, false)
+}
+
+// acquire adds a hold of import mode on pdAddr, manual is set if it's held by client,
+// who holds it at most once.
+func (m *ModeManager) acquire(ctx context.Context, pdAddr string, manual bool) error {
+	m.Lock()
+	pd := m.entry(pdAddr)
+	if manual && pd.info.Manual {
+		m.Unlock()
+		// assert import mode again without another hold
+		return m.sync(ctx, pdAddr, pd, true)
+	}
+	pd.info.Refs++
+	if manual {
+		pd.info.Manual = true
+	}
+	m.Unlock()
+
+	if err := m.sync(ctx, pdAddr, pd, false); err != nil {
+		m.Lock()
+		pd.info.Refs--
+		if manual {
+			pd.info.Manual = false
+		}
+		m.Unlock()
+		m.sync(ctx, pdAddr, pd, false)
+		return err
+	}
+	return nil
+}
+
+// Release releases a hold of import mode on pdAddr, it's switched back to normal mode if it's the last one.
+// If the switch fails, it's retried in background.
+func (m *ModeManager) Release(pdAddr string) error {
+	m.Lock()
+	pd, ok := m.pds[pdAddr]
+	if !ok || pd.info.Refs == 0 {
+		m.Unlock()
+		return nil
+	}
+	pd.info.Refs--
+	refs := pd.info.Refs
+	m.Unlock()
+	if refs > 0 {
+		return nil
+	}
+	return m.sync(m.ctx, pdAddr, pd, false)
+}
+
+// Switch is the mode switch requested by client. Import mode is held for the client until it
+// switches back to normal mode, which is rejected with ImportModeError if others still hold import mode.
+func (m *ModeManager) Switch(ctx context.Context, pdAddr string, mode import_sstpb.SwitchMode) error {
+	if mode == import_sstpb.SwitchMode_Import {
+		return m.acquire(ctx, pdAddr, true)
+	}
+
+	m.Lock()
+	pd := m.entry(pdAddr)
+	refs := pd.info.Refs
+	if pd.info.Manual {
+		refs--
+	}
+	if refs > 0 {
+		m.Unlock()
+		return &ImportModeError{PdAddr: pdAddr, Refs: refs}
+	}
+	// the cluster may be switched by others, so it's always switched back
+	pd.info.Refs, pd.info.Manual, pd.info.Importing = 0, false, true
+	m.Unlock()
+	return m.sync(ctx, pdAddr, pd, false)
+}
+
+// List returns mode infos of clusters in import mode or being restored.
+func (m *ModeManager) List() []*ModeInfo {
+	m.Lock()
+	defer m.Unlock()
+	infos := make([]*ModeInfo, 0, len(m.pds))
+	for _, pd := range m.pds {
+		info := pd.info
+		infos = append(infos, &info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].PdAddr < infos[j].PdAddr
+	})
+	return infos
+}
+
+// loadState reads clusters which may be left in import mode.
+func (m *ModeManager) loadState() ([]string, error) {
+	if m.statePath == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(m.statePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var pdAddrs []string
+	if err = json.Unmarshal(data, &pdAddrs); err != nil {
+		return nil, errors.Wrapf(err, "invalid import mode state %s", m.statePath)
+	}
+	return pdAddrs, nil
+}
+
+// saveState writes clusters which may be in import mode to a temp file and renames it,
+// it should be called with lock held.
+func (m *ModeManager) saveState() error {
+	if m.statePath == "" {
+		return nil
+	}
+	pdAddrs := make([]string, 0, len(m.pds))
+	for pdAddr, pd := range m.pds {
+		if pd.info.Importing {
+			pdAddrs = append(pdAddrs, pdAddr)
+		}
+	}
+	if len(pdAddrs) == 0 {
+		if err := os.Remove(m.statePath); err != nil && !os.IsNotExist(err) {
+			return errors.WithStack(err)
+		}
+		return nil
+	}
+	sort.Strings(pdAddrs)
+	data, err := json.Marshal(pdAddrs)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tmpPath := m.statePath + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, data, 0644); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmpPath, m.statePath))
+}
@@ -0,0 +1,167 @@
+package server_test
+
+import (
+	"context"
+	"github.com/lerencao/tidb-light/server"
+	"github.com/pingcap/kvproto/pkg/import_sstpb"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// modeRecorder records modes switched by ModeManager.
+type modeRecorder struct {
+	sync.Mutex
+	modes map[string][]import_sstpb.SwitchMode
+}
+
+func (r *modeRecorder) switchMode(ctx context.Context, pdAddr string, mode import_sstpb.SwitchMode) error {
+	r.Lock()
+	defer r.Unlock()
+	r.modes[pdAddr] = append(r.modes[pdAddr], mode)
+	return nil
+}
+
+func (r *modeRecorder) last(pdAddr string) (import_sstpb.SwitchMode, int) {
+	r.Lock()
+	defer r.Unlock()
+	modes := r.modes[pdAddr]
+	if len(modes) == 0 {
+		return -1, 0
+	}
+	return modes[len(modes)-1], len(modes)
+}
+
+func TestModeManager(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	statePath := filepath.Join(dir, "import_mode.json")
+
+	recorder := &modeRecorder{modes: make(map[string][]import_sstpb.SwitchMode)}
+	m := server.NewModeManager(recorder.switchMode, 50*time.Millisecond, statePath)
+	if err = m.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err = m.Acquire(ctx, "pd1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = m.Switch(ctx, "pd1", import_sstpb.SwitchMode_Import); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(statePath); err != nil {
+		t.Fatalf("state should be saved in import mode, error: %v", err)
+	}
+
+	// import mode is re-asserted while it's held
+	waitUntil(t, func() bool {
+		_, n := recorder.last("pd1")
+		return n >= 3
+	})
+	if err = m.Switch(ctx, "pd1", import_sstpb.SwitchMode_Normal); err == nil {
+		t.Fatal("switch to normal mode should be rejected when a job holds import mode")
+	}
+	if err = m.Release("pd1"); err != nil {
+		t.Fatal(err)
+	}
+	if mode, _ := recorder.last("pd1"); mode != import_sstpb.SwitchMode_Import {
+		t.Fatalf("client still holds import mode, got %s", mode)
+	}
+	if err = m.Switch(ctx, "pd1", import_sstpb.SwitchMode_Normal); err != nil {
+		t.Fatal(err)
+	}
+	if mode, _ := recorder.last("pd1"); mode != import_sstpb.SwitchMode_Normal {
+		t.Fatalf("expect normal mode after the last hold is released, got %s", mode)
+	}
+	if _, err = os.Stat(statePath); !os.IsNotExist(err) {
+		t.Fatalf("state should be removed in normal mode, error: %v", err)
+	}
+
+	// simulate a crash in import mode, it's restored by the next run
+	if err = m.Acquire(ctx, "pd2"); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(statePath+".bak", mustRead(t, statePath), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m.Close()
+	if mode, _ := recorder.last("pd2"); mode != import_sstpb.SwitchMode_Normal {
+		t.Fatalf("expect normal mode after close, got %s", mode)
+	}
+
+	if err = os.Rename(statePath+".bak", statePath); err != nil {
+		t.Fatal(err)
+	}
+	recorder = &modeRecorder{modes: make(map[string][]import_sstpb.SwitchMode)}
+	m = server.NewModeManager(recorder.switchMode, time.Minute, statePath)
+	if err = m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if mode, _ := recorder.last("pd2"); mode != import_sstpb.SwitchMode_Normal {
+		t.Fatalf("expect leftover import mode restored after restart, got %s", mode)
+	}
+}
+
+func mustRead(t *testing.T, path string) []byte {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestModeManager_SwitchUnlocked(t *testing.T) {
+	block := make(chan struct{})
+	switcher := func(ctx context.Context, pdAddr string, mode import_sstpb.SwitchMode) error {
+		if pdAddr == "slow" {
+			select {
+			case <-block:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	}
+	m := server.NewModeManager(switcher, time.Minute, "")
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	ctx := context.Background()
+	done := make(chan error, 1)
+	go func() {
+		done <- m.Acquire(ctx, "slow")
+	}()
+	// other clusters and status are not blocked by the pending switch
+	waitUntil(t, func() bool {
+		return len(m.List()) == 1
+	})
+	if err := m.Acquire(ctx, "fast"); err != nil {
+		t.Fatal(err)
+	}
+	if infos := m.List(); len(infos) != 2 || infos[0].PdAddr != "fast" || infos[0].AssertedAt.IsZero() {
+		t.Fatalf("expect fast asserted while slow is switching, got %v", infos)
+	}
+
+	close(block)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	for _, pdAddr := range []string{"slow", "fast"} {
+		if err := m.Release(pdAddr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if infos := m.List(); len(infos) != 0 {
+		t.Fatalf("expect all clusters switched back, got %v", infos)
+	}
+}
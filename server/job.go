@@ -0,0 +1,571 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/satori/go.uuid"
+	"github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// JobParam is the parameters of a job which imports a mydumper/dumpling directory.
+type JobParam struct {
+	Dir string `json:"dir"`
+	// PdAddr is the pd used to import engines, it's pd-addr of config if empty.
+	PdAddr string `json:"pd_addr"`
+	// CSVHeader means csv data files have a header row.
+	CSVHeader bool `json:"csv_header"`
+	// Concurrency is the number of tables imported concurrently.
+	Concurrency int `json:"concurrency"`
+	// Retries is the max retries of a failed step, 0 means defaultJobRetries, and -1 means no retries.
+	// Writing data files is never retried, since rows without primary key would be duplicated.
+	Retries int `json:"retries"`
+	// SkipSwitchMode leaves the tikv cluster mode to client, otherwise the cluster is held in
+	// import mode during the job, and switched back to normal mode when no one holds it.
+	SkipSwitchMode bool `json:"skip_switch_mode"`
+	// SkipCompact skips compacting tables after they are imported.
+	SkipCompact bool `json:"skip_compact"`
+}
+
+// defaultJobRetries is the max retries of a failed step if it's not set in JobParam.
+const defaultJobRetries = 3
+
+type JobState string
+
+const (
+	JobPending  JobState = "pending"
+	JobRunning  JobState = "running"
+	JobFinished JobState = "finished"
+	JobFailed   JobState = "failed"
+)
+
+// TableProgress is the import progress of a table in job.
+type TableProgress struct {
+	Schema    string   `json:"schema"`
+	Table     string   `json:"table"`
+	EngineId  string   `json:"engine_id"`
+	State     JobState `json:"state"`
+	Files     int      `json:"files"`
+	FilesDone int      `json:"files_done"`
+	Rows      uint64   `json:"rows"`
+	Kvs       uint64   `json:"kvs"`
+	Error     string   `json:"error,omitempty"`
+	// Steps is the pipeline of table, a rollback step is appended if the table fails before it's imported.
+	Steps []*StepStatus `json:"steps"`
+}
+
+// JobStatus is a snapshot of job.
+type JobStatus struct {
+	Id         string           `json:"id"`
+	Param      *JobParam        `json:"param"`
+	State      JobState         `json:"state"`
+	Error      string           `json:"error,omitempty"`
+	Steps      []*StepStatus    `json:"steps"`
+	Tables     []*TableProgress `json:"tables"`
+	CreatedAt  time.Time        `json:"created_at"`
+	FinishedAt *time.Time       `json:"finished_at,omitempty"`
+}
+
+type Job struct {
+	sync.Mutex
+	status JobStatus
+	uuid   uuid.UUID
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Status returns a copy of job status.
+func (j *Job) Status() *JobStatus {
+	j.Lock()
+	defer j.Unlock()
+	status := j.status
+	status.Steps = copySteps(j.status.Steps)
+	status.Tables = make([]*TableProgress, 0, len(j.status.Tables))
+	for _, t := range j.status.Tables {
+		progress := *t
+		progress.Steps = copySteps(t.Steps)
+		status.Tables = append(status.Tables, &progress)
+	}
+	return &status
+}
+
+// Cancel cancels the running job.
+func (j *Job) Cancel() {
+	j.cancel()
+}
+
+// Wait waits the job to finish.
+func (j *Job) Wait() {
+	<-j.done
+}
+
+func (j *Job) update(f func(status *JobStatus)) {
+	j.Lock()
+	defer j.Unlock()
+	f(&j.status)
+}
+
+// JobManager runs import jobs in background.
+type JobManager struct {
+	sync.RWMutex
+	svr  *Server
+	jobs map[string]*Job
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewJobManager(svr *Server) *JobManager {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &JobManager{
+		svr:    svr,
+		jobs:   make(map[string]*Job),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Close cancels all running jobs and waits them to exit.
+func (m *JobManager) Close() {
+	m.cancel()
+	m.wg.Wait()
+}
+
+func (m *JobManager) GetJob(jobid string) *Job {
+	m.RLock()
+	defer m.RUnlock()
+	return m.jobs[jobid]
+}
+
+func (m *JobManager) ListJobs() []*Job {
+	m.RLock()
+	defer m.RUnlock()
+	jobs := make([]*Job, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+// Submit validates param, and starts a job in background.
+func (m *JobManager) Submit(param *JobParam) (*Job, error) {
+	if param.Dir == "" {
+		return nil, errors.New("dir should not be empty")
+	}
+	if info, err := os.Stat(param.Dir); err != nil || !info.IsDir() {
+		return nil, errors.Errorf("dir %s is not a directory", param.Dir)
+	}
+	if param.PdAddr == "" {
+		param.PdAddr = m.svr.cfg.PdAddr
+	}
+	if param.PdAddr == "" {
+		return nil, errors.New("pd_addr should not be empty")
+	}
+	if param.Concurrency <= 0 {
+		param.Concurrency = 1
+	}
+	if param.Retries < -1 {
+		return nil, errors.New("retries should not be less than -1")
+	}
+	if param.Retries == 0 {
+		param.Retries = defaultJobRetries
+	}
+
+	id := uuid.NewV4()
+	ctx, cancel := context.WithCancel(m.ctx)
+	job := &Job{
+		status: JobStatus{
+			Id:        id.String(),
+			Param:     param,
+			State:     JobPending,
+			Steps:     newSteps(StepSwitchImport, StepSwitchNormal),
+			CreatedAt: time.Now(),
+		},
+		uuid:   id,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	m.Lock()
+	m.jobs[job.status.Id] = job
+	m.Unlock()
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer close(job.done)
+		defer cancel()
+		m.runJob(ctx, job)
+	}()
+	return job, nil
+}
+
+func (m *JobManager) runJob(ctx context.Context, job *Job) {
+	job.update(func(status *JobStatus) {
+		status.State = JobRunning
+	})
+	logrus.Infof("[job %s] start to import %s", job.status.Id, job.status.Param.Dir)
+
+	err := m.importDir(ctx, job)
+
+	job.update(func(status *JobStatus) {
+		now := time.Now()
+		status.FinishedAt = &now
+		if err != nil {
+			status.State = JobFailed
+			status.Error = err.Error()
+		} else {
+			status.State = JobFinished
+		}
+	})
+	if err != nil {
+		logrus.Errorf("[job %s] fail to import, error: %v", job.status.Id, err)
+	} else {
+		logrus.Infof("[job %s] finished", job.status.Id)
+	}
+}
+
+// importDir imports tables of dir concurrently, the cluster is in import mode during the import.
+func (m *JobManager) importDir(ctx context.Context, job *Job) (err error) {
+	param := job.status.Param
+	schemas, err := ScanDumpDir(param.Dir)
+	if err != nil {
+		return err
+	}
+
+	tables := make([]*DumpTable, 0)
+	progresses := make([]*TableProgress, 0)
+	for _, schema := range schemas {
+		if len(schema.Views) != 0 || len(schema.SkippedFiles) != 0 {
+			logrus.Warnf("[job %s] skip views %v and schema files %v of %s", job.status.Id, schema.Views, schema.SkippedFiles, schema.Name)
+		}
+		for _, table := range schema.Tables {
+			tables = append(tables, table)
+			progresses = append(progresses, &TableProgress{
+				Schema:   table.Schema,
+				Table:    table.Name,
+				EngineId: uuid.NewV5(job.uuid, table.Schema+"."+table.Name).String(),
+				State:    JobPending,
+				Files:    len(table.DataFiles),
+				Steps: newSteps(StepOpenEngine, StepWrite, StepCloseEngine,
+					StepImportEngine, StepCleanupEngine, StepCompactTable),
+			})
+		}
+	}
+	job.update(func(status *JobStatus) {
+		status.Tables = progresses
+	})
+
+	if err = m.createSchemas(ctx, schemas); err != nil {
+		return err
+	}
+
+	switchImport := findStep(job.status.Steps, StepSwitchImport)
+	switchNormal := findStep(job.status.Steps, StepSwitchNormal)
+	if param.SkipSwitchMode {
+		job.skipStep(switchImport)
+		job.skipStep(switchNormal)
+	} else {
+		err = m.runStep(ctx, job, switchImport, param.Retries, func(ctx context.Context) error {
+			return m.svr.Modes().Acquire(ctx, param.PdAddr)
+		})
+		if err != nil {
+			return err
+		}
+		// the mode manager retries switching back in background if it fails, so it's not retried here
+		defer func() {
+			switchErr := m.runStep(context.Background(), job, switchNormal, 0, func(ctx context.Context) error {
+				return m.svr.Modes().Release(param.PdAddr)
+			})
+			if switchErr != nil && err == nil {
+				err = switchErr
+			}
+		}()
+	}
+
+	sem := make(chan struct{}, param.Concurrency)
+	errs := make(chan error, len(tables)+1)
+	var wg sync.WaitGroup
+loop:
+	for i, table := range tables {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			errs <- errors.WithStack(ctx.Err())
+			break loop
+		}
+		wg.Add(1)
+		go func(table *DumpTable, progress *TableProgress) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			err := m.importTable(ctx, job, table, progress)
+			job.update(func(status *JobStatus) {
+				if err != nil {
+					progress.State = JobFailed
+					progress.Error = err.Error()
+				} else {
+					progress.State = JobFinished
+				}
+			})
+			if err != nil {
+				errs <- errors.Wrapf(err, "import table %s.%s", table.Schema, table.Name)
+			}
+		}(table, progresses[i])
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// createSchemas creates schemas and tables which are not exist in tidb.
+func (m *JobManager) createSchemas(ctx context.Context, schemas []*DumpSchema) error {
+	conn, err := m.svr.sessionManager.db.Conn(ctx)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer conn.Close()
+
+	for _, schema := range schemas {
+		var n int
+		row := conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM information_schema.schemata WHERE schema_name = ?", schema.Name)
+		if err = row.Scan(&n); err != nil {
+			return errors.WithStack(err)
+		}
+		if n == 0 {
+			logrus.Infof("create schema %s", schema.Name)
+			if schema.CreateFile != "" {
+				err = execSQLFile(ctx, conn, schema.CreateFile)
+			} else {
+				_, err = conn.ExecContext(ctx, fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s", quoteName(schema.Name)))
+			}
+			if err != nil {
+				return errors.Wrapf(err, "create schema %s", schema.Name)
+			}
+		}
+
+		if _, err = conn.ExecContext(ctx, fmt.Sprintf("USE %s", quoteName(schema.Name))); err != nil {
+			return errors.WithStack(err)
+		}
+		for _, table := range schema.Tables {
+			row := conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = ? AND table_name = ?", schema.Name, table.Name)
+			if err = row.Scan(&n); err != nil {
+				return errors.WithStack(err)
+			}
+			if n > 0 {
+				continue
+			}
+			if table.SchemaFile == "" {
+				return errors.Errorf("table %s.%s not exists, and there is no schema file", schema.Name, table.Name)
+			}
+			logrus.Infof("create table %s.%s", schema.Name, table.Name)
+			if err = execSQLFile(ctx, conn, table.SchemaFile); err != nil {
+				return errors.Wrapf(err, "create table %s.%s", schema.Name, table.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func execSQLFile(ctx context.Context, conn *sql.Conn, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	reader := NewSQLReader(f)
+	for {
+		stmt, err := reader.ReadStmt()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err = conn.ExecContext(ctx, stmt); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+}
+
+// importTable runs the pipeline of table: open engine, write data files with one session per file,
+// close, import and cleanup the engine, then compact the table. If the table fails before it's
+// imported, the engine is rolled back.
+func (m *JobManager) importTable(ctx context.Context, job *Job, table *DumpTable, progress *TableProgress) (err error) {
+	engineUUID := uuid.NewV5(job.uuid, table.Schema+"."+table.Name)
+	param := job.status.Param
+	step := func(name JobStep) *StepStatus {
+		return findStep(progress.Steps, name)
+	}
+	job.update(func(status *JobStatus) {
+		progress.State = JobRunning
+	})
+	defer func() {
+		if err != nil {
+			m.rollbackTable(job, progress, engineUUID)
+		}
+	}()
+
+	err = m.runStep(ctx, job, step(StepOpenEngine), param.Retries, func(ctx context.Context) error {
+		return m.svr.OpenEngine(ctx, engineUUID)
+	})
+	if err != nil {
+		return err
+	}
+	err = m.runStep(ctx, job, step(StepWrite), 0, func(ctx context.Context) error {
+		return m.writeTable(ctx, job, table, progress, engineUUID)
+	})
+	if err != nil {
+		return err
+	}
+	err = m.runStep(ctx, job, step(StepCloseEngine), param.Retries, func(ctx context.Context) error {
+		return m.svr.CloseEngine(ctx, engineUUID)
+	})
+	if err != nil {
+		return err
+	}
+	err = m.runStep(ctx, job, step(StepImportEngine), param.Retries, func(ctx context.Context) error {
+		return m.svr.ImportEngine(ctx, engineUUID, param.PdAddr)
+	})
+	if err != nil {
+		return err
+	}
+	err = m.runStep(ctx, job, step(StepCleanupEngine), param.Retries, func(ctx context.Context) error {
+		return m.svr.CleanupEngine(ctx, engineUUID)
+	})
+	if err != nil {
+		return err
+	}
+
+	if param.SkipCompact {
+		job.skipStep(step(StepCompactTable))
+		return nil
+	}
+	return m.runStep(ctx, job, step(StepCompactTable), param.Retries, func(ctx context.Context) error {
+		tableId, err := m.svr.sessionManager.schemas.TableId(table.Schema, table.Name)
+		if err != nil {
+			return err
+		}
+		return m.svr.CompactTable(ctx, param.PdAddr, tableId)
+	})
+}
+
+// writeTable writes data files of table into engine with one session per file.
+func (m *JobManager) writeTable(ctx context.Context, job *Job, table *DumpTable, progress *TableProgress, engineUUID uuid.UUID) error {
+	for i, file := range table.DataFiles {
+		sessionid := fmt.Sprintf("job-%s-%s.%s-%d", job.status.Id, table.Schema, table.Name, i)
+		session, err := m.svr.sessionManager.OpenSession(sessionid, engineUUID.Bytes(), table.Schema, table.Name, 0, SinkImporter)
+		if err != nil {
+			return err
+		}
+		result, err := m.writeFile(ctx, session, file, job.status.Param)
+		if _, closeErr := m.svr.sessionManager.CloseSession(sessionid); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return errors.Wrapf(err, "write file %s", filepath.Base(file))
+		}
+		job.update(func(status *JobStatus) {
+			progress.FilesDone++
+			progress.Rows += result.Rows
+			progress.Kvs += result.Kvs
+		})
+	}
+	return nil
+}
+
+// rollbackTable closes and cleans up the engine of a table failed before it's imported,
+// so the partial data is not left on importer.
+func (m *JobManager) rollbackTable(job *Job, progress *TableProgress, engineUUID uuid.UUID) {
+	if !job.stepFinished(progress.Steps, StepOpenEngine) || job.stepFinished(progress.Steps, StepImportEngine) {
+		return
+	}
+	rollback := &StepStatus{Name: StepRollback, State: StepPending}
+	job.update(func(status *JobStatus) {
+		progress.Steps = append(progress.Steps, rollback)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), jobRollbackTimeout)
+	defer cancel()
+	err := m.runStep(ctx, job, rollback, job.status.Param.Retries, func(ctx context.Context) error {
+		if info := m.svr.engines.Get(engineUUID); info != nil && (info.State == EngineOpened || info.State == EngineWriting) {
+			if err := m.svr.CloseEngine(ctx, engineUUID); err != nil {
+				return err
+			}
+		}
+		return m.svr.CleanupEngine(ctx, engineUUID)
+	})
+	if err != nil {
+		logrus.Errorf("[job %s] fail to rollback engine %s of %s.%s, error: %v",
+			job.status.Id, engineUUID, progress.Schema, progress.Table, err)
+	}
+}
+
+// maxStmtsPerWrite is the max insert statements encoded in one session write.
+const maxStmtsPerWrite = 16
+
+func (m *JobManager) writeFile(ctx context.Context, session *WriteSession, path string, param *JobParam) (*WriteResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	if filepath.Ext(path) == ".csv" {
+		ts, err := m.svr.oracle.GetTimestamp(ctx)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		opts := DefaultCSVOptions()
+		opts.Header = param.CSVHeader
+		return session.WriteCSV(ctx, 0, f, &CSVWriteParam{CSVOptions: opts, ChunkRows: 1000}, ts)
+	}
+
+	result := &WriteResult{Indexes: make(map[string]uint64)}
+	stmts := make([]string, 0, maxStmtsPerWrite)
+	flush := func() error {
+		if len(stmts) == 0 {
+			return nil
+		}
+		ts, err := m.svr.oracle.GetTimestamp(ctx)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		res, err := session.Write(ctx, 0, stmts, ts)
+		if err != nil {
+			return err
+		}
+		result.merge(res)
+		stmts = stmts[:0]
+		return nil
+	}
+
+	reader := NewSQLReader(f)
+	for {
+		stmt, err := reader.ReadStmt()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return result, err
+		}
+		// skip set statements in header of dump files
+		if !isInsertStmt(stmt) {
+			continue
+		}
+		stmts = append(stmts, stmt)
+		if len(stmts) >= maxStmtsPerWrite {
+			if err = flush(); err != nil {
+				return result, err
+			}
+		}
+	}
+	return result, flush()
+}
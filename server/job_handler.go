@@ -0,0 +1,63 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"github.com/unrolled/render"
+	"net/http"
+	"sort"
+)
+
+type JobHandler struct {
+	r   *render.Render
+	svr *Server
+}
+
+func (h *JobHandler) Submit(w http.ResponseWriter, r *http.Request) {
+	param := &JobParam{}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(param); err != nil {
+		h.r.JSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	job, err := h.svr.jobManager.Submit(param)
+	if err != nil {
+		h.r.JSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	h.r.JSON(w, http.StatusCreated, job.Status())
+}
+
+func (h *JobHandler) List(w http.ResponseWriter, r *http.Request) {
+	jobs := h.svr.jobManager.ListJobs()
+	statuses := make([]*JobStatus, 0, len(jobs))
+	for _, job := range jobs {
+		statuses = append(statuses, job.Status())
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].CreatedAt.Before(statuses[j].CreatedAt)
+	})
+	h.r.JSON(w, http.StatusOK, statuses)
+}
+
+func (h *JobHandler) Get(w http.ResponseWriter, r *http.Request) {
+	jobid := mux.Vars(r)["jobid"]
+	job := h.svr.jobManager.GetJob(jobid)
+	if job == nil {
+		h.r.JSON(w, http.StatusNotFound, "job is not exist")
+		return
+	}
+	h.r.JSON(w, http.StatusOK, job.Status())
+}
+
+func (h *JobHandler) Cancel(w http.ResponseWriter, r *http.Request) {
+	jobid := mux.Vars(r)["jobid"]
+	job := h.svr.jobManager.GetJob(jobid)
+	if job == nil {
+		h.r.JSON(w, http.StatusNotFound, "job is not exist")
+		return
+	}
+	job.Cancel()
+	h.r.JSON(w, http.StatusOK, job.Status())
+}
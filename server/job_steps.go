@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+type JobStep string
+
+const (
+	StepSwitchImport  JobStep = "switch_import_mode"
+	StepOpenEngine    JobStep = "open_engine"
+	StepWrite         JobStep = "write"
+	StepCloseEngine   JobStep = "close_engine"
+	StepImportEngine  JobStep = "import_engine"
+	StepCleanupEngine JobStep = "cleanup_engine"
+	StepCompactTable  JobStep = "compact_table"
+	StepRollback      JobStep = "rollback"
+	StepSwitchNormal  JobStep = "switch_normal_mode"
+)
+
+type StepState string
+
+const (
+	StepPending  StepState = "pending"
+	StepRunning  StepState = "running"
+	StepFinished StepState = "finished"
+	StepFailed   StepState = "failed"
+	StepSkipped  StepState = "skipped"
+)
+
+const (
+	// jobRetryBackoff is the wait before retrying a failed step, it doubles up to jobMaxRetryBackoff.
+	jobRetryBackoff    = time.Second
+	jobMaxRetryBackoff = 30 * time.Second
+	// jobRollbackTimeout bounds the steps run after a job is failed or canceled.
+	jobRollbackTimeout = 5 * time.Minute
+)
+
+// StepStatus is the status of a step in job.
+type StepStatus struct {
+	Name       JobStep    `json:"name"`
+	State      StepState  `json:"state"`
+	Attempts   int        `json:"attempts"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+func newSteps(names ...JobStep) []*StepStatus {
+	steps := make([]*StepStatus, 0, len(names))
+	for _, name := range names {
+		steps = append(steps, &StepStatus{Name: name, State: StepPending})
+	}
+	return steps
+}
+
+func copySteps(steps []*StepStatus) []*StepStatus {
+	copied := make([]*StepStatus, 0, len(steps))
+	for _, step := range steps {
+		s := *step
+		copied = append(copied, &s)
+	}
+	return copied
+}
+
+// findStep returns the step of name, it should be called with job locked.
+func findStep(steps []*StepStatus, name JobStep) *StepStatus {
+	for _, step := range steps {
+		if step.Name == name {
+			return step
+		}
+	}
+	return nil
+}
+
+// stepFinished returns whether step of name is finished.
+func (j *Job) stepFinished(steps []*StepStatus, name JobStep) bool {
+	j.Lock()
+	defer j.Unlock()
+	step := findStep(steps, name)
+	return step != nil && step.State == StepFinished
+}
+
+// skipStep marks step as skipped.
+func (j *Job) skipStep(step *StepStatus) {
+	j.update(func(status *JobStatus) {
+		step.State = StepSkipped
+	})
+}
+
+// runStep runs f as step, a failed step is retried at most retries times with backoff, no retry
+// if retries is negative. Steps failed by illegal engine state are not retried.
+func (m *JobManager) runStep(ctx context.Context, job *Job, step *StepStatus, retries int, f func(ctx context.Context) error) error {
+	backoff := jobRetryBackoff
+	for {
+		job.update(func(status *JobStatus) {
+			now := time.Now()
+			step.State = StepRunning
+			step.Attempts++
+			if step.StartedAt == nil {
+				step.StartedAt = &now
+			}
+		})
+		err := f(ctx)
+
+		var attempts int
+		job.update(func(status *JobStatus) {
+			attempts = step.Attempts
+			if err == nil {
+				now := time.Now()
+				step.State = StepFinished
+				step.Error = ""
+				step.FinishedAt = &now
+				return
+			}
+			step.Error = err.Error()
+		})
+		if err == nil {
+			return nil
+		}
+
+		_, illegal := errors.Cause(err).(*EngineStateError)
+		if attempts > retries || illegal || ctx.Err() != nil {
+			job.update(func(status *JobStatus) {
+				now := time.Now()
+				step.State = StepFailed
+				step.FinishedAt = &now
+			})
+			return errors.Wrapf(err, "step %s", step.Name)
+		}
+		logrus.Warnf("[job %s] step %s failed, retry %d after %v, error: %v", job.status.Id, step.Name, attempts, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		}
+		backoff *= 2
+		if backoff > jobMaxRetryBackoff {
+			backoff = jobMaxRetryBackoff
+		}
+	}
+}
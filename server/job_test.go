@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"github.com/lerencao/tidb-light/config"
+	"github.com/lerencao/tidb-light/mockimporter"
+	"github.com/satori/go.uuid"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// startJobServer starts a server importing to mock, with table test.t in its schema catalog.
+func startJobServer(t *testing.T, dir string, mock *mockimporter.Server) *Server {
+	addr, err := mock.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	catalog := filepath.Join(dir, "catalog.toml")
+	err = ioutil.WriteFile(catalog, []byte(`
+[[tables]]
+schema = "test"
+table = "t"
+db-id = 1
+id = 45
+ddl = "CREATE TABLE t (id int, name varchar(16), PRIMARY KEY (id))"
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.NewConfig()
+	cfg.ImporterAddr = addr
+	cfg.SchemaCatalog = catalog
+	cfg.ImportModeState = filepath.Join(dir, "import_mode.json")
+	svr := NewServer(cfg)
+	if err = svr.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return svr
+}
+
+// runTestTable imports test.t of data files by the pipeline of a job.
+func runTestTable(t *testing.T, svr *Server, param *JobParam, files ...string) (*Job, *TableProgress, error) {
+	job := &Job{
+		status: JobStatus{Id: "test", Param: param},
+		uuid:   uuid.NewV4(),
+	}
+	table := &DumpTable{Schema: "test", Name: "t", DataFiles: files}
+	progress := &TableProgress{
+		Schema: "test",
+		Table:  "t",
+		Steps: newSteps(StepOpenEngine, StepWrite, StepCloseEngine,
+			StepImportEngine, StepCleanupEngine, StepCompactTable),
+	}
+	job.status.Tables = []*TableProgress{progress}
+	err := svr.jobManager.importTable(context.Background(), job, table, progress)
+	return job, progress, err
+}
+
+func writeDataFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestJob_RetrySteps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mock := mockimporter.New()
+	defer mock.Stop()
+	svr := startJobServer(t, dir, mock)
+	defer svr.Close()
+
+	file := writeDataFile(t, dir, "test.t.sql", "INSERT INTO t VALUES (1, 'a'), (2, 'b');\nINSERT INTO t VALUES (3, 'c');\n")
+	mock.InjectFaults(mockimporter.Faults{CloseErrors: 1, ImportErrors: 1})
+	job, progress, err := runTestTable(t, svr, &JobParam{PdAddr: "pd", Retries: 1}, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[JobStep]int{StepOpenEngine: 1, StepWrite: 1, StepCloseEngine: 2, StepImportEngine: 2, StepCleanupEngine: 1, StepCompactTable: 1}
+	for name, attempts := range expected {
+		step := findStep(progress.Steps, name)
+		if step.State != StepFinished || step.Attempts != attempts {
+			t.Fatalf("expect step %s finished after %d attempts, got %+v", name, attempts, step)
+		}
+	}
+	if progress.Rows != 3 || progress.FilesDone != 1 {
+		t.Fatalf("expect 3 rows of 1 file written, got %d rows of %d files", progress.Rows, progress.FilesDone)
+	}
+	engineUUID := uuid.NewV5(job.uuid, "test.t")
+	if info := svr.engines.Get(engineUUID); info == nil || info.State != EngineCleaned {
+		t.Fatalf("expect engine cleaned, got %+v", info)
+	}
+	if mock.Compactions() != 1 {
+		t.Fatalf("expect table compacted, got %d compactions", mock.Compactions())
+	}
+}
+
+func TestJob_RollbackFailedWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mock := mockimporter.New()
+	defer mock.Stop()
+	svr := startJobServer(t, dir, mock)
+	defer svr.Close()
+
+	files := []string{
+		writeDataFile(t, dir, "test.t.0.sql", "INSERT INTO t VALUES (1, 'a');\n"),
+		writeDataFile(t, dir, "test.t.1.sql", "INSERT INTO t (id, no_exists_column) VALUES (2, 'b');\n"),
+	}
+	job, progress, err := runTestTable(t, svr, &JobParam{PdAddr: "pd", Retries: -1}, files...)
+	if err == nil {
+		t.Fatal("write of unknown column should fail")
+	}
+
+	if step := findStep(progress.Steps, StepWrite); step.State != StepFailed {
+		t.Fatalf("expect write failed, got %+v", step)
+	}
+	if step := findStep(progress.Steps, StepCloseEngine); step.State != StepPending {
+		t.Fatalf("expect steps after write not run, got %+v", step)
+	}
+	if step := findStep(progress.Steps, StepRollback); step == nil || step.State != StepFinished {
+		t.Fatalf("expect engine rolled back, got %+v", step)
+	}
+
+	// the partial data of the first file is cleaned up
+	engineUUID := uuid.NewV5(job.uuid, "test.t")
+	if state, ok := mock.EngineState(engineUUID.Bytes()); ok {
+		t.Fatalf("expect engine removed from importer, got %s", state)
+	}
+	if info := svr.engines.Get(engineUUID); info == nil || info.State != EngineCleaned || info.Sessions != 0 {
+		t.Fatalf("expect engine cleaned without sessions, got %+v", info)
+	}
+}
@@ -1 +1,86 @@
 package server
+
+import (
+	"github.com/pingcap/tidb/model"
+	"github.com/pingcap/tidb/tablecodec"
+	"strings"
+	"testing"
+)
+
+// TestIndexIdMapping checks index ids of the table created by kvencoder map to the indexes of the same
+// name in tidb, including the implicit primary key, anonymous indexes and unique column options.
+func TestIndexIdMapping(t *testing.T) {
+	ddl := "CREATE TABLE t (" +
+		"id varchar(16), code varchar(16), name varchar(16), age int UNIQUE, " +
+		"PRIMARY KEY (id, code), KEY (name), KEY (name, age))"
+	tableInfo, err := buildTableInfo(ddl, 45, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// indexes in tidb are neither in the order of ddl nor of ids, as if indexes were added and dropped,
+	// and an index being added is not public yet
+	ids := map[string]int64{"primary": 7, "name": 3, "name_2": 9, "age": 4}
+	indices := []*model.IndexInfo{{ID: 10, Name: model.NewCIStr("adding"), State: model.StateWriteOnly}}
+	for i := len(tableInfo.Indices) - 1; i >= 0; i-- {
+		indexInfo := *tableInfo.Indices[i]
+		indexInfo.ID = ids[indexInfo.Name.L]
+		indices = append(indices, &indexInfo)
+	}
+	tableInfo.Indices = indices
+	indexes, err := indexIdMapping(tableInfo, ddl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(indexes) != 4 {
+		t.Fatalf("expect 4 indexes, got %d", len(indexes))
+	}
+
+	allocator := NewTableAllocators(nil, 10).NewSessionAllocator(1, 45)
+	encoders, err := newEncoderPool("test", ddl, allocator, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeEncoders(encoders)
+	kvs, _, err := encoders[0].Encode("INSERT INTO t VALUES ('a', 'b', 'c', 7)", 45)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the values of each index key start with the columns of the mapped index, keys of non unique
+	// indexes are followed by the handle
+	expected := map[string]string{"primary": "a,b", "name": "c", "name_2": "c,7", "age": "7"}
+	seen := 0
+	for _, pair := range kvs {
+		_, localId, values, err := tablecodec.DecodeIndexKey(pair.Key)
+		if err != nil {
+			continue
+		}
+		indexInfo, ok := indexes[localId]
+		if !ok {
+			t.Fatalf("local index id %d is not mapped", localId)
+		}
+		if len(values) < len(indexInfo.Columns) {
+			t.Fatalf("local index id %d is mapped to %s, but has values %v", localId, indexInfo.Name.O, values)
+		}
+		if got := strings.Join(values[:len(indexInfo.Columns)], ","); got != expected[indexInfo.Name.L] {
+			t.Fatalf("local index id %d is mapped to %s(%d), but has values %s", localId, indexInfo.Name.O, indexInfo.ID, got)
+		}
+		seen++
+	}
+	if seen != 4 {
+		t.Fatalf("expect 4 index keys, got %d", seen)
+	}
+}
+
+func TestIndexIdMapping_MissingIndex(t *testing.T) {
+	ddl := "CREATE TABLE t (id int, name varchar(16), KEY idx_name (name))"
+	tableInfo, err := buildTableInfo(ddl, 45, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the index is dropped in tidb after ddl is fetched
+	tableInfo.Indices = nil
+	if _, err = indexIdMapping(tableInfo, ddl); err == nil {
+		t.Fatal("an index of ddl missing in tidb should be rejected")
+	}
+}
@@ -2,11 +2,15 @@ package server
 
 import (
 	"context"
+	"fmt"
 	"github.com/juju/errors"
 	"github.com/pingcap/kvproto/pkg/import_kvpb"
+	"github.com/satori/go.uuid"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,22 +19,75 @@ var (
 	errClosing = errors.New("[writer] closing")
 )
 
+// sentBatch is a batch in the retry buffer.
+type sentBatch struct {
+	// batch is nil for a flush.
+	batch *import_kvpb.WriteBatch
+	size  int
+	// req is the write or flush waiting for the batch, it's nil if the req is finished or the batch is coalesced.
+	req *writeReq
+}
+
 type writeReq struct {
 	mutation *import_kvpb.WriteBatch
-	ctx      context.Context
-	done     chan error
+	// sync is a flush without mutation, it waits until all mutations before it are sent,
+	// or acknowledged by importer in ack mode.
+	sync   bool
+	ctx    context.Context
+	future *WriteFuture
+	// queued is the bytes of mutation accounted in queue, they are released when req is finished.
+	queue  *writeQueue
+	queued int
 }
 
-func NewEngineWriter(grpcConn *grpc.ClientConn, engineId []byte) *EngineWriter {
+// WriterOptions is the options of EngineWriter.
+type WriterOptions struct {
+	// CoalesceBytes is the size threshold of coalesced mutations to be sent, 0 disables coalescing.
+	CoalesceBytes int
+	// CoalesceInterval is the max time coalesced mutations wait before being sent.
+	CoalesceInterval time.Duration
+	// AckWrites enables ack mode, in which a write is finished only after the importer acknowledges it.
+	// The stream is completed to get the response every AckInterval, or when AckBytes are unacknowledged.
+	AckWrites   bool
+	AckInterval time.Duration
+	AckBytes    int
+	// RetryBufferBytes bounds the batches kept for replay, the stream is completed when it's exceeded.
+	RetryBufferBytes int
+	// RetryLimit is the max retries to reconnect and replay, the wait between retries starts from
+	// RetryBackoff and doubles up to RetryMaxBackoff.
+	RetryLimit      int
+	RetryBackoff    time.Duration
+	RetryMaxBackoff time.Duration
+	// QueueBytes bounds bytes of queued writes, 0 means unbounded. A write waits at most EnqueueTimeout
+	// for room in the queue, then it's rejected with BackpressureError.
+	QueueBytes     int
+	EnqueueTimeout time.Duration
+	// SpillDir enables spilling batches to local segment files of SpillSegmentBytes, when more than
+	// SpillThreshold bytes are queued. Spilled batches are drained to importer in order.
+	// A spilled write is finished once it's on disk, so spilling is disabled in ack mode.
+	SpillDir          string
+	SpillThreshold    int
+	SpillSegmentBytes int
+}
+
+func NewEngineWriter(grpcConn *grpc.ClientConn, engineId []byte, opts WriterOptions) *EngineWriter {
 	ctx, cancel := context.WithCancel(context.Background())
 	writer := &EngineWriter{
 		client:   import_kvpb.NewImportKVClient(grpcConn),
 		engineId: engineId,
+		opts:     opts,
 		ctx:      ctx,
 		cancel:   cancel,
 
 		wg:          &sync.WaitGroup{},
 		requestChan: make(chan *writeReq, 100000),
+		queue:       newWriteQueue(opts.QueueBytes),
+	}
+	if opts.SpillDir != "" && opts.AckWrites {
+		logrus.Warnf("[importer_writer] spilling is disabled in ack mode")
+	} else if opts.SpillDir != "" {
+		dir := fmt.Sprintf("%s-%s", uuid.FromBytesOrNil(engineId), uuid.NewV4())
+		writer.spill = newSpillQueue(filepath.Join(opts.SpillDir, dir), opts.SpillSegmentBytes)
 	}
 	return writer
 }
@@ -38,13 +95,77 @@ func NewEngineWriter(grpcConn *grpc.ClientConn, engineId []byte) *EngineWriter {
 type EngineWriter struct {
 	client   import_kvpb.ImportKVClient
 	engineId []byte
+	opts     WriterOptions
 	ctx      context.Context
 	cancel   context.CancelFunc
 
 	wg          *sync.WaitGroup
 	requestChan chan *writeReq
+	queue       *writeQueue
+	// closed is set by Close after the loop exits, reqs are only sent to requestChan before it's set,
+	// so every req is either handled by the loop or failed by Close.
+	closeMu sync.RWMutex
+	closed  bool
+	// connected is 1 if the loop has a usable write stream, it's accessed atomically.
+	connected int32
+	// spill is nil if spilling is disabled.
+	spill *spillQueue
+	// spillErr is the error of spilled batches failed after their writes finished, it's returned by the next Flush.
+	spillMu  sync.Mutex
+	spillErr error
 
 	loopCancel context.CancelFunc
+
+	// pending is the coalesced mutations not sent yet, they are only accessed by the loop.
+	pending     *import_kvpb.WriteBatch
+	pendingSize int
+	// pendingErr is the error of mutations lost after their writes finished, it's returned by the next sync req.
+	pendingErr error
+
+	// stream is the current write stream, it's only accessed by the loop.
+	stream       import_kvpb.ImportKV_WriteEngineClient
+	streamCancel context.CancelFunc
+	// unacked is the retry buffer of batches sent on stream but not acknowledged by importer,
+	// they are replayed on a new stream if the stream breaks.
+	unacked      []*sentBatch
+	unackedBytes int
+
+	errMu     sync.Mutex
+	lastErr   error
+	lastErrAt time.Time
+}
+
+// EngineWriterStats is the status of writer.
+type EngineWriterStats struct {
+	Streams    int        `json:"streams"`
+	QueueDepth int        `json:"queue_depth"`
+	QueueBytes int        `json:"queue_bytes"`
+	LastError  *ErrorInfo `json:"last_error,omitempty"`
+	// SpilledBatches and SpilledBytes are the batches in spill files waiting to be drained.
+	SpilledBatches int   `json:"spilled_batches"`
+	SpilledBytes   int64 `json:"spilled_bytes"`
+	// SinkFiles is the files written by a file sink.
+	SinkFiles int `json:"sink_files,omitempty"`
+}
+
+func (w *EngineWriter) Stats() EngineWriterStats {
+	stats := EngineWriterStats{Streams: 1, QueueDepth: len(w.requestChan), QueueBytes: w.queue.size()}
+	if w.spill != nil {
+		stats.SpilledBatches, stats.SpilledBytes = w.spill.stats()
+	}
+	w.errMu.Lock()
+	defer w.errMu.Unlock()
+	if w.lastErr != nil {
+		stats.LastError = &ErrorInfo{Error: w.lastErr.Error(), Time: w.lastErrAt}
+	}
+	return stats
+}
+
+func (w *EngineWriter) setLastError(err error) {
+	w.errMu.Lock()
+	defer w.errMu.Unlock()
+	w.lastErr = err
+	w.lastErrAt = time.Now()
 }
 
 func (w *EngineWriter) Open() {
@@ -52,94 +173,502 @@ func (w *EngineWriter) Open() {
 	loopCtx, loopCancel := context.WithCancel(w.ctx)
 	w.loopCancel = loopCancel
 	go w.reqHandleLoop(loopCtx)
+	if w.spill != nil {
+		w.wg.Add(1)
+		go w.drainLoop(loopCtx)
+	}
 }
 
 func (w *EngineWriter) Close() {
 	if w.loopCancel != nil {
+		if w.spill != nil {
+			// spilled batches are finished before they are sent, drain them before closing the stream
+			if err := w.Flush(w.ctx); err != nil {
+				logrus.Errorf("[importer_writer] fail to drain spilled batches, error: %v", err)
+			}
+		}
 		w.loopCancel()
 		logrus.Infof("Wait loop")
 		w.wg.Wait()
 	}
 	w.cancel()
+	w.closeMu.Lock()
+	w.closed = true
+	w.closeMu.Unlock()
 	w.failWriteReqs(errClosing)
+	if w.spill != nil {
+		if lost := w.spill.close(); lost > 0 {
+			logrus.Errorf("[importer_writer] %d spilled batches are dropped", lost)
+		}
+	}
+}
+
+// AcksWrites returns whether writes are acknowledged by importer before they are finished.
+func (c *EngineWriter) AcksWrites() bool {
+	return c.opts.AckWrites
+}
+
+// Coalesces returns whether small writes are coalesced before they are sent.
+func (c *EngineWriter) Coalesces() bool {
+	return c.opts.CoalesceBytes > 0
 }
 
 func (c *EngineWriter) WriteEngine(ctx context.Context, mutation *import_kvpb.WriteBatch) error {
-	req := &writeReq{mutation: mutation, ctx: ctx, done: make(chan error, 1)}
-	c.requestChan <- req
+	future := newWriteFuture()
+	if err := c.push(ctx, mutation, future); err != nil {
+		return err
+	}
+	return future.Wait(ctx)
+}
+
+// Flush waits until all mutations written before are sent, or acknowledged by importer in ack mode.
+// Spilled mutations are drained first.
+func (c *EngineWriter) Flush(ctx context.Context) error {
+	if c.spill != nil {
+		if err := c.spill.waitEmpty(ctx); err != nil {
+			return err
+		}
+	}
+	future := newWriteFuture()
+	err := c.enqueue(ctx, &writeReq{sync: true, ctx: ctx, future: future})
+	if err == nil {
+		err = future.Wait(ctx)
+	}
+	if c.spill != nil {
+		c.spillMu.Lock()
+		if err == nil {
+			err = c.spillErr
+		}
+		c.spillErr = nil
+		c.spillMu.Unlock()
+	}
+	return err
+}
 
-	select {
-	case err := <-req.done:
+// push queues mutation to be sent without waiting, future is resolved with the result.
+// It returns BackpressureError if there's no room in the queue within EnqueueTimeout.
+func (c *EngineWriter) push(ctx context.Context, mutation *import_kvpb.WriteBatch, future *WriteFuture) error {
+	if c.ctx.Err() != nil {
+		return errClosing
+	}
+	size := mutation.Size()
+	if c.spill != nil {
+		spilled, err := c.spill.push(mutation, c.queue.size()+size > c.opts.SpillThreshold)
+		if err != nil {
+			return err
+		}
+		if spilled {
+			// the batch is finished once it's on disk, like a coalesced one
+			future.resolve(nil)
+			return nil
+		}
+	}
+	if err := c.queue.acquire(ctx, size, c.opts.EnqueueTimeout); err != nil {
+		if err == errEnqueueTimeout {
+			return c.backpressure(fmt.Sprintf("%d bytes are queued", c.queue.size()))
+		}
 		return err
-	case <-req.ctx.Done():
-		return errors.Trace(req.ctx.Err())
 	}
+	return c.enqueue(ctx, &writeReq{mutation: mutation, ctx: ctx, future: future, queue: c.queue, queued: size})
+}
+
+// enqueue sends req to the loop. It fails if ctx is done or writer is closing, then req is finished with the error.
+func (c *EngineWriter) enqueue(ctx context.Context, req *writeReq) error {
+	c.closeMu.RLock()
+	defer c.closeMu.RUnlock()
+	var err error
+	if c.closed {
+		err = errClosing
+	} else {
+		select {
+		case c.requestChan <- req:
+			return nil
+		case <-ctx.Done():
+			err = errors.Trace(ctx.Err())
+		case <-c.ctx.Done():
+			err = errClosing
+		}
+	}
+	finishWriteReq(req, err)
+	return err
+}
+
+// drainLoop sends spilled batches to the loop in order, a batch is removed from spill files
+// after it's queued. Errors of drained batches are returned by the next Flush.
+func (c *EngineWriter) drainLoop(loopCtx context.Context) {
+	defer c.wg.Done()
+	for {
+		batch, n, err := c.spill.peek(loopCtx)
+		if loopCtx.Err() != nil {
+			return
+		}
+		if err != nil {
+			lost := c.spill.discard()
+			logrus.Errorf("[importer_writer] fail to read spilled batches, %d batches are lost, error: %v", lost, err)
+			c.setLastError(err)
+			c.setSpillErr(errors.Annotatef(err, "%d spilled batches are lost", lost))
+			continue
+		}
+
+		size := batch.Size()
+		for {
+			// wait as long as needed, the batch is already accepted
+			err = c.queue.acquire(loopCtx, size, time.Second)
+			if err != errEnqueueTimeout {
+				break
+			}
+		}
+		if err != nil {
+			return
+		}
+		future := newWriteFuture()
+		future.onResolve = func() {
+			if future.err != nil {
+				c.setSpillErr(future.err)
+			}
+		}
+		if err = c.enqueue(loopCtx, &writeReq{mutation: batch, ctx: loopCtx, future: future, queue: c.queue, queued: size}); err != nil {
+			return
+		}
+		c.spill.commit(n)
+	}
+}
+
+func (c *EngineWriter) setSpillErr(err error) {
+	c.spillMu.Lock()
+	defer c.spillMu.Unlock()
+	if c.spillErr == nil {
+		c.spillErr = err
+	}
+}
+
+// backpressure returns the error of a rejected write, the importer is unavailable if there's no write stream.
+func (c *EngineWriter) backpressure(reason string) error {
+	if atomic.LoadInt32(&c.connected) == 0 {
+		return &BackpressureError{Unavailable: true, RetryAfter: c.opts.RetryMaxBackoff, Reason: reason}
+	}
+	return &BackpressureError{RetryAfter: c.opts.EnqueueTimeout, Reason: reason}
 }
 
 func (c *EngineWriter) reqHandleLoop(loopCtx context.Context) {
 	defer c.wg.Done()
 
-	var writeStream import_kvpb.ImportKV_WriteEngineClient
-	var streamCancel context.CancelFunc
+	var flushTick, ackTick <-chan time.Time
+	if c.opts.CoalesceBytes > 0 {
+		ticker := time.NewTicker(c.opts.CoalesceInterval)
+		defer ticker.Stop()
+		flushTick = ticker.C
+	}
+	if c.opts.AckWrites {
+		ticker := time.NewTicker(c.opts.AckInterval)
+		defer ticker.Stop()
+		ackTick = ticker.C
+	}
 
 	for {
-		var err error
-
-		if writeStream == nil {
-			var streamCtx context.Context
-			streamCtx, streamCancel = context.WithCancel(c.ctx)
-			writeStream, err = c.client.WriteEngine(streamCtx)
-			logrus.Infof("create write steam")
-			if err == nil {
-				err = initialSend(writeStream, c.engineId)
-			}
-			if err != nil {
+		if c.stream == nil {
+			if err := c.reconnect(loopCtx); err != nil {
+				if loopCtx.Err() != nil {
+					c.finishUnacked(errClosing)
+					return
+				}
 				logrus.Errorf("[importer_writer] create write stream error: %v", err)
-				streamCancel()
-				c.failWriteReqs(err)
+				c.setLastError(err)
+				c.finishUnacked(err)
+				c.failWriteReqs(c.backpressure(err.Error()))
 				select {
-				case <-time.After(time.Second):
+				case <-time.After(c.opts.RetryMaxBackoff):
 				case <-loopCtx.Done():
 					return
 				}
-
-				continue
 			}
-			logrus.Infof("write init head")
+			continue
 		}
 
 		select {
 		case req := <-c.requestChan:
-			err := c.processWriteReq(writeStream, req)
-			if err != nil {
-				logrus.Errorf("[importer] send write req error: %v", err)
-				streamCancel()
-				// closeWriteStream(writeStream)
-				writeStream, streamCancel = nil, nil
+			c.checkStream(c.handleWriteReq(req))
+		case <-flushTick:
+			c.checkStream(c.flushPending())
+		case <-ackTick:
+			if len(c.unacked) > 0 {
+				c.checkStream(c.completeStream())
 			}
 		case <-loopCtx.Done():
 			logrus.Infof("closing write stream")
-			err := closeWriteStream(writeStream)
-			if err != nil {
-				logrus.Errorf("fail to close write stream, error: %v", err)
-			}
-			streamCancel()
+			c.closeStream()
 			logrus.Infof("return from loop")
 			return
 		}
 	}
 }
 
-func (c *EngineWriter) processWriteReq(client import_kvpb.ImportKV_WriteEngineClient, writeReq *writeReq) error {
-	logrus.Infof("process write req")
-	req := &import_kvpb.WriteEngineRequest{
+// checkStream drops the stream if err is not nil, the retry buffer is replayed on the next stream.
+func (c *EngineWriter) checkStream(err error) {
+	if err == nil {
+		return
+	}
+	logrus.Errorf("[importer] write stream of engine is broken, %d batches will be replayed, error: %v", len(c.unacked), err)
+	c.setLastError(err)
+	c.dropStream()
+}
+
+func (c *EngineWriter) dropStream() {
+	atomic.StoreInt32(&c.connected, 0)
+	if c.stream != nil {
+		c.streamCancel()
+		c.stream, c.streamCancel = nil, nil
+	}
+}
+
+func (c *EngineWriter) openStream() error {
+	streamCtx, streamCancel := context.WithCancel(c.ctx)
+	stream, err := c.client.WriteEngine(streamCtx)
+	logrus.Infof("create write steam")
+	if err == nil {
+		err = initialSend(stream, c.engineId)
+	}
+	if err != nil {
+		streamCancel()
+		return errors.Trace(err)
+	}
+	c.stream, c.streamCancel = stream, streamCancel
+	atomic.StoreInt32(&c.connected, 1)
+	return nil
+}
+
+// reconnect opens a new stream with write head, and replays the retry buffer on it.
+// It retries with backoff until RetryLimit is reached.
+func (c *EngineWriter) reconnect(ctx context.Context) error {
+	backoff := c.opts.RetryBackoff
+	for retry := 0; ; retry++ {
+		err := c.openStream()
+		if err == nil {
+			err = c.replay()
+		}
+		if err == nil {
+			return nil
+		}
+		c.dropStream()
+		if retry >= c.opts.RetryLimit {
+			return errors.Annotatef(err, "reconnect after %d retries", retry)
+		}
+		logrus.Warnf("[importer_writer] fail to reconnect write stream, retry %d after %v, error: %v", retry+1, backoff, err)
+		c.setLastError(err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return errors.Trace(ctx.Err())
+		}
+		backoff *= 2
+		if backoff > c.opts.RetryMaxBackoff {
+			backoff = c.opts.RetryMaxBackoff
+		}
+	}
+}
+
+// replay re-sends the retry buffer on a new stream. In ack mode, the stream is completed at once
+// if a flush is waiting.
+func (c *EngineWriter) replay() error {
+	if len(c.unacked) == 0 {
+		return nil
+	}
+	logrus.Infof("[importer_writer] replay %d batches, %d bytes", len(c.unacked), c.unackedBytes)
+	flushing := false
+	for _, sent := range c.unacked {
+		if sent.batch != nil {
+			err := c.stream.Send(&import_kvpb.WriteEngineRequest{
+				Chunk: &import_kvpb.WriteEngineRequest_Batch{
+					Batch: sent.batch,
+				},
+			})
+			if err != nil {
+				return errors.Trace(err)
+			}
+		}
+		if sent.req != nil && sent.req.sync {
+			flushing = true
+		}
+		if !c.opts.AckWrites {
+			c.finishSent(sent)
+		}
+	}
+	if flushing && c.opts.AckWrites {
+		return c.completeStream()
+	}
+	return nil
+}
+
+// closeStream sends pending mutations and completes the stream when writer is closing.
+func (c *EngineWriter) closeStream() {
+	err := c.flushPending()
+	if err == nil {
+		err = c.completeStream()
+	}
+	if err != nil {
+		// the stream is broken, finish the retry buffer on a new one
+		c.checkStream(err)
+		if err = c.reconnect(c.ctx); err == nil {
+			err = c.completeStream()
+		}
+	}
+	if err != nil {
+		logrus.Errorf("fail to close write stream, error: %v", err)
+		c.setLastError(err)
+		c.finishUnacked(err)
+		c.dropStream()
+	}
+}
+
+// completeStream closes the stream and checks the response of importer, the retry buffer is
+// finished with the result. The buffer is kept for replay if the stream is broken.
+func (c *EngineWriter) completeStream() error {
+	if c.stream == nil {
+		return nil
+	}
+	resp, err := c.stream.CloseAndRecv()
+	c.dropStream()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var respErr error
+	if resp.GetError() != nil {
+		respErr = errors.Errorf("importer rejects write stream: %v", resp.GetError())
+		logrus.Errorf("[importer] %v", respErr)
+		c.setLastError(respErr)
+	}
+	c.finishUnacked(respErr)
+	return nil
+}
+
+// finishSent finishes the req of a sent batch, a flush gets the error of mutations lost before it.
+func (c *EngineWriter) finishSent(sent *sentBatch) {
+	if sent.req == nil {
+		return
+	}
+	var err error
+	if sent.req.sync {
+		err, c.pendingErr = c.pendingErr, nil
+	}
+	finishWriteReq(sent.req, err)
+	sent.req = nil
+}
+
+// finishUnacked finishes reqs of the retry buffer with err and clears it.
+// Batches whose reqs are already finished are lost if err is not nil.
+func (c *EngineWriter) finishUnacked(err error) {
+	lost := 0
+	for _, sent := range c.unacked {
+		if sent.req == nil {
+			if sent.batch != nil {
+				lost += len(sent.batch.Mutations)
+			}
+			continue
+		}
+		if err != nil {
+			finishWriteReq(sent.req, err)
+			sent.req = nil
+		} else {
+			c.finishSent(sent)
+		}
+	}
+	if err != nil && lost > 0 {
+		c.pendingErr = errors.Annotatef(err, "%d mutations are lost", lost)
+	}
+	c.unacked, c.unackedBytes = nil, 0
+}
+
+// handleWriteReq sends the mutation of req, or coalesces it with pending mutations if coalescing is enabled.
+// In ack mode, req is finished after the importer acknowledges it. It returns the error of stream.
+func (c *EngineWriter) handleWriteReq(req *writeReq) error {
+	if req.sync {
+		err := c.flushPending()
+		if err == nil && (!c.opts.AckWrites || len(c.unacked) == 0) {
+			c.finishSent(&sentBatch{req: req})
+			return nil
+		}
+		// the flush is finished after the retry buffer is acknowledged, or replayed if the stream is broken
+		c.unacked = append(c.unacked, &sentBatch{req: req})
+		if err != nil {
+			return err
+		}
+		return c.completeStream()
+	}
+
+	if err := req.ctx.Err(); err != nil {
+		// the producer has given up, don't send the mutation
+		finishWriteReq(req, err)
+		return nil
+	}
+
+	var err error
+	if c.opts.CoalesceBytes > 0 {
+		err = c.coalesce(req)
+	} else {
+		err = c.send(&sentBatch{batch: req.mutation, size: req.mutation.Size(), req: req})
+	}
+	if err != nil {
+		return err
+	}
+	if c.unackedBytes >= c.opts.RetryBufferBytes || (c.opts.AckWrites && c.unackedBytes >= c.opts.AckBytes) {
+		return c.completeStream()
+	}
+	return nil
+}
+
+// send adds sent to the retry buffer and sends it. Out of ack mode, the req is finished once it's sent.
+func (c *EngineWriter) send(sent *sentBatch) error {
+	c.unacked = append(c.unacked, sent)
+	c.unackedBytes += sent.size
+	err := c.stream.Send(&import_kvpb.WriteEngineRequest{
 		Chunk: &import_kvpb.WriteEngineRequest_Batch{
-			Batch: writeReq.mutation,
+			Batch: sent.batch,
 		},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if !c.opts.AckWrites {
+		c.finishSent(sent)
+	}
+	return nil
+}
+
+// coalesce merges the mutation of req into pending mutations, which are sent when they are large enough.
+// req is finished once it's merged.
+func (c *EngineWriter) coalesce(req *writeReq) error {
+	m := req.mutation
+	size := m.Size()
+	if c.pending != nil && (c.pending.CommitTs != m.CommitTs || c.pendingSize+size > c.opts.CoalesceBytes) {
+		if err := c.flushPending(); err != nil {
+			// req is not merged, it's replayed after the pending mutations
+			c.unacked = append(c.unacked, &sentBatch{batch: m, size: size, req: req})
+			c.unackedBytes += size
+			return err
+		}
+	}
+	if c.pending == nil {
+		c.pending = &import_kvpb.WriteBatch{CommitTs: m.CommitTs}
+	}
+	c.pending.Mutations = append(c.pending.Mutations, m.Mutations...)
+	c.pendingSize += size
+	finishWriteReq(req, nil)
+
+	if c.pendingSize >= c.opts.CoalesceBytes {
+		return c.flushPending()
+	}
+	return nil
+}
+
+// flushPending sends coalesced mutations, they are kept in the retry buffer until acknowledged.
+func (c *EngineWriter) flushPending() error {
+	if c.pending == nil {
+		return nil
 	}
-	err := client.Send(req)
-	finishWriteReq(writeReq, err)
-	return errors.Trace(err)
+	wb, size := c.pending, c.pendingSize
+	c.pending, c.pendingSize = nil, 0
+	return c.send(&sentBatch{batch: wb, size: size})
 }
 
 func (c *EngineWriter) failWriteReqs(err error) {
@@ -165,19 +694,8 @@ func initialSend(stream import_kvpb.ImportKV_WriteEngineClient, uuid []byte) err
 }
 
 func finishWriteReq(req *writeReq, err error) {
-	req.done <- errors.Trace(err)
-}
-
-func closeWriteStream(stream import_kvpb.ImportKV_WriteEngineClient) error {
-	if stream == nil {
-		return nil
-	}
-	writeResp, err := stream.CloseAndRecv()
-	if err != nil {
-		return errors.Trace(err)
-	}
-	if writeResp.GetError() == nil {
-		return nil
+	if req.queue != nil {
+		req.queue.release(req.queued)
 	}
-	return errors.Errorf("engine not found: %v", writeResp.GetError().GetEngineNotFound().GetUuid())
+	req.future.resolve(errors.Trace(err))
 }
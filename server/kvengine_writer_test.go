@@ -0,0 +1,453 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/lerencao/tidb-light/mockimporter"
+	"github.com/lerencao/tidb-light/server"
+	"github.com/pingcap/kvproto/pkg/import_kvpb"
+	"google.golang.org/grpc"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+var testEngine = []byte("engine")
+
+// startMockImporter starts a mock importer with testEngine opened.
+func startMockImporter(t *testing.T, addr string) (*mockimporter.Server, string) {
+	mock := mockimporter.New()
+	var err error
+	// the address may be not released at once after the previous server stops
+	for i := 0; i < 50; i++ {
+		if addr, err = mock.Start(addr); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = mock.OpenEngine(context.Background(), &import_kvpb.OpenEngineRequest{Uuid: testEngine}); err != nil {
+		t.Fatal(err)
+	}
+	return mock, addr
+}
+
+// newTestWriter connects an engine writer of testEngine to the importer at addr. The writer retries
+// 3 times with 50ms to 200ms backoff and a 1MB replay buffer, override changes the options if not nil.
+// The caller should close the returned connection.
+func newTestWriter(t *testing.T, addr string, override func(opts *server.WriterOptions)) (*server.EngineWriter, *grpc.ClientConn) {
+	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := server.WriterOptions{
+		RetryBufferBytes: 1 << 20,
+		RetryLimit:       3,
+		RetryBackoff:     50 * time.Millisecond,
+		RetryMaxBackoff:  200 * time.Millisecond,
+	}
+	if override != nil {
+		override(&opts)
+	}
+	return server.NewEngineWriter(conn, testEngine, opts), conn
+}
+
+// engineStats returns keys, received batches and completed streams of testEngine.
+func engineStats(mock *mockimporter.Server) (keys, batches, completed int) {
+	stats := mock.EngineStats(testEngine)
+	return len(mock.KVs(testEngine)), stats.Batches, stats.Streams
+}
+
+func testBatch(i int) *import_kvpb.WriteBatch {
+	return &import_kvpb.WriteBatch{
+		CommitTs: 1,
+		Mutations: []*import_kvpb.Mutation{{
+			Op:    import_kvpb.Mutation_Put,
+			Key:   []byte(fmt.Sprintf("key-%d", i)),
+			Value: bytes.Repeat([]byte{'v'}, 16),
+		}},
+	}
+}
+
+func waitUntil(t *testing.T, cond func() bool) {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("timeout")
+}
+
+func TestEngineWriter_ReplayOnReconnect(t *testing.T) {
+	mock1, addr := startMockImporter(t, "127.0.0.1:0")
+	writer, conn := newTestWriter(t, addr, func(opts *server.WriterOptions) {
+		opts.RetryLimit = 50
+	})
+	defer conn.Close()
+	writer.Open()
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := writer.WriteEngine(ctx, testBatch(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitUntil(t, func() bool {
+		_, batches, _ := engineStats(mock1)
+		return batches == 2
+	})
+
+	// kill the importer in the middle of the stream, and restart it at the same address
+	mock1.Stop()
+	mock2, _ := startMockImporter(t, addr)
+	defer mock2.Stop()
+
+	if err := writer.WriteEngine(ctx, testBatch(2)); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+
+	if _, _, completed := engineStats(mock1); completed != 0 {
+		t.Fatalf("the stream of killed importer should not be completed")
+	}
+	keys, _, completed := engineStats(mock2)
+	if completed == 0 {
+		t.Fatalf("the stream of restarted importer should be completed")
+	}
+	if keys != 3 {
+		t.Fatalf("expect 3 keys after replay, got %d", keys)
+	}
+	for i := 0; i < 3; i++ {
+		if _, ok := mock2.Get(testEngine, testBatch(i).Mutations[0].Key); !ok {
+			t.Fatalf("batch %d is not replayed", i)
+		}
+	}
+	if stats := writer.Stats(); stats.LastError == nil {
+		t.Fatalf("the broken stream should be reported")
+	}
+}
+
+func TestEngineWriter_AckWrites(t *testing.T) {
+	mock, addr := startMockImporter(t, "127.0.0.1:0")
+	defer mock.Stop()
+	writer, conn := newTestWriter(t, addr, func(opts *server.WriterOptions) {
+		opts.AckWrites = true
+		opts.AckInterval = time.Hour
+		opts.AckBytes = 1 << 20
+	})
+	defer conn.Close()
+	writer.Open()
+	defer writer.Close()
+
+	ctx := context.Background()
+	done := make(chan error, 1)
+	go func() {
+		done <- writer.WriteEngine(ctx, testBatch(0))
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("write should wait for acknowledgement, got %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if err := writer.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if keys, _, completed := engineStats(mock); keys != 1 || completed != 1 {
+		t.Fatalf("expect 1 key in 1 completed stream, got %d keys in %d streams", keys, completed)
+	}
+}
+
+func TestEngineWriter_Coalesce(t *testing.T) {
+	mock, addr := startMockImporter(t, "127.0.0.1:0")
+	defer mock.Stop()
+	writer, conn := newTestWriter(t, addr, func(opts *server.WriterOptions) {
+		opts.CoalesceBytes = 3 * testBatch(0).Size()
+		opts.CoalesceInterval = time.Hour
+	})
+	defer conn.Close()
+	writer.Open()
+
+	ctx := context.Background()
+	// 3 writes are sent in a batch when coalesce-bytes is reached
+	for i := 0; i < 4; i++ {
+		if err := writer.WriteEngine(ctx, testBatch(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitUntil(t, func() bool {
+		_, batches, _ := engineStats(mock)
+		return batches == 1
+	})
+	// a write of another commit ts isn't merged into pending writes
+	other := testBatch(4)
+	other.CommitTs = 2
+	if err := writer.WriteEngine(ctx, other); err != nil {
+		t.Fatal(err)
+	}
+	waitUntil(t, func() bool {
+		_, batches, _ := engineStats(mock)
+		return batches == 2
+	})
+	if keys, _, _ := engineStats(mock); keys != 4 {
+		t.Fatalf("expect 4 keys sent before flush, got %d", keys)
+	}
+	if err := writer.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// flush waits until the pending writes are sent, but not until importer receives them out of ack mode
+	waitUntil(t, func() bool {
+		keys, batches, _ := engineStats(mock)
+		return keys == 5 && batches == 3
+	})
+	writer.Close()
+	// a flush after close fails instead of waiting forever
+	if err := writer.Flush(ctx); err == nil {
+		t.Fatal("flush of a closed writer should fail")
+	}
+
+	// pending writes are sent after coalesce-interval without flush
+	writer, conn = newTestWriter(t, addr, func(opts *server.WriterOptions) {
+		opts.CoalesceBytes = 1 << 20
+		opts.CoalesceInterval = 50 * time.Millisecond
+	})
+	defer conn.Close()
+	writer.Open()
+	defer writer.Close()
+	for i := 5; i < 7; i++ {
+		if err := writer.WriteEngine(ctx, testBatch(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitUntil(t, func() bool {
+		keys, batches, _ := engineStats(mock)
+		return keys == 7 && batches == 4
+	})
+}
+
+func TestMultiStreamWriter(t *testing.T) {
+	mock, addr := startMockImporter(t, "127.0.0.1:0")
+	defer mock.Stop()
+	conns := make([]*grpc.ClientConn, 0, 2)
+	for i := 0; i < 2; i++ {
+		conn, err := grpc.Dial(addr, grpc.WithInsecure())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+
+	writer := server.NewMultiStreamWriter(conns, testEngine, server.WriterOptions{
+		RetryBufferBytes: 1 << 20,
+		RetryLimit:       3,
+		RetryBackoff:     50 * time.Millisecond,
+		RetryMaxBackoff:  200 * time.Millisecond,
+	})
+	writer.Open()
+
+	ctx := context.Background()
+	for i := 0; i < 4; i++ {
+		if err := writer.WriteEngine(ctx, testBatch(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if stats := writer.Stats(); stats.Streams != 2 {
+		t.Fatalf("expect 2 streams, got %d", stats.Streams)
+	}
+	writer.Close()
+
+	if keys, batches, completed := engineStats(mock); keys != 4 || batches != 4 || completed != 2 {
+		t.Fatalf("expect 4 batches in 2 streams, got %d keys, %d batches in %d streams", keys, batches, completed)
+	}
+}
+
+func TestWriteTunnel(t *testing.T) {
+	mock, addr := startMockImporter(t, "127.0.0.1:0")
+	defer mock.Stop()
+	writer, conn := newTestWriter(t, addr, nil)
+	defer conn.Close()
+	writer.Open()
+	tunnel := server.NewWriteTunnel(writer, 2)
+
+	ctx := context.Background()
+	futures := make([]*server.WriteFuture, 0, 8)
+	for i := 0; i < 8; i++ {
+		future, err := tunnel.Push(ctx, testBatch(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		futures = append(futures, future)
+	}
+	for i, future := range futures {
+		if err := future.Wait(ctx); err != nil {
+			t.Fatalf("batch %d: %v", i, err)
+		}
+	}
+	if err := tunnel.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+
+	if keys, batches, _ := engineStats(mock); keys != 8 || batches != 8 {
+		t.Fatalf("expect 8 batches, got %d keys in %d batches", keys, batches)
+	}
+
+	// a push is canceled when the tunnel is full
+	full := server.NewWriteTunnel(writer, 0)
+	cancelCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := full.Push(cancelCtx, testBatch(8)); err == nil {
+		t.Fatal("push into a full tunnel should be canceled")
+	}
+}
+
+func TestEngineWriter_Backpressure(t *testing.T) {
+	// nothing listens on the address, so the write stream is never connected
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+	writer, conn := newTestWriter(t, addr, func(opts *server.WriterOptions) {
+		opts.RetryLimit = 100
+		opts.RetryBackoff = time.Second
+		opts.RetryMaxBackoff = time.Second
+		opts.QueueBytes = testBatch(0).Size()
+		opts.EnqueueTimeout = 50 * time.Millisecond
+	})
+	defer conn.Close()
+	writer.Open()
+	tunnel := server.NewWriteTunnel(writer, 4)
+
+	ctx := context.Background()
+	if _, err = tunnel.Push(ctx, testBatch(0)); err != nil {
+		t.Fatal(err)
+	}
+	_, err = tunnel.Push(ctx, testBatch(1))
+	e, ok := err.(*server.BackpressureError)
+	if !ok {
+		t.Fatalf("expect backpressure error, got %v", err)
+	}
+	if !e.Unavailable || e.RetryAfter != time.Second {
+		t.Fatalf("expect importer unavailable, got %v", e)
+	}
+	if stats := writer.Stats(); stats.QueueBytes != testBatch(0).Size() {
+		t.Fatalf("expect 1 batch queued, got %d bytes", stats.QueueBytes)
+	}
+	writer.Close()
+}
+
+func TestEngineWriter_Spill(t *testing.T) {
+	mock, addr := startMockImporter(t, "127.0.0.1:0")
+	defer mock.Stop()
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// every batch is spilled, and segments are rotated every 2 batches
+	writer, conn := newTestWriter(t, addr, func(opts *server.WriterOptions) {
+		opts.QueueBytes = 1 << 20
+		opts.EnqueueTimeout = time.Second
+		opts.SpillDir = dir
+		opts.SpillThreshold = 0
+		opts.SpillSegmentBytes = 2 * testBatch(0).Size()
+	})
+	defer conn.Close()
+	writer.Open()
+
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		if err = writer.WriteEngine(ctx, testBatch(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = writer.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if keys, batches, _ := engineStats(mock); keys != 10 || batches != 10 {
+		t.Fatalf("expect 10 batches drained, got %d keys in %d batches", keys, batches)
+	}
+	if stats := writer.Stats(); stats.SpilledBatches != 0 {
+		t.Fatalf("expect spill files drained, got %d batches", stats.SpilledBatches)
+	}
+	writer.Close()
+
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("spill dir should be removed after close, got %d files", len(files))
+	}
+}
+
+func TestEngineWriter_DroppedStream(t *testing.T) {
+	mock, addr := startMockImporter(t, "127.0.0.1:0")
+	defer mock.Stop()
+	// the first stream is broken after a batch, the rest are replayed on a new one
+	mock.InjectFaults(mockimporter.Faults{DropStreams: 1, DropAfterBatches: 1})
+	writer, conn := newTestWriter(t, addr, func(opts *server.WriterOptions) {
+		opts.RetryLimit = 10
+	})
+	defer conn.Close()
+	writer.Open()
+
+	ctx := context.Background()
+	for i := 0; i < 4; i++ {
+		if err := writer.WriteEngine(ctx, testBatch(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writer.Close()
+
+	kvs := mock.KVs(testEngine)
+	if len(kvs) != 4 {
+		t.Fatalf("expect 4 keys after replay, got %d", len(kvs))
+	}
+	for i, kv := range kvs {
+		if !bytes.Equal(kv.Key, testBatch(i).Mutations[0].Key) {
+			t.Fatalf("expect key %d in order, got %s", i, kv.Key)
+		}
+	}
+	if n := len(mock.Mutations(testEngine)); n < 4 {
+		t.Fatalf("expect at least 4 mutations, got %d", n)
+	}
+}
+
+func TestEngineWriter_EngineNotFound(t *testing.T) {
+	mock, addr := startMockImporter(t, "127.0.0.1:0")
+	defer mock.Stop()
+	mock.InjectFaults(mockimporter.Faults{EngineNotFound: 1})
+	writer, conn := newTestWriter(t, addr, func(opts *server.WriterOptions) {
+		opts.AckWrites = true
+		opts.AckInterval = time.Hour
+		opts.AckBytes = 1 << 20
+	})
+	defer conn.Close()
+	writer.Open()
+	defer writer.Close()
+
+	ctx := context.Background()
+	future, err := server.NewWriteTunnel(writer, 1).Push(ctx, testBatch(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = writer.Flush(ctx); err == nil {
+		t.Fatal("flush should fail when importer answers EngineNotFound")
+	}
+	if err = future.Wait(ctx); err == nil {
+		t.Fatal("write should not be acknowledged when importer answers EngineNotFound")
+	}
+}
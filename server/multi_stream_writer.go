@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"github.com/pingcap/kvproto/pkg/import_kvpb"
+	"google.golang.org/grpc"
+	"sync"
+	"sync/atomic"
+)
+
+// ImportWriter writes batches of an engine to importer.
+type ImportWriter interface {
+	Open()
+	Close()
+	WriteEngine(ctx context.Context, mutation *import_kvpb.WriteBatch) error
+	Flush(ctx context.Context) error
+	AcksWrites() bool
+	Coalesces() bool
+	Stats() EngineWriterStats
+
+	// push queues mutation to be sent without waiting, future is resolved when importer replies.
+	push(ctx context.Context, mutation *import_kvpb.WriteBatch, future *WriteFuture) error
+}
+
+// MultiStreamWriter fans batches of an engine out over several write streams, each stream is
+// an EngineWriter on a different connection.
+//
+// Batches are sent round robin, batches of the same stream are applied in order, but batches of
+// different streams may be applied in any order. So a key written twice may end with either value,
+// unless Flush is called between the writes, which waits for all streams.
+type MultiStreamWriter struct {
+	writers []*EngineWriter
+	next    uint32
+}
+
+func NewMultiStreamWriter(conns []*grpc.ClientConn, engineId []byte, opts WriterOptions) *MultiStreamWriter {
+	writers := make([]*EngineWriter, 0, len(conns))
+	for _, conn := range conns {
+		writers = append(writers, NewEngineWriter(conn, engineId, opts))
+	}
+	return &MultiStreamWriter{writers: writers}
+}
+
+func (w *MultiStreamWriter) Open() {
+	for _, writer := range w.writers {
+		writer.Open()
+	}
+}
+
+func (w *MultiStreamWriter) Close() {
+	wg := &sync.WaitGroup{}
+	for _, writer := range w.writers {
+		wg.Add(1)
+		go func(writer *EngineWriter) {
+			defer wg.Done()
+			writer.Close()
+		}(writer)
+	}
+	wg.Wait()
+}
+
+func (w *MultiStreamWriter) WriteEngine(ctx context.Context, mutation *import_kvpb.WriteBatch) error {
+	future := newWriteFuture()
+	if err := w.push(ctx, mutation, future); err != nil {
+		return err
+	}
+	return future.Wait(ctx)
+}
+
+// Flush waits until mutations written before are sent by all streams.
+func (w *MultiStreamWriter) Flush(ctx context.Context) error {
+	errs := make([]error, len(w.writers))
+	wg := &sync.WaitGroup{}
+	for i, writer := range w.writers {
+		wg.Add(1)
+		go func(i int, writer *EngineWriter) {
+			defer wg.Done()
+			errs[i] = writer.Flush(ctx)
+		}(i, writer)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *MultiStreamWriter) AcksWrites() bool {
+	return w.writers[0].AcksWrites()
+}
+
+func (w *MultiStreamWriter) Coalesces() bool {
+	return w.writers[0].Coalesces()
+}
+
+// Stats sums up queue depth of streams, and reports the latest error of them.
+func (w *MultiStreamWriter) Stats() EngineWriterStats {
+	stats := EngineWriterStats{Streams: len(w.writers)}
+	for _, writer := range w.writers {
+		s := writer.Stats()
+		stats.QueueDepth += s.QueueDepth
+		stats.QueueBytes += s.QueueBytes
+		stats.SpilledBatches += s.SpilledBatches
+		stats.SpilledBytes += s.SpilledBytes
+		if s.LastError != nil && (stats.LastError == nil || s.LastError.Time.After(stats.LastError.Time)) {
+			stats.LastError = s.LastError
+		}
+	}
+	return stats
+}
+
+func (w *MultiStreamWriter) push(ctx context.Context, mutation *import_kvpb.WriteBatch, future *WriteFuture) error {
+	i := atomic.AddUint32(&w.next, 1) % uint32(len(w.writers))
+	return w.writers[i].push(ctx, mutation, future)
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"github.com/lerencao/tidb-light/config"
+	"github.com/pingcap/pd/pd-client"
+	"github.com/pingcap/tidb/store/tikv/oracle"
+	"github.com/pingcap/tidb/store/tikv/oracle/oracles"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"strings"
+	"time"
+)
+
+// pdOracleUpdateInterval is the interval the pd oracle refreshes its last ts.
+const pdOracleUpdateInterval = 2 * time.Second
+
+// PdClientCreator creates a pd client connected to pdAddrs.
+type PdClientCreator func(pdAddrs []string) (pd.Client, error)
+
+// NewPdClient creates a pd client without tls.
+func NewPdClient(pdAddrs []string) (pd.Client, error) {
+	return pd.NewClient(pdAddrs, pd.SecurityOption{})
+}
+
+// NewOracle creates the timestamp oracle used to get commit ts of write batches.
+// With cfg.Oracle == auto, pd tso is used when pd-addr is set, and local oracle is the fallback.
+func NewOracle(cfg *config.Config, newPdClient PdClientCreator) (oracle.Oracle, error) {
+	switch cfg.Oracle {
+	case config.OracleLocal:
+		return oracles.NewLocalOracle(), nil
+	case config.OraclePd:
+		return newPdOracle(cfg.PdAddr, newPdClient)
+	case config.OracleAuto, "":
+		if cfg.PdAddr == "" {
+			logrus.Warnf("pd-addr is not set, use local oracle, commit ts may be skewed from pd")
+			return oracles.NewLocalOracle(), nil
+		}
+		o, err := newPdOracle(cfg.PdAddr, newPdClient)
+		if err != nil {
+			logrus.Warnf("fail to create pd oracle, fallback to local oracle, error: %v", err)
+			return oracles.NewLocalOracle(), nil
+		}
+		return o, nil
+	default:
+		return nil, errors.Errorf("unknown oracle %s", cfg.Oracle)
+	}
+}
+
+func newPdOracle(pdAddr string, newPdClient PdClientCreator) (oracle.Oracle, error) {
+	pdClient, err := newPdClient(strings.Split(pdAddr, ","))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	o, err := oracles.NewPdOracle(pdClient, pdOracleUpdateInterval)
+	if err != nil {
+		pdClient.Close()
+		return nil, errors.WithStack(err)
+	}
+	return &pdTsOracle{Oracle: o, pdClient: pdClient}, nil
+}
+
+// pdTsOracle owns the pd client, and closes it together with the oracle.
+type pdTsOracle struct {
+	oracle.Oracle
+	pdClient pd.Client
+}
+
+func (o *pdTsOracle) Close() {
+	o.Oracle.Close()
+	o.pdClient.Close()
+}
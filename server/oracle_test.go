@@ -0,0 +1,72 @@
+package server_test
+
+import (
+	"context"
+	"github.com/lerencao/tidb-light/config"
+	"github.com/lerencao/tidb-light/server"
+	"github.com/pingcap/pd/pd-client"
+	"github.com/pingcap/tidb/store/mockstore/mocktikv"
+	"github.com/pingcap/tidb/store/tikv/oracle"
+	"github.com/pkg/errors"
+	"testing"
+	"time"
+)
+
+func mockPdClientCreator(_ []string) (pd.Client, error) {
+	cluster := mocktikv.NewCluster()
+	mocktikv.BootstrapWithSingleStore(cluster)
+	return mocktikv.NewPDClient(cluster), nil
+}
+
+func failPdClientCreator(_ []string) (pd.Client, error) {
+	return nil, errors.New("pd is unreachable")
+}
+
+func TestNewOracle_Pd(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.PdAddr = "127.0.0.1:2379"
+	cfg.Oracle = config.OraclePd
+	o, err := server.NewOracle(cfg, mockPdClientCreator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+
+	var last uint64
+	for i := 0; i < 10; i++ {
+		ts, err := o.GetTimestamp(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ts <= last {
+			t.Fatalf("ts should be increasing, last: %d, current: %d", last, ts)
+		}
+		last = ts
+	}
+
+	physical := oracle.ExtractPhysical(last)
+	now := oracle.GetPhysical(time.Now())
+	if physical > now+1000 || physical < now-1000 {
+		t.Fatalf("physical time of ts %d is too far from now %d", physical, now)
+	}
+}
+
+func TestNewOracle_Fallback(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.PdAddr = "127.0.0.1:2379"
+
+	cfg.Oracle = config.OraclePd
+	if _, err := server.NewOracle(cfg, failPdClientCreator); err == nil {
+		t.Fatalf("pd oracle should fail when pd is unreachable")
+	}
+
+	cfg.Oracle = config.OracleAuto
+	o, err := server.NewOracle(cfg, failPdClientCreator)
+	if err != nil {
+		t.Fatalf("auto oracle should fallback to local oracle, error: %v", err)
+	}
+	defer o.Close()
+	if _, err := o.GetTimestamp(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -20,6 +20,8 @@ func CreateRouter(prefix string, s *Server) *mux.Router {
 		r:   render,
 		svr: s,
 	}
+	engineRouter.Methods(http.MethodGet).Path("").HandlerFunc(engineHandler.List)
+	engineRouter.Methods(http.MethodGet).Path("/{engineid}").HandlerFunc(engineHandler.Get)
 	engineRouter.Path("/{engineid}/open").Methods("POST").HandlerFunc(engineHandler.Open)
 	engineRouter.Path("/{engineid}/close").Methods("POST").HandlerFunc(engineHandler.Close)
 	engineRouter.Path("/{engineid}/cleanup").Methods("POST").HandlerFunc(engineHandler.Cleanup)
@@ -29,9 +31,15 @@ func CreateRouter(prefix string, s *Server) *mux.Router {
 		r:   render,
 		svr: s,
 	}
+	sessionRouter.Methods(http.MethodGet).Path("").HandlerFunc(sessionHandler.List)
+	sessionRouter.Methods(http.MethodGet).Path("/reaped").HandlerFunc(sessionHandler.Reaped)
 	sessionRouter.Methods(http.MethodPost).Path("/{sessionid}/open").HandlerFunc(sessionHandler.Open)
 	sessionRouter.Methods(http.MethodGet).Path("/{sessionid}").HandlerFunc(sessionHandler.Get)
 	sessionRouter.Methods(http.MethodPost).Path("/{sessionid}/write").HandlerFunc(sessionHandler.Write)
+	sessionRouter.Methods(http.MethodPost).Path("/{sessionid}/write/csv").HandlerFunc(sessionHandler.WriteCSV)
+	sessionRouter.Methods(http.MethodPost).Path("/{sessionid}/flush").HandlerFunc(sessionHandler.Flush)
+	sessionRouter.Methods(http.MethodPost).Path("/{sessionid}/heartbeat").HandlerFunc(sessionHandler.Heartbeat)
+	sessionRouter.Methods(http.MethodPost).Path("/{sessionid}/rebase").HandlerFunc(sessionHandler.Rebase)
 	sessionRouter.Methods(http.MethodPost).Path("/{sessionid}/close").HandlerFunc(sessionHandler.Close)
 
 	importRouter := r.PathPrefix("/import").Subrouter()
@@ -40,9 +48,20 @@ func CreateRouter(prefix string, s *Server) *mux.Router {
 		svr: s,
 	}
 	importRouter.Methods(http.MethodPost).Path("/switch_mode").HandlerFunc(importHandler.SwitchMode)
+	importRouter.Methods(http.MethodGet).Path("/modes").HandlerFunc(importHandler.Modes)
 	importRouter.Methods(http.MethodPost).Path("/compact_table").HandlerFunc(importHandler.CompactTable)
 	importRouter.Methods(http.MethodPost).Path("/engines/{engineid}").HandlerFunc(importHandler.ImportEngine)
 
+	jobRouter := r.PathPrefix("/jobs").Subrouter()
+	jobHandler := &JobHandler{
+		r:   render,
+		svr: s,
+	}
+	jobRouter.Methods(http.MethodPost).Path("").HandlerFunc(jobHandler.Submit)
+	jobRouter.Methods(http.MethodGet).Path("").HandlerFunc(jobHandler.List)
+	jobRouter.Methods(http.MethodGet).Path("/{jobid}").HandlerFunc(jobHandler.Get)
+	jobRouter.Methods(http.MethodPost).Path("/{jobid}/cancel").HandlerFunc(jobHandler.Cancel)
+
 	return router
 }
 
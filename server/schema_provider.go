@@ -0,0 +1,328 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/BurntSushi/toml"
+	"github.com/lerencao/tidb-light/config"
+	"github.com/pingcap/tidb/ast"
+	"github.com/pingcap/tidb/model"
+	"github.com/pingcap/tidb/mysql"
+	"github.com/pingcap/tidb/parser"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// SchemaProvider provides schemas of tables to encode.
+type SchemaProvider interface {
+	// DatabaseId returns the id of schema in tidb.
+	DatabaseId(schema string) (int64, error)
+	// TableId returns the id of table in tidb.
+	TableId(schema, table string) (int64, error)
+	// TableInfo returns the table info with columns and indexes, ids of table and indexes are the ones in tidb.
+	TableInfo(schema, table string) (*model.TableInfo, error)
+	// TableDDL returns the create table statement, which is executed by encoders.
+	TableDDL(schema, table string) (string, error)
+}
+
+// NewSchemaProvider creates schema provider by config, schemas are read from the catalog file
+// if it's set, or else from tidb.
+func NewSchemaProvider(cfg *config.Config, db *sql.DB) (SchemaProvider, error) {
+	if cfg.SchemaCatalog != "" {
+		return LoadCatalogSchemaProvider(cfg.SchemaCatalog)
+	}
+	return NewTiDBSchemaProvider(cfg.TiDBHttpAddr, db), nil
+}
+
+// TiDBSchemaProvider gets table infos from the http endpoint of tidb, and ddls by `show create table`.
+type TiDBSchemaProvider struct {
+	httpAddr string
+	db       *sql.DB
+}
+
+func NewTiDBSchemaProvider(httpAddr string, db *sql.DB) *TiDBSchemaProvider {
+	return &TiDBSchemaProvider{httpAddr: httpAddr, db: db}
+}
+
+func (p *TiDBSchemaProvider) DatabaseId(schema string) (int64, error) {
+	return DatabaseId(p.httpAddr, schema)
+}
+
+func (p *TiDBSchemaProvider) TableId(schema, table string) (int64, error) {
+	return TableId(p.httpAddr, schema, table)
+}
+
+func (p *TiDBSchemaProvider) TableInfo(schema, table string) (*model.TableInfo, error) {
+	return TableInfo(p.httpAddr, schema, table)
+}
+
+func (p *TiDBSchemaProvider) TableDDL(schema, table string) (string, error) {
+	return TableDDL(p.db, schema, table)
+}
+
+// CatalogTable is a table in schema catalog.
+type CatalogTable struct {
+	Schema string `toml:"schema" json:"schema"`
+	Table  string `toml:"table" json:"table"`
+	// DbId is the id of schema, it's only needed to rebase auto id of tidb, which is skipped if it's 0.
+	DbId int64  `toml:"db-id" json:"db_id"`
+	Id   int64  `toml:"id" json:"id"`
+	DDL  string `toml:"ddl" json:"ddl"`
+	// Indexes maps index names to ids in tidb. If it's empty, indexes have ids 1, 2, ... in order
+	// of the ddl, which are the ids of a newly created table.
+	Indexes map[string]int64 `toml:"indexes" json:"indexes"`
+}
+
+// SchemaCatalog is the content of a catalog file.
+type SchemaCatalog struct {
+	Tables []*CatalogTable `toml:"tables" json:"tables"`
+}
+
+type catalogEntry struct {
+	table     *CatalogTable
+	tableInfo *model.TableInfo
+}
+
+// CatalogSchemaProvider provides schemas from a local catalog file, so tables can be encoded without tidb.
+// Table infos are built from the ddls in catalog.
+type CatalogSchemaProvider struct {
+	path   string
+	dbs    map[string]int64
+	tables map[string]*catalogEntry
+}
+
+// LoadCatalogSchemaProvider loads the catalog file of path, which is toml if it has the `.toml` extension,
+// or else json.
+func LoadCatalogSchemaProvider(path string) (*CatalogSchemaProvider, error) {
+	catalog := &SchemaCatalog{}
+	if strings.ToLower(filepath.Ext(path)) == ".toml" {
+		if _, err := toml.DecodeFile(path, catalog); err != nil {
+			return nil, errors.Wrapf(err, "invalid schema catalog %s", path)
+		}
+	} else {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if err = json.Unmarshal(data, catalog); err != nil {
+			return nil, errors.Wrapf(err, "invalid schema catalog %s", path)
+		}
+	}
+	return NewCatalogSchemaProvider(path, catalog)
+}
+
+// NewCatalogSchemaProvider checks tables of catalog and builds their table infos, path is only used in errors.
+func NewCatalogSchemaProvider(path string, catalog *SchemaCatalog) (*CatalogSchemaProvider, error) {
+	p := &CatalogSchemaProvider{
+		path:   path,
+		dbs:    make(map[string]int64),
+		tables: make(map[string]*catalogEntry, len(catalog.Tables)),
+	}
+	for _, table := range catalog.Tables {
+		if table.Schema == "" || table.Table == "" {
+			return nil, errors.Errorf("schema and table should not be empty in schema catalog %s", path)
+		}
+		key := catalogKey(table.Schema, table.Table)
+		if _, ok := p.tables[key]; ok {
+			return nil, errors.Errorf("table %s.%s is duplicated in schema catalog %s", table.Schema, table.Table, path)
+		}
+		if table.Id <= 0 {
+			return nil, errors.Errorf("id of table %s.%s should be positive", table.Schema, table.Table)
+		}
+		tableInfo, err := buildTableInfo(table.DDL, table.Id, lowerKeys(table.Indexes))
+		if err != nil {
+			return nil, errors.Wrapf(err, "table %s.%s", table.Schema, table.Table)
+		}
+		p.tables[key] = &catalogEntry{table: table, tableInfo: tableInfo}
+
+		schema := strings.ToLower(table.Schema)
+		if dbid, ok := p.dbs[schema]; ok && dbid != table.DbId {
+			return nil, errors.Errorf("schema %s has different ids %d and %d in schema catalog %s", table.Schema, dbid, table.DbId, path)
+		}
+		p.dbs[schema] = table.DbId
+	}
+	return p, nil
+}
+
+func catalogKey(schema, table string) string {
+	return strings.ToLower(schema) + "." + strings.ToLower(table)
+}
+
+func lowerKeys(m map[string]int64) map[string]int64 {
+	lowered := make(map[string]int64, len(m))
+	for k, v := range m {
+		lowered[strings.ToLower(k)] = v
+	}
+	return lowered
+}
+
+func (p *CatalogSchemaProvider) entry(schema, table string) (*catalogEntry, error) {
+	entry, ok := p.tables[catalogKey(schema, table)]
+	if !ok {
+		return nil, errors.Errorf("table %s.%s not exists in schema catalog %s", schema, table, p.path)
+	}
+	return entry, nil
+}
+
+func (p *CatalogSchemaProvider) DatabaseId(schema string) (int64, error) {
+	dbid, ok := p.dbs[strings.ToLower(schema)]
+	if !ok {
+		return 0, errors.Errorf("schema %s not exists in schema catalog %s", schema, p.path)
+	}
+	return dbid, nil
+}
+
+func (p *CatalogSchemaProvider) TableId(schema, table string) (int64, error) {
+	entry, err := p.entry(schema, table)
+	if err != nil {
+		return 0, err
+	}
+	return entry.table.Id, nil
+}
+
+func (p *CatalogSchemaProvider) TableInfo(schema, table string) (*model.TableInfo, error) {
+	entry, err := p.entry(schema, table)
+	if err != nil {
+		return nil, err
+	}
+	return entry.tableInfo, nil
+}
+
+func (p *CatalogSchemaProvider) TableDDL(schema, table string) (string, error) {
+	entry, err := p.entry(schema, table)
+	if err != nil {
+		return "", err
+	}
+	return entry.table.DDL, nil
+}
+
+// buildTableInfo builds the table info of a create table statement, it has public columns and indexes
+// in the same order as tidb creates them, which is what encoders do with the ddl.
+// Index ids are taken from ids by lower case name, or 1, 2, ... in order if ids is empty.
+func buildTableInfo(ddl string, id int64, ids map[string]int64) (*model.TableInfo, error) {
+	stmt, err := parser.New().ParseOneStmt(ddl, "", "")
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid ddl")
+	}
+	create, ok := stmt.(*ast.CreateTableStmt)
+	if !ok {
+		return nil, errors.Errorf("ddl should be a create table statement")
+	}
+
+	tableInfo := &model.TableInfo{
+		ID:    id,
+		Name:  create.Table.Name,
+		State: model.StatePublic,
+	}
+	columns := make(map[string]*model.ColumnInfo, len(create.Cols))
+	// constraints of columns follow the ones of table, like tidb does
+	constraints := append([]*ast.Constraint(nil), create.Constraints...)
+	for i, colDef := range create.Cols {
+		col := &model.ColumnInfo{
+			ID:        int64(i + 1),
+			Name:      colDef.Name.Name,
+			Offset:    i,
+			FieldType: *colDef.Tp,
+			State:     model.StatePublic,
+		}
+		tableInfo.Columns = append(tableInfo.Columns, col)
+		columns[col.Name.L] = col
+
+		for _, opt := range colDef.Options {
+			keys := []*ast.IndexColName{{Column: colDef.Name}}
+			switch opt.Tp {
+			case ast.ColumnOptionNotNull:
+				col.Flag |= mysql.NotNullFlag
+			case ast.ColumnOptionAutoIncrement:
+				col.Flag |= mysql.AutoIncrementFlag
+			case ast.ColumnOptionPrimaryKey:
+				col.Flag |= mysql.NotNullFlag
+				constraints = append(constraints, &ast.Constraint{Tp: ast.ConstraintPrimaryKey, Keys: keys})
+			case ast.ColumnOptionUniqKey:
+				constraints = append(constraints, &ast.Constraint{Tp: ast.ConstraintUniqKey, Keys: keys})
+			}
+		}
+	}
+
+	for _, constraint := range constraints {
+		var primary, unique bool
+		switch constraint.Tp {
+		case ast.ConstraintPrimaryKey:
+			primary, unique = true, true
+		case ast.ConstraintUniq, ast.ConstraintUniqKey, ast.ConstraintUniqIndex:
+			unique = true
+		case ast.ConstraintKey, ast.ConstraintIndex:
+		default:
+			// foreign keys and fulltext indexes are not created
+			continue
+		}
+
+		indexColumns := make([]*model.IndexColumn, 0, len(constraint.Keys))
+		for _, key := range constraint.Keys {
+			col, ok := columns[key.Column.Name.L]
+			if !ok {
+				return nil, errors.Errorf("index column %s not exists", key.Column.Name.O)
+			}
+			if primary {
+				col.Flag |= mysql.NotNullFlag
+			}
+			indexColumns = append(indexColumns, &model.IndexColumn{Name: col.Name, Offset: col.Offset, Length: key.Length})
+		}
+		if primary && len(indexColumns) == 1 && isIntegerType(columns[indexColumns[0].Name.L].Tp) {
+			// the integer primary key is the row handle, there's no index of it
+			tableInfo.PKIsHandle = true
+			columns[indexColumns[0].Name.L].Flag |= mysql.PriKeyFlag
+			continue
+		}
+
+		name := model.NewCIStr(constraint.Name)
+		if primary {
+			name = model.NewCIStr("PRIMARY")
+		} else if constraint.Name == "" {
+			name = anonymousIndexName(tableInfo, indexColumns[0].Name)
+		}
+		indexId := int64(len(tableInfo.Indices) + 1)
+		if len(ids) > 0 {
+			if indexId, ok = ids[name.L]; !ok {
+				return nil, errors.Errorf("id of index %s is missing", name.O)
+			}
+		}
+		tableInfo.Indices = append(tableInfo.Indices, &model.IndexInfo{
+			ID:      indexId,
+			Name:    name,
+			Table:   tableInfo.Name,
+			Columns: indexColumns,
+			Unique:  unique,
+			Primary: primary,
+			State:   model.StatePublic,
+		})
+	}
+	return tableInfo, nil
+}
+
+// anonymousIndexName names an index without name by its first column, suffixed with _2, _3, ... if it's taken.
+func anonymousIndexName(tableInfo *model.TableInfo, colName model.CIStr) model.CIStr {
+	taken := func(name model.CIStr) bool {
+		for _, indexInfo := range tableInfo.Indices {
+			if indexInfo.Name.L == name.L {
+				return true
+			}
+		}
+		return false
+	}
+	name := colName
+	for i := 2; taken(name); i++ {
+		name = model.NewCIStr(fmt.Sprintf("%s_%d", colName.O, i))
+	}
+	return name
+}
+
+func isIntegerType(tp byte) bool {
+	switch tp {
+	case mysql.TypeTiny, mysql.TypeShort, mysql.TypeInt24, mysql.TypeLong, mysql.TypeLonglong:
+		return true
+	}
+	return false
+}
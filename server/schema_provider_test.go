@@ -0,0 +1,132 @@
+package server_test
+
+import (
+	"github.com/lerencao/tidb-light/server"
+	"github.com/pingcap/tidb/model"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const catalogDDL = "CREATE TABLE `t` (" +
+	"`id` bigint(20) NOT NULL, " +
+	"`name` varchar(64) NOT NULL UNIQUE, " +
+	"`age` int(11) DEFAULT NULL, " +
+	"`city` varchar(64) DEFAULT NULL, " +
+	"PRIMARY KEY (`id`), " +
+	"KEY `idx_age` (`age`), " +
+	"KEY (`city`), " +
+	"KEY (`city`, `age`))"
+
+func writeCatalog(t *testing.T, name, content string) string {
+	dir, err := ioutil.TempDir("", "catalog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err = ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// indexIds returns ids of indexes by lower case index name.
+func indexIds(tableInfo *model.TableInfo) map[string]int64 {
+	ids := make(map[string]int64, len(tableInfo.Indices))
+	for _, indexInfo := range tableInfo.Indices {
+		ids[indexInfo.Name.L] = indexInfo.ID
+	}
+	return ids
+}
+
+func TestCatalogSchemaProvider_Toml(t *testing.T) {
+	path := writeCatalog(t, "catalog.toml", `
+[[tables]]
+schema = "test"
+table = "t"
+db-id = 40
+id = 45
+ddl = """`+catalogDDL+`"""
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	provider, err := server.LoadCatalogSchemaProvider(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dbid, err := provider.DatabaseId("TEST"); err != nil || dbid != 40 {
+		t.Fatalf("expect db id 40, got %d, %v", dbid, err)
+	}
+	if tableId, err := provider.TableId("test", "T"); err != nil || tableId != 45 {
+		t.Fatalf("expect table id 45, got %d, %v", tableId, err)
+	}
+	if ddl, err := provider.TableDDL("test", "t"); err != nil || ddl != catalogDDL {
+		t.Fatalf("expect ddl of catalog, got %s, %v", ddl, err)
+	}
+
+	tableInfo, err := provider.TableInfo("test", "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tableInfo.PKIsHandle {
+		t.Fatal("integer primary key should be the handle")
+	}
+	if len(tableInfo.Columns) != 4 || tableInfo.Columns[3].Name.O != "city" {
+		t.Fatalf("unexpected columns %v", tableInfo.Columns)
+	}
+
+	// table constraints are created before column ones, anonymous indexes are named by the first column
+	ids := indexIds(tableInfo)
+	expected := map[string]int64{"idx_age": 1, "city": 2, "city_2": 3, "name": 4}
+	if len(ids) != len(expected) {
+		t.Fatalf("expect indexes %v, got %v", expected, ids)
+	}
+	for name, id := range expected {
+		if ids[name] != id {
+			t.Fatalf("expect indexes %v, got %v", expected, ids)
+		}
+	}
+
+	if _, err = provider.TableInfo("test", "no_exists_table"); err == nil {
+		t.Fatal("no_exists_table should return err")
+	}
+}
+
+func TestCatalogSchemaProvider_Json(t *testing.T) {
+	path := writeCatalog(t, "catalog.json", `{"tables": [{
+		"schema": "test",
+		"table": "t",
+		"id": 45,
+		"ddl": "CREATE TABLE t (id varchar(32), age int, PRIMARY KEY (id), KEY idx_age (age))",
+		"indexes": {"PRIMARY": 3, "IDX_AGE": 5}
+	}]}`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	provider, err := server.LoadCatalogSchemaProvider(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tableInfo, err := provider.TableInfo("test", "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tableInfo.PKIsHandle || len(tableInfo.Indices) != 2 {
+		t.Fatalf("non integer primary key should be an index, got %d indexes", len(tableInfo.Indices))
+	}
+	if ids := indexIds(tableInfo); ids["primary"] != 3 || ids["idx_age"] != 5 {
+		t.Fatalf("index ids should be taken from catalog, got %v", ids)
+	}
+
+	// ids of all indexes should be given if any is
+	_, err = server.NewCatalogSchemaProvider("", &server.SchemaCatalog{Tables: []*server.CatalogTable{{
+		Schema:  "test",
+		Table:   "t",
+		Id:      45,
+		DDL:     "CREATE TABLE t (id int, age int, KEY idx_age (age), KEY idx_id (id))",
+		Indexes: map[string]int64{"idx_age": 1},
+	}}})
+	if err == nil {
+		t.Fatal("missing index id should return err")
+	}
+}
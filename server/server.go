@@ -1,16 +1,26 @@
 package server
 
 import (
+	"context"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/lerencao/tidb-light/config"
 	"github.com/lerencao/tidb-light/utils"
+	"github.com/pingcap/kvproto/pkg/import_sstpb"
+	"github.com/pingcap/tidb/kv"
 	"github.com/pingcap/tidb/store/tikv/oracle"
-	"github.com/pingcap/tidb/store/tikv/oracle/oracles"
+	"github.com/pingcap/tidb/tablecodec"
+	"github.com/pkg/errors"
+	"github.com/satori/go.uuid"
+	"github.com/sirupsen/logrus"
+	"path/filepath"
 )
 
+var errNoImporter = errors.New("importer is not set, importer-addr should be set")
+
 type KvImporter interface {
 	GetImportClient() (*KvImportClient, error)
-	GetImportWriter(engineid []byte) (*EngineWriter, error)
+	GetImportWriter(engineid []byte, streams int) (ImportWriter, error)
+	GetFileSink(engineid []byte, name string) (ImportWriter, error)
 }
 
 type Server struct {
@@ -18,8 +28,13 @@ type Server struct {
 
 	rpcClient *utils.RpcClient
 
+	engines        *EngineRegistry
 	sessionManager *SessionManager
+	jobManager     *JobManager
+	modes          *ModeManager
 	oracle         oracle.Oracle
+	// store is used to update tidb meta, it's nil when pd-addr is not set.
+	store kv.Storage
 }
 
 func NewServer(cfg *config.Config) *Server {
@@ -30,26 +45,155 @@ func NewServer(cfg *config.Config) *Server {
 	// 	return nil, errors.WithStack(err)
 	// }
 
+	engines := NewEngineRegistry()
 	server := &Server{
 		cfg:            cfg,
 		rpcClient:      rpcClient,
-		sessionManager: NewSessionManager(cfg),
-		oracle:         oracles.NewLocalOracle(),
+		engines:        engines,
+		sessionManager: NewSessionManager(cfg, engines),
 	}
+	server.jobManager = NewJobManager(server)
+	server.modes = NewModeManager(server.SwitchMode, cfg.ImportModeInterval.Duration, cfg.ImportModeState)
 
 	return server
 }
 
 func (s *Server) Start() error {
-	return s.sessionManager.Start(s)
+	o, err := NewOracle(s.cfg, NewPdClient)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	s.oracle = o
+
+	if s.cfg.PdAddr != "" {
+		store, err := OpenStore(s.cfg.PdAddr)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		s.store = store
+	} else {
+		logrus.Warnf("pd-addr is not set, auto id of tidb will not be rebased")
+	}
+	if err = s.modes.Start(); err != nil {
+		return err
+	}
+	if s.cfg.SpillDir != "" {
+		// spill queues are not reopened, writers of restored sessions spill to new ones
+		if err = cleanSpillDir(s.cfg.SpillDir); err != nil {
+			return err
+		}
+	}
+	return s.sessionManager.Start(s, s.store)
 }
 
 func (s *Server) Close() error {
+	s.jobManager.Close()
+	s.modes.Close()
 	s.sessionManager.Close()
+	if s.oracle != nil {
+		s.oracle.Close()
+	}
+	if s.store != nil {
+		if err := s.store.Close(); err != nil {
+			logrus.Errorf("fail to close store, error: %v", err)
+		}
+	}
 	return s.rpcClient.Close()
 }
 
+// SubmitJob starts a job to import a mydumper/dumpling directory.
+func (s *Server) SubmitJob(param *JobParam) (*Job, error) {
+	return s.jobManager.Submit(param)
+}
+
+// OpenEngine opens engine on importer, and registers it in engine registry.
+func (s *Server) OpenEngine(ctx context.Context, engineId uuid.UUID) error {
+	return s.engineOp(ctx, engineId, engineOpOpen, func(client *KvImportClient) error {
+		return client.OpenEngine(ctx, engineId.Bytes())
+	})
+}
+
+// CloseEngine closes engine on importer, it's rejected if any session is writing to the engine.
+func (s *Server) CloseEngine(ctx context.Context, engineId uuid.UUID) error {
+	return s.engineOp(ctx, engineId, engineOpClose, func(client *KvImportClient) error {
+		return client.CloseEngine(ctx, engineId.Bytes())
+	})
+}
+
+// ImportEngine imports a closed engine into the tikv cluster of pdAddr, which is kept in import mode during the import.
+func (s *Server) ImportEngine(ctx context.Context, engineId uuid.UUID, pdAddr string) error {
+	return s.engineOp(ctx, engineId, engineOpImport, func(client *KvImportClient) error {
+		if pdAddr != "" {
+			if err := s.modes.Acquire(ctx, pdAddr); err != nil {
+				return err
+			}
+			defer s.modes.Release(pdAddr)
+		}
+		return client.ImportEngine(ctx, engineId.Bytes(), pdAddr)
+	})
+}
+
+// CleanupEngine removes data of engine on importer.
+func (s *Server) CleanupEngine(ctx context.Context, engineId uuid.UUID) error {
+	return s.engineOp(ctx, engineId, engineOpCleanup, func(client *KvImportClient) error {
+		return client.CleanupEngine(ctx, engineId.Bytes())
+	})
+}
+
+func (s *Server) engineOp(ctx context.Context, engineId uuid.UUID, op engineOp, f func(client *KvImportClient) error) error {
+	if err := s.engines.begin(engineId, op); err != nil {
+		return err
+	}
+	client, err := s.GetImportClient()
+	if err == nil {
+		err = f(client)
+	}
+	s.engines.finish(engineId, op, err)
+	return err
+}
+
+// SwitchMode switches the tikv cluster of pdAddr to mode, without holding it in ModeManager.
+// It's the switcher of ModeManager, others should switch mode by ModeManager.
+func (s *Server) SwitchMode(ctx context.Context, pdAddr string, mode import_sstpb.SwitchMode) error {
+	client, err := s.GetImportClient()
+	if err != nil {
+		return err
+	}
+	return client.SwitchMode(ctx, pdAddr, mode)
+}
+
+// CompactTable compacts data of table in the tikv cluster of pdAddr.
+func (s *Server) CompactTable(ctx context.Context, pdAddr string, tableId int64) error {
+	client, err := s.GetImportClient()
+	if err != nil {
+		return err
+	}
+	tablePrefix := tablecodec.EncodeTablePrefix(tableId)
+	tablePrefixNext := tablePrefix.PrefixNext()
+	req := &import_sstpb.CompactRequest{
+		OutputLevel: -1,
+		Range: &import_sstpb.Range{
+			Start: tablePrefix,
+			End:   tablePrefixNext,
+		},
+	}
+	return client.CompactCluster(ctx, pdAddr, req)
+}
+
+// Modes returns the import mode manager.
+func (s *Server) Modes() *ModeManager {
+	return s.modes
+}
+
+// Engines returns the engine registry.
+func (s *Server) Engines() *EngineRegistry {
+	return s.engines
+}
+
 func (s *Server) GetImportClient() (*KvImportClient, error) {
+	if s.cfg.ImporterAddr == "" {
+		return nil, errNoImporter
+	}
 	conn, err := s.rpcClient.GetConn(s.cfg.ImporterAddr)
 	if err != nil {
 		return nil, err
@@ -57,11 +201,75 @@ func (s *Server) GetImportClient() (*KvImportClient, error) {
 	return NewKvImportClient(conn), nil
 }
 
-func (s *Server) GetImportWriter(engineId []byte) (*EngineWriter, error) {
-	conn, err := s.rpcClient.GetConn(s.cfg.ImporterAddr)
+// GetImportWriter creates a writer of engine, which sends batches over streams write streams.
+func (s *Server) GetImportWriter(engineId []byte, streams int) (ImportWriter, error) {
+	return s.newImportWriter(engineId, streams, s.writerOptions())
+}
+
+// writerOptions returns the configured options of import writers.
+func (s *Server) writerOptions() WriterOptions {
+	return WriterOptions{
+		CoalesceBytes:    s.cfg.CoalesceBytes,
+		CoalesceInterval: s.cfg.CoalesceInterval.Duration,
+		AckWrites:        s.cfg.AckWrites,
+		AckInterval:      s.cfg.AckInterval.Duration,
+		AckBytes:         s.cfg.AckBytes,
+		RetryBufferBytes: s.cfg.RetryBufferBytes,
+		RetryLimit:       s.cfg.RetryLimit,
+		RetryBackoff:     s.cfg.RetryBackoff.Duration,
+		RetryMaxBackoff:  s.cfg.RetryMaxBackoff.Duration,
+		QueueBytes:       s.cfg.QueueBytes,
+		EnqueueTimeout:   s.cfg.EnqueueTimeout.Duration,
+
+		SpillDir:          s.cfg.SpillDir,
+		SpillThreshold:    s.cfg.SpillBytes,
+		SpillSegmentBytes: s.cfg.SpillSegmentBytes,
+	}
+}
+
+func (s *Server) newImportWriter(engineId []byte, streams int, opts WriterOptions) (ImportWriter, error) {
+	if s.cfg.ImporterAddr == "" {
+		return nil, errNoImporter
+	}
+	if streams <= 1 {
+		conn, err := s.rpcClient.GetConn(s.cfg.ImporterAddr)
+		if err != nil {
+			return nil, err
+		}
+		return NewEngineWriter(conn, engineId, opts), nil
+	}
+
+	conns, err := s.rpcClient.GetConns(s.cfg.ImporterAddr, streams)
 	if err != nil {
 		return nil, err
 	}
+	return NewMultiStreamWriter(conns, engineId, opts), nil
+}
+
+// GetFileSink creates a file sink of engine, which writes files of name to the sink dir of engine.
+func (s *Server) GetFileSink(engineId []byte, name string) (ImportWriter, error) {
+	dir := filepath.Join(s.cfg.SinkDir, uuid.FromBytesOrNil(engineId).String())
+	return NewFileSink(dir, name, s.cfg.SinkFormat, s.cfg.SinkFileBytes)
+}
 
-	return NewEngineWriter(conn, engineId), nil
+// ReplayEngine opens engine on importer, writes sink files in dir to it over streams write streams,
+// and closes the engine. The writer is in ack mode, so the engine is not closed if importer rejects
+// any write stream.
+func (s *Server) ReplayEngine(ctx context.Context, engineId uuid.UUID, dir string, streams int) (*ReplayResult, error) {
+	if err := s.OpenEngine(ctx, engineId); err != nil {
+		return nil, err
+	}
+	opts := s.writerOptions()
+	opts.AckWrites, opts.SpillDir = true, ""
+	writer, err := s.newImportWriter(engineId.Bytes(), streams, opts)
+	if err != nil {
+		return nil, err
+	}
+	writer.Open()
+	result, err := ReplaySinkFiles(ctx, dir, writer, s.cfg.BatchBytes, s.cfg.BatchKvs)
+	writer.Close()
+	if err != nil {
+		return result, err
+	}
+	return result, s.CloseEngine(ctx, engineId)
 }
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"github.com/lerencao/tidb-light/config"
+	"github.com/lerencao/tidb-light/mockimporter"
+	"github.com/pingcap/kvproto/pkg/import_kvpb"
+	"github.com/satori/go.uuid"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestServer_ReplayEngine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mock := mockimporter.New()
+	defer mock.Stop()
+	svr := startJobServer(t, dir, mock)
+	defer svr.Close()
+
+	sinkDir := filepath.Join(dir, "sink")
+	sink, err := NewFileSink(sinkDir, "session", config.SinkFormatKV, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	err = sink.WriteEngine(ctx, &import_kvpb.WriteBatch{
+		CommitTs: 1,
+		Mutations: []*import_kvpb.Mutation{
+			{Op: import_kvpb.Mutation_Put, Key: []byte("k1"), Value: []byte("v1")},
+			{Op: import_kvpb.Mutation_Put, Key: []byte("k2"), Value: []byte("v2")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Close()
+
+	engineId := uuid.NewV4()
+	result, err := svr.ReplayEngine(ctx, engineId, sinkDir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Files != 1 || result.Kvs != 2 {
+		t.Fatalf("expect 2 kv pairs in 1 file replayed, got %d in %d files", result.Kvs, result.Files)
+	}
+	if state, _ := mock.EngineState(engineId.Bytes()); state != mockimporter.EngineClosed {
+		t.Fatalf("expect engine closed after replay, got %s", state)
+	}
+
+	// the engine is not closed if importer rejects the write stream
+	mock.InjectFaults(mockimporter.Faults{EngineNotFound: 1})
+	engineId = uuid.NewV4()
+	if _, err = svr.ReplayEngine(ctx, engineId, sinkDir, 1); err == nil {
+		t.Fatal("replay should fail when importer rejects the write stream")
+	}
+	if state, _ := mock.EngineState(engineId.Bytes()); state != mockimporter.EngineOpened {
+		t.Fatalf("expect engine opened after rejected replay, got %s", state)
+	}
+
+	mock.InjectFaults(mockimporter.Faults{CloseErrors: 1})
+	engineId = uuid.NewV4()
+	if _, err = svr.ReplayEngine(ctx, engineId, sinkDir, 1); err == nil {
+		t.Fatal("replay should fail when importer fails to close the engine")
+	}
+	if state, _ := mock.EngineState(engineId.Bytes()); state != mockimporter.EngineOpened {
+		t.Fatalf("expect engine opened after failed close, got %s", state)
+	}
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"github.com/pkg/errors"
+	"github.com/satori/go.uuid"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+// saveCheckpoint saves the state of session, it should be called with encodeMu held.
+func (s *WriteSession) saveCheckpoint() error {
+	if s.checkpoints == nil {
+		return nil
+	}
+	cp := &SessionCheckpoint{
+		SessionId:     s.id,
+		EngineId:      uuid.FromBytesOrNil(s.engineId).String(),
+		SchemaName:    s.schemaName,
+		TableName:     s.tableName,
+		DbId:          s.dbid,
+		TableId:       s.tableid,
+		DDL:           s.ddl,
+		Streams:       s.streams,
+		Sink:          s.sink,
+		AllocatorBase: s.allocator.Base(),
+		AllocatorEnd:  s.allocator.End(),
+		Seq:           s.lastSeq,
+		UpdatedAt:     time.Now(),
+	}
+	return errors.Wrapf(s.checkpoints.Save(cp), "save checkpoint of session %s", s.id)
+}
+
+// restoreSessions restores sessions from checkpoints, and re-attaches writers to their engines.
+// Sessions which can't be restored are logged and skipped, their checkpoints are kept.
+func (s *SessionManager) restoreSessions() error {
+	cps, err := s.checkpoints.LoadAll()
+	if err != nil {
+		return err
+	}
+
+	for _, cp := range cps {
+		session, err := s.restoreSession(cp)
+		if err != nil {
+			logrus.Errorf("fail to restore session %s of %s.%s, error: %v", cp.SessionId, cp.SchemaName, cp.TableName, err)
+			continue
+		}
+		s.sessions[cp.SessionId] = session
+		logrus.Infof("restore session %s of %s.%s, engine: %s, seq: %d, allocator: (%d, %d]",
+			cp.SessionId, cp.SchemaName, cp.TableName, cp.EngineId, cp.Seq, cp.AllocatorBase, cp.AllocatorEnd)
+	}
+	return nil
+}
+
+func (s *SessionManager) restoreSession(cp *SessionCheckpoint) (*WriteSession, error) {
+	engineId, err := uuid.FromString(cp.EngineId)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	tableInfo, err := s.schemas.TableInfo(cp.SchemaName, cp.TableName)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if tableInfo.ID != cp.TableId {
+		return nil, errors.Errorf("table id changed from %d to %d", cp.TableId, tableInfo.ID)
+	}
+
+	streams := cp.Streams
+	if streams <= 0 {
+		streams = s.cfg.WriteStreams
+	}
+	sink := cp.Sink
+	if sink == "" {
+		sink = SinkImporter
+	}
+	session, err := s.newSession(cp.SessionId, engineId.Bytes(), cp.SchemaName, cp.TableName, cp.DbId, tableInfo, cp.DDL, streams, sink)
+	if err != nil {
+		return nil, err
+	}
+	session.allocator.Restore(cp.AllocatorBase, cp.AllocatorEnd)
+	session.lastSeq = cp.Seq
+	return session, nil
+}
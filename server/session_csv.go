@@ -0,0 +1,171 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/pingcap/tidb/model"
+	"github.com/pkg/errors"
+	"io"
+	"strings"
+)
+
+// CSVWriteParam is the format and column mapping of csv data.
+type CSVWriteParam struct {
+	*CSVOptions
+	// Columns maps csv fields to table columns in order, an empty name or "-" skips the field.
+	// If it's empty, header row is used when Header is set, otherwise all columns in table order.
+	Columns []string
+	// ChunkRows is the max rows encoded and sent to importer in one batch.
+	ChunkRows int
+	// Seq is the write sequence of client.
+	Seq uint64
+	// Sync waits until the data is sent to importer.
+	Sync bool
+}
+
+// CSVError is the error of malformed csv data.
+type CSVError struct {
+	Line int
+	Err  error
+}
+
+func (e *CSVError) Error() string {
+	return fmt.Sprintf("csv line %d: %v", e.Line, e.Err)
+}
+
+// WriteCSV parses csv data from r, and encodes and sends rows in chunks while parsing.
+// The returned result contains rows already sent even if error occurs.
+// seq is reserved while streaming, and acknowledged with a checkpoint saved after all rows are sent,
+// so a checkpoint never covers a part of seq, and a resend after restart allocates handles from the checkpoint.
+func (s *WriteSession) WriteCSV(ctx context.Context, seq uint64, r io.Reader, param *CSVWriteParam, commitTs uint64) (*WriteResult, error) {
+	result := &WriteResult{Indexes: make(map[string]uint64)}
+	s.encodeMu.Lock()
+	if err := s.checkWritable(seq); err != nil {
+		s.encodeMu.Unlock()
+		return result, err
+	}
+	if s.isAcked(seq) {
+		s.encodeMu.Unlock()
+		return s.skippedResult(), nil
+	}
+	if seq != 0 {
+		if s.inflightSeqs == nil {
+			s.inflightSeqs = make(map[uint64]bool)
+		}
+		s.inflightSeqs[seq] = true
+		defer func() {
+			s.encodeMu.Lock()
+			delete(s.inflightSeqs, seq)
+			s.encodeMu.Unlock()
+		}()
+	}
+	s.encodeMu.Unlock()
+
+	result, err := s.streamCSV(ctx, r, param, commitTs)
+	s.encodeMu.Lock()
+	defer s.encodeMu.Unlock()
+	return s.finishWrite(ctx, seq, result, err)
+}
+
+// streamCSV parses csv data from r, and writes rows in chunks without acknowledging any seq.
+func (s *WriteSession) streamCSV(ctx context.Context, r io.Reader, param *CSVWriteParam, commitTs uint64) (*WriteResult, error) {
+	result := &WriteResult{Indexes: make(map[string]uint64)}
+	parser := NewCSVParser(r, param.CSVOptions)
+
+	fields := param.Columns
+	if param.Header {
+		header, err := parser.ReadRow()
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil {
+			return result, &CSVError{Line: parser.Line(), Err: err}
+		}
+		if len(fields) == 0 {
+			fields = make([]string, 0, len(header))
+			for _, name := range header {
+				if name == nil {
+					return result, &CSVError{Line: parser.Line(), Err: errors.New("column name in header should not be null")}
+				}
+				fields = append(fields, name.(string))
+			}
+		}
+	}
+	if len(fields) == 0 {
+		fields = s.colNames
+	}
+
+	columns := make([]string, 0, len(fields))
+	indexes := make([]int, 0, len(fields))
+	for i, name := range fields {
+		if name == "" || name == "-" {
+			continue
+		}
+		columns = append(columns, name)
+		indexes = append(indexes, i)
+	}
+	if err := s.ValidateRows(&RowsParam{Columns: columns}); err != nil {
+		return result, err
+	}
+	// values are checked while parsing, so a bad row is rejected before its chunk is written
+	colInfos := make([]*model.ColumnInfo, 0, len(columns))
+	for _, name := range columns {
+		colInfos = append(colInfos, s.columns[strings.ToLower(name)])
+	}
+
+	chunk := &RowsParam{
+		Columns: columns,
+		Values:  make([][]interface{}, 0, param.ChunkRows),
+	}
+	flush := func() error {
+		if len(chunk.Values) == 0 {
+			return nil
+		}
+		s.encodeMu.Lock()
+		defer s.encodeMu.Unlock()
+		if s.closed {
+			return &SessionClosedError{Id: s.id}
+		}
+		res, err := s.writeRows(ctx, chunk, commitTs)
+		if res != nil {
+			result.merge(res)
+		}
+		if err != nil {
+			return err
+		}
+		chunk.Values = chunk.Values[:0]
+		return nil
+	}
+
+	for {
+		row, err := parser.ReadRow()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return result, &CSVError{Line: parser.Line(), Err: err}
+		}
+		if len(row) != len(fields) {
+			return result, &CSVError{Line: parser.Line(), Err: errors.Errorf("row has %d fields, but there are %d columns", len(row), len(fields))}
+		}
+		values := make([]interface{}, 0, len(indexes))
+		for j, i := range indexes {
+			if err = checkValue(colInfos[j], row[i]); err != nil {
+				return result, &CSVError{Line: parser.Line(), Err: errors.Errorf("column %s: %v", columns[j], err)}
+			}
+			values = append(values, row[i])
+		}
+		chunk.Values = append(chunk.Values, values)
+
+		if len(chunk.Values) >= param.ChunkRows {
+			if err = flush(); err != nil {
+				return result, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return result, err
+	}
+	result.Acked = s.writesAcked()
+	return result, nil
+}
@@ -2,11 +2,18 @@ package server
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/gorilla/mux"
+	"github.com/lerencao/tidb-light/utils"
+	"github.com/pkg/errors"
 	"github.com/satori/go.uuid"
 	"github.com/sirupsen/logrus"
 	"github.com/unrolled/render"
+	"math"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 )
 
 type SessionHandler struct {
@@ -17,6 +24,11 @@ type OpenSessionParam struct {
 	EngineId   string `json:"engine_id"`
 	SchemaName string `json:"schema_name"`
 	TableName  string `json:"table_name"`
+	// Streams is the number of write streams to the engine, the configured write-streams is used if it's 0.
+	Streams int `json:"streams"`
+	// Sink is `importer` to stream kv pairs to importer, which is the default, or `file` to write them
+	// to sorted files in sink-dir, which are replayed to importer by `lighting replay`.
+	Sink string `json:"sink"`
 }
 
 func (s *SessionHandler) Open(w http.ResponseWriter, r *http.Request) {
@@ -34,11 +46,23 @@ func (s *SessionHandler) Open(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	session, err := s.svr.sessionManager.OpenSession(sessionid, engineId.Bytes(), param.SchemaName, param.TableName)
+	if param.Streams < 0 || uint(param.Streams) > utils.MaxConnectionCount {
+		s.r.JSON(w, http.StatusBadRequest, fmt.Sprintf("streams should be in [0, %d]", utils.MaxConnectionCount))
+		return
+	}
+
+	switch param.Sink {
+	case "", SinkImporter, SinkFile:
+	default:
+		s.r.JSON(w, http.StatusBadRequest, fmt.Sprintf("sink should be one of %s|%s", SinkImporter, SinkFile))
+		return
+	}
+
+	session, err := s.svr.sessionManager.OpenSession(sessionid, engineId.Bytes(), param.SchemaName, param.TableName, param.Streams, param.Sink)
 
 	if err != nil {
 		logrus.Error(err)
-		s.r.JSON(w, http.StatusInternalServerError, err.Error())
+		s.r.JSON(w, engineErrorStatus(err), err.Error())
 		return
 	}
 
@@ -47,17 +71,38 @@ func (s *SessionHandler) Open(w http.ResponseWriter, r *http.Request) {
 		"table_name":  session.tableName,
 		"table_id":    session.tableid,
 		"ddl":         session.ddl,
+		"streams":     session.streams,
+		"sink":        session.sink,
 	})
 }
 
 func (s *SessionHandler) Get(w http.ResponseWriter, r *http.Request) {
-	// sessionid := mux.Vars(r)["sessionid"]
-	// session := s.svr.sessionManager.GetSession(sessionid)
-	// TODO
+	sessionid := mux.Vars(r)["sessionid"]
+	session := s.svr.sessionManager.GetSession(sessionid)
+	if session == nil {
+		s.r.JSON(w, http.StatusNotFound, "session is not exist")
+		return
+	}
+	s.r.JSON(w, http.StatusOK, session.Info())
+}
+
+func (s *SessionHandler) List(w http.ResponseWriter, r *http.Request) {
+	sessions := s.svr.sessionManager.ListSessions()
+	infos := make([]*SessionInfo, 0, len(sessions))
+	for _, session := range sessions {
+		infos = append(infos, session.Info())
+	}
+	s.r.JSON(w, http.StatusOK, infos)
 }
 
+// SessionWriteParam is the data to write, one of Sqls and Rows should be set.
 type SessionWriteParam struct {
-	Sqls []string `json:"sqls"`
+	Sqls []string   `json:"sqls"`
+	Rows *RowsParam `json:"rows"`
+	// Seq is the increasing write sequence of client, writes with acknowledged seq are skipped.
+	Seq uint64 `json:"seq"`
+	// Sync waits until the data is sent to importer, instead of returning once it's coalesced.
+	Sync bool `json:"sync"`
 }
 
 func (s *SessionHandler) Write(w http.ResponseWriter, r *http.Request) {
@@ -70,23 +115,228 @@ func (s *SessionHandler) Write(w http.ResponseWriter, r *http.Request) {
 
 	param := &SessionWriteParam{}
 	defer r.Body.Close()
-	if err := json.NewDecoder(r.Body).Decode(param); err != nil {
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(param); err != nil {
 		s.r.JSON(w, http.StatusBadRequest, err.Error())
 		return
 	}
-	// we use local oracle, err is never returned
-	ts, _ := s.svr.oracle.GetTimestamp(r.Context())
-	rows, err := session.Write(r.Context(), param.Sqls, ts)
+	if param.Rows != nil {
+		if len(param.Sqls) != 0 {
+			s.r.JSON(w, http.StatusBadRequest, "only one of sqls and rows should be set")
+			return
+		}
+		if err := session.ValidateRows(param.Rows); err != nil {
+			s.r.JSON(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	ts, err := s.svr.oracle.GetTimestamp(r.Context())
 	if err != nil {
-		s.r.JSON(w, http.StatusInternalServerError, err.Error())
+		logrus.Errorf("fail to get commit ts, error: %v", err)
+		s.r.JSON(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	var result *WriteResult
+	if param.Rows != nil {
+		result, err = session.WriteRows(r.Context(), param.Seq, param.Rows, ts)
+	} else {
+		result, err = session.Write(r.Context(), param.Seq, param.Sqls, ts)
+	}
+	if err == nil && param.Sync {
+		if err = session.Flush(r.Context()); err == nil {
+			result.Acked = session.writer.AcksWrites()
+		}
+	}
+	if err != nil {
+		s.r.JSON(w, writeErrorStatus(w, err), err.Error())
+		return
+	}
+
+	s.r.JSON(w, http.StatusOK, result)
+}
+
+// writeErrorStatus returns the http status of a failed write. A write rejected by backpressure
+// gets 429, or 503 if the importer is unavailable, with a Retry-After header.
+// A write to a session closed meanwhile, e.g. by reaper, gets 410, a write of seq being
+// streamed by another request gets 409, and a write which can't be retried gets 422.
+func writeErrorStatus(w http.ResponseWriter, err error) int {
+	switch errors.Cause(err).(type) {
+	case *SessionClosedError:
+		return http.StatusGone
+	case *SeqInFlightError:
+		return http.StatusConflict
+	case *PartialWriteError:
+		return http.StatusUnprocessableEntity
+	}
+	e, ok := errors.Cause(err).(*BackpressureError)
+	if !ok {
+		return http.StatusInternalServerError
+	}
+	retryAfter := int(math.Ceil(e.RetryAfter.Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	if e.Unavailable {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusTooManyRequests
+}
+
+// WriteCSV streams csv data in request body into session, the format is set by query params:
+// delimiter, quote, escape, null, header, columns, chunk_rows, seq and sync.
+func (s *SessionHandler) WriteCSV(w http.ResponseWriter, r *http.Request) {
+	sessionid := mux.Vars(r)["sessionid"]
+	session := s.svr.sessionManager.GetSession(sessionid)
+	if session == nil {
+		s.r.JSON(w, http.StatusBadRequest, "session is not exist")
+		return
+	}
+	defer r.Body.Close()
+
+	param, err := parseCSVWriteParam(r.URL.Query())
+	if err != nil {
+		s.r.JSON(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ts, err := s.svr.oracle.GetTimestamp(r.Context())
+	if err != nil {
+		logrus.Errorf("fail to get commit ts, error: %v", err)
+		s.r.JSON(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	result, err := session.WriteCSV(r.Context(), param.Seq, r.Body, param, ts)
+	if err == nil && param.Sync {
+		if err = session.Flush(r.Context()); err == nil {
+			result.Acked = session.writer.AcksWrites()
+		}
+	}
+	if err != nil {
+		logrus.Errorf("fail to write csv to session %s after %d rows, error: %v", sessionid, result.Rows, err)
+		status := writeErrorStatus(w, err)
+		if _, ok := errors.Cause(err).(*CSVError); ok {
+			status = http.StatusBadRequest
+		}
+		s.r.JSON(w, status, map[string]interface{}{
+			"error":  err.Error(),
+			"result": result,
+		})
+		return
+	}
+
+	s.r.JSON(w, http.StatusOK, result)
+}
+
+func parseCSVWriteParam(query url.Values) (*CSVWriteParam, error) {
+	param := &CSVWriteParam{
+		CSVOptions: DefaultCSVOptions(),
+		ChunkRows:  1000,
+	}
+
+	var err error
+	// an empty value disables quote or escape char
+	if _, ok := query["delimiter"]; ok {
+		if param.Delimiter, err = csvChar("delimiter", query.Get("delimiter")); err != nil {
+			return nil, err
+		}
+		if param.Delimiter == 0 {
+			return nil, errors.New("delimiter should not be empty")
+		}
+	}
+	if _, ok := query["quote"]; ok {
+		if param.Quote, err = csvChar("quote", query.Get("quote")); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := query["escape"]; ok {
+		if param.Escape, err = csvChar("escape", query.Get("escape")); err != nil {
+			return nil, err
+		}
+	}
+	if param.Escape == param.Quote {
+		// quotes are escaped by doubling them
+		param.Escape = 0
+	}
+	if _, ok := query["null"]; ok {
+		param.Null = query.Get("null")
+	}
+	if header := query.Get("header"); header != "" {
+		if param.Header, err = strconv.ParseBool(header); err != nil {
+			return nil, errors.Errorf("invalid header %s", header)
+		}
+	}
+	if columns := query.Get("columns"); columns != "" {
+		param.Columns = strings.Split(columns, ",")
+	}
+	if sync := query.Get("sync"); sync != "" {
+		if param.Sync, err = strconv.ParseBool(sync); err != nil {
+			return nil, errors.Errorf("invalid sync %s", sync)
+		}
+	}
+	if seq := query.Get("seq"); seq != "" {
+		if param.Seq, err = strconv.ParseUint(seq, 10, 64); err != nil {
+			return nil, errors.Errorf("invalid seq %s", seq)
+		}
+	}
+	if chunkRows := query.Get("chunk_rows"); chunkRows != "" {
+		if param.ChunkRows, err = strconv.Atoi(chunkRows); err != nil || param.ChunkRows <= 0 {
+			return nil, errors.Errorf("invalid chunk_rows %s", chunkRows)
+		}
+	}
+	return param, nil
+}
+
+func csvChar(name, value string) (byte, error) {
+	switch value {
+	case "":
+		return 0, nil
+	case `\t`, "tab":
+		return '\t', nil
+	}
+	if len(value) != 1 {
+		return 0, errors.Errorf("%s should be a single char, got %s", name, value)
+	}
+	return value[0], nil
+}
+
+// Flush waits until all data written to session is sent to importer.
+func (s *SessionHandler) Flush(w http.ResponseWriter, r *http.Request) {
+	sessionid := mux.Vars(r)["sessionid"]
+	session := s.svr.sessionManager.GetSession(sessionid)
+	if session == nil {
+		s.r.JSON(w, http.StatusBadRequest, "session is not exist")
+		return
+	}
+	if err := session.Flush(r.Context()); err != nil {
+		s.r.JSON(w, writeErrorStatus(w, err), err.Error())
+		return
+	}
+	s.r.JSON(w, http.StatusOK, nil)
+}
+
+// Heartbeat extends the lease of session.
+func (s *SessionHandler) Heartbeat(w http.ResponseWriter, r *http.Request) {
+	sessionid := mux.Vars(r)["sessionid"]
+	session := s.svr.sessionManager.GetSession(sessionid)
+	if session == nil {
+		s.r.JSON(w, http.StatusBadRequest, "session is not exist")
 		return
 	}
 
+	expireAt := s.svr.sessionManager.Heartbeat(session)
 	s.r.JSON(w, http.StatusOK, map[string]interface{}{
-		"rows": rows,
+		"expire_at": expireAt,
 	})
 }
 
+// Reaped lists recent sessions closed because their lease expired.
+func (s *SessionHandler) Reaped(w http.ResponseWriter, r *http.Request) {
+	s.r.JSON(w, http.StatusOK, s.svr.sessionManager.ReapedSessions())
+}
+
 func (s *SessionHandler) Close(w http.ResponseWriter, r *http.Request) {
 	sessionid := mux.Vars(r)["sessionid"]
 	session := s.svr.sessionManager.GetSession(sessionid)
@@ -95,11 +345,33 @@ func (s *SessionHandler) Close(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := s.svr.sessionManager.CloseSession(sessionid)
+	autoIdBase, err := s.svr.sessionManager.CloseSession(sessionid)
 	if err != nil {
 		s.r.JSON(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	s.r.JSON(w, http.StatusOK, nil)
+	s.r.JSON(w, http.StatusOK, map[string]interface{}{
+		"auto_id_base": autoIdBase,
+	})
+}
+
+// Rebase rebases auto id of the session's table in tidb, without closing the session.
+func (s *SessionHandler) Rebase(w http.ResponseWriter, r *http.Request) {
+	sessionid := mux.Vars(r)["sessionid"]
+	session := s.svr.sessionManager.GetSession(sessionid)
+	if session == nil {
+		s.r.JSON(w, http.StatusBadRequest, "session is not exist")
+		return
+	}
+
+	autoIdBase, err := s.svr.sessionManager.RebaseSession(session)
+	if err != nil {
+		s.r.JSON(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s.r.JSON(w, http.StatusOK, map[string]interface{}{
+		"auto_id_base": autoIdBase,
+	})
 }
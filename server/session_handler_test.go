@@ -0,0 +1,208 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/lerencao/tidb-light/mockimporter"
+	"github.com/pingcap/tidb/store/mockstore"
+	"github.com/satori/go.uuid"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// doRequest serves a request of method to path by handler, body is encoded in json if it's not nil.
+// The response is decoded into result if it's not nil.
+func doRequest(t *testing.T, handler http.Handler, method, path string, body, result interface{}) int {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(data))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if result != nil && w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code
+}
+
+// openTestSession opens session id of test.t on a new engine opened in the importer of svr, and returns the engine.
+func openTestSession(t *testing.T, svr *Server, handler http.Handler, id string) uuid.UUID {
+	engineId := uuid.NewV4()
+	if err := svr.OpenEngine(context.Background(), engineId); err != nil {
+		t.Fatal(err)
+	}
+	param := &OpenSessionParam{EngineId: engineId.String(), SchemaName: "test", TableName: "t"}
+	if code := doRequest(t, handler, http.MethodPost, "/sql2kv/sessions/"+id+"/open", param, nil); code != http.StatusOK {
+		t.Fatalf("fail to open session, got status %d", code)
+	}
+	return engineId
+}
+
+func TestSessionHandler_SyncAndFlush(t *testing.T) {
+	dir, err := ioutil.TempDir("", "handler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mock := mockimporter.New()
+	defer mock.Stop()
+	svr := startJobServer(t, dir, mock)
+	defer svr.Close()
+	// writes are coalesced, and only sent and acknowledged by sync writes and flushes
+	svr.cfg.CoalesceBytes, svr.cfg.CoalesceInterval.Duration = 1<<20, time.Hour
+	svr.cfg.AckWrites, svr.cfg.AckInterval.Duration, svr.cfg.AckBytes = true, time.Hour, 1<<20
+	handler := CreateRouter("/sql2kv", svr)
+	engineId := openTestSession(t, svr, handler, "session")
+
+	// writes without seq are not flushed to be acknowledged
+	write := func(sql string, sync bool) *WriteResult {
+		result := &WriteResult{}
+		param := &SessionWriteParam{Sqls: []string{sql}, Sync: sync}
+		if code := doRequest(t, handler, http.MethodPost, "/sql2kv/sessions/session/write", param, result); code != http.StatusOK {
+			t.Fatalf("write %s failed with status %d", sql, code)
+		}
+		return result
+	}
+	if result := write("INSERT INTO t VALUES (1, 'a')", false); result.Acked {
+		t.Fatal("a coalesced write should not be acknowledged")
+	}
+	if keys := len(mock.KVs(engineId.Bytes())); keys != 0 {
+		t.Fatalf("expect coalesced write not sent, got %d keys", keys)
+	}
+	// a sync write returns after importer acknowledges all writes of session
+	if result := write("INSERT INTO t VALUES (2, 'b')", true); !result.Acked {
+		t.Fatal("a sync write should be acknowledged")
+	}
+	if keys := len(mock.KVs(engineId.Bytes())); keys != 2 {
+		t.Fatalf("expect 2 keys after sync write, got %d", keys)
+	}
+
+	write("INSERT INTO t VALUES (3, 'c')", false)
+	if code := doRequest(t, handler, http.MethodPost, "/sql2kv/sessions/session/flush", nil, nil); code != http.StatusOK {
+		t.Fatalf("flush failed with status %d", code)
+	}
+	if keys := len(mock.KVs(engineId.Bytes())); keys != 3 {
+		t.Fatalf("expect 3 keys after flush, got %d", keys)
+	}
+	if code := doRequest(t, handler, http.MethodPost, "/sql2kv/sessions/no-session/flush", nil, nil); code != http.StatusBadRequest {
+		t.Fatalf("flush of unknown session should be rejected, got status %d", code)
+	}
+}
+
+func TestSessionHandler_Rebase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "handler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mock := mockimporter.New()
+	defer mock.Stop()
+	svr := startJobServer(t, dir, mock)
+	defer svr.Close()
+	store := newMetaStore(t)
+	defer store.Close()
+	svr.sessionManager.store = store
+	handler := CreateRouter("/sql2kv", svr)
+	openTestSession(t, svr, handler, "session")
+
+	param := &SessionWriteParam{Sqls: []string{"INSERT INTO t VALUES (1, 'a')"}}
+	if code := doRequest(t, handler, http.MethodPost, "/sql2kv/sessions/session/write", param, nil); code != http.StatusOK {
+		t.Fatalf("write failed with status %d", code)
+	}
+	session := svr.sessionManager.GetSession("session")
+	rebase := func() (int64, int) {
+		result := &struct {
+			AutoIdBase int64 `json:"auto_id_base"`
+		}{}
+		code := doRequest(t, handler, http.MethodPost, "/sql2kv/sessions/session/rebase", nil, result)
+		return result.AutoIdBase, code
+	}
+	// auto id of tidb is rebased after the reserved ids of session
+	if base, code := rebase(); code != http.StatusOK || base != session.allocator.End()+1 {
+		t.Fatalf("expect auto id rebased to %d, got %d with status %d", session.allocator.End()+1, base, code)
+	}
+	if id := autoIdOf(t, store, 1, 45); id != session.allocator.End()+1 {
+		t.Fatalf("expect auto id %d in tidb, got %d", session.allocator.End()+1, id)
+	}
+	// a rebase below the auto id of tidb doesn't move it back
+	if err = RebaseAutoId(store, 1, 45, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if _, code := rebase(); code != http.StatusOK {
+		t.Fatalf("rebase failed with status %d", code)
+	}
+	if id := autoIdOf(t, store, 1, 45); id != 1<<20 {
+		t.Fatalf("expect auto id kept at %d, got %d", 1<<20, id)
+	}
+
+	// the table is not in tidb meta
+	empty, err := mockstore.NewMockTikvStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer empty.Close()
+	svr.sessionManager.store = empty
+	if _, code := rebase(); code != http.StatusInternalServerError {
+		t.Fatalf("rebase of a table not in tidb should fail, got status %d", code)
+	}
+	svr.sessionManager.store = nil
+	if _, code := rebase(); code != http.StatusInternalServerError {
+		t.Fatalf("rebase without store should fail, got status %d", code)
+	}
+}
+
+func TestSessionHandler_Stats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "handler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mock := mockimporter.New()
+	defer mock.Stop()
+	svr := startJobServer(t, dir, mock)
+	defer svr.Close()
+	handler := CreateRouter("/sql2kv", svr)
+	openTestSession(t, svr, handler, "session")
+
+	write := func(sqls ...string) int {
+		return doRequest(t, handler, http.MethodPost, "/sql2kv/sessions/session/write", &SessionWriteParam{Sqls: sqls}, nil)
+	}
+	stats := func() *SessionInfo {
+		info := &SessionInfo{}
+		if code := doRequest(t, handler, http.MethodGet, "/sql2kv/sessions/session", nil, info); code != http.StatusOK {
+			t.Fatalf("get session failed with status %d", code)
+		}
+		return info
+	}
+	if code := write("INSERT INTO t VALUES (1, 'a'), (2, 'b')", "INSERT INTO t VALUES (3, 'c')"); code != http.StatusOK {
+		t.Fatalf("write failed with status %d", code)
+	}
+	info := stats()
+	if info.Rows != 3 || info.Kvs != 3 || info.BytesSent == 0 || info.LastWriteAt == nil || info.LastError != nil {
+		t.Fatalf("expect 3 rows in 3 kv pairs sent without error, got %+v", info)
+	}
+
+	// a failed write is reported, and not counted
+	bytesSent := info.BytesSent
+	if code := write("INSERT INTO t VALUES (4, 'd', 'e')"); code == http.StatusOK {
+		t.Fatal("write of mismatched columns should fail")
+	}
+	info = stats()
+	if info.Rows != 3 || info.Kvs != 3 || info.BytesSent != bytesSent {
+		t.Fatalf("expect the failed write not counted, got %d rows in %d kv pairs of %d bytes", info.Rows, info.Kvs, info.BytesSent)
+	}
+	if info.LastError == nil || info.LastError.Error == "" {
+		t.Fatal("expect the error of failed write reported")
+	}
+}
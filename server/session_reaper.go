@@ -0,0 +1,123 @@
+package server
+
+import (
+	"github.com/satori/go.uuid"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// maxReapedSessions is the max number of reaped sessions kept for inspection.
+const maxReapedSessions = 100
+
+// ReapedSession is a session closed by reaper because its lease expired.
+type ReapedSession struct {
+	Id         string    `json:"id"`
+	SchemaName string    `json:"schema_name"`
+	TableName  string    `json:"table_name"`
+	EngineId   string    `json:"engine_id"`
+	LastActive time.Time `json:"last_active"`
+	ReapedAt   time.Time `json:"reaped_at"`
+	Rows       uint64    `json:"rows"`
+	Kvs        uint64    `json:"kvs"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// sessionReaper keeps recent reaped sessions.
+type sessionReaper struct {
+	sync.Mutex
+	reaped []*ReapedSession
+}
+
+func (r *sessionReaper) add(reaped *ReapedSession) {
+	r.Lock()
+	defer r.Unlock()
+	r.reaped = append(r.reaped, reaped)
+	if len(r.reaped) > maxReapedSessions {
+		r.reaped = r.reaped[len(r.reaped)-maxReapedSessions:]
+	}
+}
+
+func (r *sessionReaper) list() []*ReapedSession {
+	r.Lock()
+	defer r.Unlock()
+	return append([]*ReapedSession(nil), r.reaped...)
+}
+
+// ReapedSessions returns recent sessions closed by reaper.
+func (s *SessionManager) ReapedSessions() []*ReapedSession {
+	return s.reaper.list()
+}
+
+// Heartbeat extends the lease of session, and returns the new expire time, which is zero if
+// sessions never expire.
+func (s *SessionManager) Heartbeat(session *WriteSession) time.Time {
+	lastActive := session.stats.touch()
+	if s.cfg.SessionTTL.Duration <= 0 {
+		return time.Time{}
+	}
+	return lastActive.Add(s.cfg.SessionTTL.Duration)
+}
+
+func (s *SessionManager) reapLoop(ttl time.Duration) {
+	defer s.wg.Done()
+
+	interval := ttl / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.reapExpired(ttl)
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// reapExpired flushes and closes sessions whose lease expired.
+func (s *SessionManager) reapExpired(ttl time.Duration) {
+	now := time.Now()
+	expired := make([]*WriteSession, 0)
+	s.Lock()
+	for id, session := range s.sessions {
+		if session.stats.getLastActive().Add(ttl).Before(now) {
+			expired = append(expired, session)
+			delete(s.sessions, id)
+		}
+	}
+	s.Unlock()
+
+	for _, session := range expired {
+		reaped := &ReapedSession{
+			Id:         session.id,
+			SchemaName: session.schemaName,
+			TableName:  session.tableName,
+			EngineId:   uuid.FromBytesOrNil(session.engineId).String(),
+			LastActive: session.stats.getLastActive(),
+		}
+		var err error
+		if s.store != nil {
+			_, err = session.RebaseAutoId(s.store)
+		}
+		if closeErr := session.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		s.release(session)
+		reaped.ReapedAt = time.Now()
+		info := session.Info()
+		reaped.Rows, reaped.Kvs = info.Rows, info.Kvs
+		if err != nil {
+			reaped.Error = err.Error()
+			logrus.Errorf("reap session %s of %s.%s, last active at %v, error: %v",
+				reaped.Id, reaped.SchemaName, reaped.TableName, reaped.LastActive, err)
+		} else {
+			logrus.Warnf("reap session %s of %s.%s, last active at %v, rows: %d, kvs: %d",
+				reaped.Id, reaped.SchemaName, reaped.TableName, reaped.LastActive, reaped.Rows, reaped.Kvs)
+		}
+		s.reaper.add(reaped)
+	}
+}
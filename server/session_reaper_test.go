@@ -0,0 +1,52 @@
+package server
+
+import (
+	"context"
+	"github.com/lerencao/tidb-light/config"
+	"github.com/pkg/errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReapExpired(t *testing.T) {
+	ttl := 50 * time.Millisecond
+	cfg := config.NewConfig()
+	cfg.SessionTTL.Duration = ttl
+	manager, dir := newTestManager(t, cfg)
+	defer os.RemoveAll(dir)
+
+	ddl := "CREATE TABLE t (id int, name varchar(16), PRIMARY KEY (id))"
+	idle, active := newTestSession(t, manager, "idle", 1, ddl), newTestSession(t, manager, "active", 1, ddl)
+
+	time.Sleep(2 * ttl)
+	ctx := context.Background()
+	_, err := active.Write(ctx, 1, []string{"INSERT INTO t VALUES (1, 'a')"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager.reapExpired(ttl)
+
+	if manager.GetSession("idle") != nil || manager.GetSession("active") == nil {
+		t.Fatal("only the idle session should be reaped")
+	}
+	if reaped := manager.ReapedSessions(); len(reaped) != 1 || reaped[0].Id != "idle" || reaped[0].Error != "" {
+		t.Fatalf("expect the idle session reaped, got %v", reaped)
+	}
+
+	// a handler may still hold the reaped session
+	_, err = idle.Write(ctx, 1, []string{"INSERT INTO t VALUES (2, 'b')"}, 1)
+	if _, ok := errors.Cause(err).(*SessionClosedError); !ok {
+		t.Fatalf("expect session closed error, got %v", err)
+	}
+	_, err = idle.WriteRows(ctx, 0, &RowsParam{Columns: []string{"id"}, Values: [][]interface{}{{int64(2)}}}, 1)
+	if _, ok := errors.Cause(err).(*SessionClosedError); !ok {
+		t.Fatalf("expect session closed error, got %v", err)
+	}
+	if err = idle.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = active.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
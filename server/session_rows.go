@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/pingcap/tidb/model"
+	"github.com/pingcap/tidb/mysql"
+	"github.com/pingcap/tidb/util/kvencoder"
+	"github.com/pkg/errors"
+	"strconv"
+	"strings"
+)
+
+// RowsParam is typed rows to write, each value of Values is a row with the same order of Columns.
+type RowsParam struct {
+	Columns []string        `json:"columns"`
+	Values  [][]interface{} `json:"values"`
+}
+
+func columnMapping(tableInfo *model.TableInfo) map[string]*model.ColumnInfo {
+	columns := make(map[string]*model.ColumnInfo, len(tableInfo.Columns))
+	for _, col := range tableInfo.Columns {
+		if col.State != model.StatePublic {
+			continue
+		}
+		columns[col.Name.L] = col
+	}
+	return columns
+}
+
+func columnNames(tableInfo *model.TableInfo) []string {
+	names := make([]string, 0, len(tableInfo.Columns))
+	for _, col := range tableInfo.Columns {
+		if col.State != model.StatePublic {
+			continue
+		}
+		names = append(names, col.Name.O)
+	}
+	return names
+}
+
+// ValidateRows checks rows against the table of session.
+func (s *WriteSession) ValidateRows(rows *RowsParam) error {
+	if len(rows.Columns) == 0 {
+		return errors.Errorf("columns should not be empty")
+	}
+	seen := make(map[string]bool, len(rows.Columns))
+	columns := make([]*model.ColumnInfo, 0, len(rows.Columns))
+	for _, name := range rows.Columns {
+		name = strings.ToLower(name)
+		col, ok := s.columns[name]
+		if !ok {
+			return errors.Errorf("column %s not exists in table %s.%s", name, s.schemaName, s.tableName)
+		}
+		columns = append(columns, col)
+		if seen[name] {
+			return errors.Errorf("column %s is duplicated", name)
+		}
+		seen[name] = true
+	}
+
+	for i, row := range rows.Values {
+		if len(row) != len(rows.Columns) {
+			return errors.Errorf("row %d has %d values, but there are %d columns", i, len(row), len(rows.Columns))
+		}
+		for j, v := range row {
+			if err := checkValue(columns[j], v); err != nil {
+				return errors.Errorf("row %d column %s: %v", i, rows.Columns[j], err)
+			}
+		}
+	}
+	return nil
+}
+
+// WriteRows encodes rows with a prepared insert stmt, and sends the kv pairs to importer.
+// rows should be validated by ValidateRows first.
+func (s *WriteSession) WriteRows(ctx context.Context, seq uint64, rows *RowsParam, commitTs uint64) (*WriteResult, error) {
+	s.encodeMu.Lock()
+	defer s.encodeMu.Unlock()
+	if err := s.checkWritable(seq); err != nil {
+		return nil, err
+	}
+	if s.isAcked(seq) {
+		return s.skippedResult(), nil
+	}
+	result, err := s.writeRows(ctx, rows, commitTs)
+	return s.finishWrite(ctx, seq, result, err)
+}
+
+// writeRows encodes and sends rows without acknowledging any seq, it should be called with encodeMu held.
+func (s *WriteSession) writeRows(ctx context.Context, rows *RowsParam, commitTs uint64) (*WriteResult, error) {
+	stmtIds := make([]uint32, len(s.encoders))
+	for _, encoder := range s.encoders {
+		stmtId, err := encoder.prepareInsert(s.schemaName, s.tableName, rows.Columns)
+		if err != nil {
+			return nil, err
+		}
+		stmtIds[encoder.idx] = stmtId
+	}
+
+	return s.write(ctx, commitTs, len(rows.Values), func(encoder *sessionEncoder, i int) ([]kvenc.KvPair, uint64, error) {
+		params := make([]interface{}, len(rows.Columns))
+		for j, v := range rows.Values[i] {
+			params[j], _ = rowValue(v)
+		}
+		return encoder.EncodePrepareStmt(s.tableid, stmtIds[encoder.idx], params...)
+	})
+}
+
+func quoteName(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+// rowValue converts a json value to the param of prepared stmt.
+// Numbers which are not integers are passed as strings, so that decimals keep precision.
+func rowValue(v interface{}) (interface{}, error) {
+	switch x := v.(type) {
+	case nil, string:
+		return x, nil
+	case json.Number:
+		if i, err := x.Int64(); err == nil {
+			return i, nil
+		}
+		if u, err := strconv.ParseUint(x.String(), 10, 64); err == nil {
+			return u, nil
+		}
+		return x.String(), nil
+	case bool:
+		if x {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case []interface{}, map[string]interface{}:
+		data, err := json.Marshal(x)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return string(data), nil
+	default:
+		return nil, errors.Errorf("unsupported value type %T", v)
+	}
+}
+
+type valueClass int
+
+const (
+	classString valueClass = iota
+	classNumber
+	classTime
+	classJSON
+)
+
+// columnClass returns the class of values accepted by column type tp.
+func columnClass(tp byte) valueClass {
+	switch tp {
+	case mysql.TypeTiny, mysql.TypeShort, mysql.TypeInt24, mysql.TypeLong, mysql.TypeLonglong, mysql.TypeYear,
+		mysql.TypeFloat, mysql.TypeDouble, mysql.TypeDecimal, mysql.TypeNewDecimal:
+		return classNumber
+	case mysql.TypeDate, mysql.TypeNewDate, mysql.TypeDatetime, mysql.TypeTimestamp, mysql.TypeDuration:
+		return classTime
+	case mysql.TypeJSON:
+		return classJSON
+	default:
+		return classString
+	}
+}
+
+// checkValue checks nullability of v and whether v is of the class of col, so bad rows are rejected
+// before row ids are allocated. Values are converted by the encoder, so numbers are accepted by string
+// and time columns, and strings of numbers by number columns.
+func checkValue(col *model.ColumnInfo, v interface{}) error {
+	if _, err := rowValue(v); err != nil {
+		return err
+	}
+	if v == nil {
+		// null of an auto increment column allocates a new id
+		if mysql.HasNotNullFlag(col.Flag) && !mysql.HasAutoIncrementFlag(col.Flag) {
+			return errors.Errorf("column can't be null")
+		}
+		return nil
+	}
+
+	class := columnClass(col.Tp)
+	switch x := v.(type) {
+	case string:
+		if class == classNumber {
+			if _, err := strconv.ParseFloat(strings.TrimSpace(x), 64); err != nil {
+				return errors.Errorf("%q is not a number", x)
+			}
+		}
+	case []interface{}, map[string]interface{}:
+		if class != classJSON && class != classString {
+			return errors.Errorf("json value can't be written to column of type %s", col.FieldType.String())
+		}
+	}
+	return nil
+}
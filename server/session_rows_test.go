@@ -0,0 +1,81 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestValidateRows(t *testing.T) {
+	ddl := "CREATE TABLE t (" +
+		"id bigint AUTO_INCREMENT NOT NULL, name varchar(16) NOT NULL, age int, score decimal(10,2), " +
+		"birth date, extra json, PRIMARY KEY (id))"
+	tableInfo, err := buildTableInfo(ddl, 45, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := &WriteSession{schemaName: "test", tableName: "t", columns: columnMapping(tableInfo)}
+	columns := []string{"id", "name", "age", "score", "birth", "extra"}
+
+	cases := []struct {
+		row []interface{}
+		ok  bool
+	}{
+		{[]interface{}{json.Number("1"), "a", json.Number("10"), "1.5", "2018-01-01", map[string]interface{}{"k": "v"}}, true},
+		// null of auto increment column allocates an id
+		{[]interface{}{nil, "a", nil, nil, nil, nil}, true},
+		{[]interface{}{nil, nil, nil, nil, nil, nil}, false},
+		// numbers are converted for string and bool for number columns
+		{[]interface{}{json.Number("1"), json.Number("2"), true, " 3 ", nil, []interface{}{1, 2}}, true},
+		{[]interface{}{json.Number("1"), "a", "ten", nil, nil, nil}, false},
+		{[]interface{}{json.Number("1"), "a", map[string]interface{}{}, nil, nil, nil}, false},
+		{[]interface{}{json.Number("1"), "a", nil, nil, []interface{}{}, nil}, false},
+		{[]interface{}{json.Number("1"), "a", nil, nil, nil, struct{}{}}, false},
+	}
+	for i, c := range cases {
+		err := session.ValidateRows(&RowsParam{Columns: columns, Values: [][]interface{}{c.row}})
+		if c.ok && err != nil {
+			t.Fatalf("case %d: %v", i, err)
+		}
+		if !c.ok && err == nil {
+			t.Fatalf("case %d should be rejected", i)
+		}
+	}
+
+	// the primary key column is not null even without the option
+	tableInfo, err = buildTableInfo("CREATE TABLE t (id varchar(16), PRIMARY KEY (id))", 45, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.columns = columnMapping(tableInfo)
+	if err = session.ValidateRows(&RowsParam{Columns: []string{"id"}, Values: [][]interface{}{{nil}}}); err == nil {
+		t.Fatal("null primary key should be rejected")
+	}
+}
+
+func TestRowValue(t *testing.T) {
+	cases := []struct {
+		v        interface{}
+		expected interface{}
+	}{
+		{nil, nil},
+		{"a", "a"},
+		{json.Number("-1"), int64(-1)},
+		{json.Number("18446744073709551615"), uint64(18446744073709551615)},
+		{json.Number("1.5"), "1.5"},
+		{true, int64(1)},
+		{false, int64(0)},
+		{map[string]interface{}{"k": "v"}, `{"k":"v"}`},
+	}
+	for _, c := range cases {
+		v, err := rowValue(c.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != c.expected {
+			t.Fatalf("expect %v(%T) of %v, got %v(%T)", c.expected, c.expected, c.v, v, v)
+		}
+	}
+	if _, err := rowValue(1.5); err == nil {
+		t.Fatal("float64 should be rejected as numbers are decoded to json.Number")
+	}
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"github.com/satori/go.uuid"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sessionStats is the write statistics of a session.
+type sessionStats struct {
+	sync.Mutex
+	// lastActive is the last time the lease is extended.
+	lastActive  time.Time
+	lastWriteAt time.Time
+	rows        uint64
+	kvs         uint64
+	bytes       uint64
+	lastErr     string
+	lastErrAt   time.Time
+}
+
+func (s *sessionStats) onWrite(result *WriteResult, bytes uint64) {
+	s.Lock()
+	defer s.Unlock()
+	s.lastWriteAt = time.Now()
+	s.lastActive = s.lastWriteAt
+	s.rows += result.Rows
+	s.kvs += result.Kvs
+	s.bytes += bytes
+}
+
+func (s *sessionStats) touch() time.Time {
+	s.Lock()
+	defer s.Unlock()
+	s.lastActive = time.Now()
+	return s.lastActive
+}
+
+func (s *sessionStats) getLastActive() time.Time {
+	s.Lock()
+	defer s.Unlock()
+	return s.lastActive
+}
+
+func (s *sessionStats) onError(err error) {
+	s.Lock()
+	defer s.Unlock()
+	s.lastErr = err.Error()
+	s.lastErrAt = time.Now()
+}
+
+// SessionInfo is the snapshot of a session.
+type SessionInfo struct {
+	Id          string            `json:"id"`
+	SchemaName  string            `json:"schema_name"`
+	TableName   string            `json:"table_name"`
+	TableId     int64             `json:"table_id"`
+	EngineId    string            `json:"engine_id"`
+	Sink        string            `json:"sink"`
+	CreatedAt   time.Time         `json:"created_at"`
+	LastWriteAt *time.Time        `json:"last_write_at,omitempty"`
+	LastActive  time.Time         `json:"last_active"`
+	Rows        uint64            `json:"rows"`
+	Kvs         uint64            `json:"kvs"`
+	BytesSent   uint64            `json:"bytes_sent"`
+	LastSeq     uint64            `json:"last_seq"`
+	Allocator   AllocatorInfo     `json:"allocator"`
+	LastError   *ErrorInfo        `json:"last_error,omitempty"`
+	Writer      EngineWriterStats `json:"writer"`
+}
+
+// AllocatorInfo is the current row id range of an allocator, ids in (base, end] are reserved.
+type AllocatorInfo struct {
+	Base int64 `json:"base"`
+	End  int64 `json:"end"`
+}
+
+type ErrorInfo struct {
+	Error string    `json:"error"`
+	Time  time.Time `json:"time"`
+}
+
+func (s *WriteSession) Info() *SessionInfo {
+	info := &SessionInfo{
+		Id:         s.id,
+		SchemaName: s.schemaName,
+		TableName:  s.tableName,
+		TableId:    s.tableid,
+		EngineId:   uuid.FromBytesOrNil(s.engineId).String(),
+		Sink:       s.sink,
+		CreatedAt:  s.createdAt,
+		Allocator: AllocatorInfo{
+			Base: s.allocator.Base(),
+			End:  s.allocator.End(),
+		},
+		LastSeq: atomic.LoadUint64(&s.lastSeq),
+		Writer:  s.writer.Stats(),
+	}
+
+	s.stats.Lock()
+	defer s.stats.Unlock()
+	if !s.stats.lastWriteAt.IsZero() {
+		lastWriteAt := s.stats.lastWriteAt
+		info.LastWriteAt = &lastWriteAt
+	}
+	info.LastActive = s.stats.lastActive
+	info.Rows = s.stats.rows
+	info.Kvs = s.stats.kvs
+	info.BytesSent = s.stats.bytes
+	if s.stats.lastErr != "" {
+		info.LastError = &ErrorInfo{Error: s.stats.lastErr, Time: s.stats.lastErrAt}
+	}
+	return info
+}
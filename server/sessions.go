@@ -6,11 +6,17 @@ import (
 	"fmt"
 	"github.com/lerencao/tidb-light/config"
 	"github.com/pingcap/kvproto/pkg/import_kvpb"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/model"
 	"github.com/pingcap/tidb/tablecodec"
 	"github.com/pingcap/tidb/util/kvencoder"
 	"github.com/pkg/errors"
+	"github.com/satori/go.uuid"
 	"github.com/sirupsen/logrus"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type SessionManager struct {
@@ -18,23 +24,60 @@ type SessionManager struct {
 	cfg *config.Config
 
 	db         *sql.DB
+	store      kv.Storage
+	schemas    SchemaProvider
 	kvimporter KvImporter
+	allocators *TableAllocators
+	engines    *EngineRegistry
 	sessions   map[string]*WriteSession
+	// checkpoints is nil if checkpoint is disabled.
+	checkpoints CheckpointStore
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	reaper sessionReaper
 }
 
-func NewSessionManager(cfg *config.Config) *SessionManager {
+func NewSessionManager(cfg *config.Config, engines *EngineRegistry) *SessionManager {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &SessionManager{
 		cfg:      cfg,
+		engines:  engines,
 		sessions: make(map[string]*WriteSession, 10),
+		ctx:      ctx,
+		cancel:   cancel,
 	}
 }
-func (s *SessionManager) Start(importer KvImporter) error {
+func (s *SessionManager) Start(importer KvImporter, store kv.Storage) error {
 	db, err := OpenDB(s.cfg.TiDBAddr, s.cfg.TiDBUser, s.cfg.TiDBPass)
 	if err != nil {
 		return errors.WithStack(err)
 	}
 	s.db = db
+	s.store = store
+	s.schemas, err = NewSchemaProvider(s.cfg, db)
+	if err != nil {
+		return err
+	}
+	s.allocators = NewTableAllocators(store, s.cfg.IdStep)
 	s.kvimporter = importer
+
+	checkpoints, err := NewCheckpointStore(s.cfg, db)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	s.checkpoints = checkpoints
+	if checkpoints != nil {
+		if err = s.restoreSessions(); err != nil {
+			return err
+		}
+	}
+
+	if s.cfg.SessionTTL.Duration > 0 {
+		s.wg.Add(1)
+		go s.reapLoop(s.cfg.SessionTTL.Duration)
+	}
 	return nil
 }
 
@@ -44,7 +87,17 @@ func OpenDB(tidbAddr, tidbUser, tidbPass string) (*sql.DB, error) {
 }
 
 func (s *SessionManager) Close() {
+	s.cancel()
+	s.wg.Wait()
 	defer func() {
+		if s.checkpoints != nil {
+			if err := s.checkpoints.Close(); err != nil {
+				logrus.Errorf("fail to close checkpoint store, error: %v", err)
+			}
+		}
+		if s.db == nil {
+			return
+		}
 		if err := s.db.Close(); err != nil {
 			logrus.Errorf("fail to close db, error: %v", err)
 		}
@@ -65,117 +118,517 @@ func (s *SessionManager) GetSession(sessionid string) *WriteSession {
 	return s.sessions[sessionid]
 }
 
-func (s *SessionManager) CloseSession(sessionid string) error {
-	s.Lock()
-	defer s.Unlock()
+// ListSessions returns all sessions in created order.
+func (s *SessionManager) ListSessions() []*WriteSession {
+	s.RWMutex.RLock()
+	defer s.RWMutex.RUnlock()
+	sessions := make([]*WriteSession, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].createdAt.Before(sessions[j].createdAt)
+	})
+	return sessions
+}
 
-	if session, ok := s.sessions[sessionid]; ok {
+// CloseSession rebases tidb auto id of the table, and then closes the session.
+// It returns the rebased auto id base, which is 0 if store is not opened or schema id is unknown.
+// The session is kept if rebase fails, so that client can retry.
+// Like reapExpired, the session is removed under the lock, and rebased and closed outside it,
+// so a slow close doesn't block other sessions.
+func (s *SessionManager) CloseSession(sessionid string) (int64, error) {
+	s.Lock()
+	session, ok := s.sessions[sessionid]
+	if ok {
 		delete(s.sessions, sessionid)
-		return session.Close()
+	}
+	s.Unlock()
+	if !ok {
+		return 0, nil
 	}
 
-	return nil
+	var newBase int64
+	if s.store != nil {
+		var err error
+		newBase, err = session.RebaseAutoId(s.store)
+		if err != nil {
+			s.Lock()
+			_, reopened := s.sessions[sessionid]
+			if !reopened {
+				s.sessions[sessionid] = session
+			}
+			s.Unlock()
+			if reopened {
+				// the id is taken by a new session, so this one can't be retried.
+				// The checkpoint belongs to the new session, only the engine is released.
+				logrus.Warnf("session %s is reopened, close the old one whose auto id is not rebased", sessionid)
+				session.Close()
+				s.engines.detach(uuid.FromBytesOrNil(session.engineId))
+			}
+			return 0, err
+		}
+	} else {
+		logrus.Warnf("store is not opened, skip rebasing auto id of %s.%s", session.schemaName, session.tableName)
+	}
+
+	err := session.Close()
+	s.release(session)
+	return newBase, err
 }
 
-func (s *SessionManager) OpenSession(sessionid string, engineid []byte, schemaName, tableName string) (*WriteSession, error) {
+// release detaches a closed session from its engine, and removes its checkpoint.
+func (s *SessionManager) release(session *WriteSession) {
+	s.engines.detach(uuid.FromBytesOrNil(session.engineId))
+	if s.checkpoints == nil {
+		return
+	}
+	if err := s.checkpoints.Remove(session.id); err != nil {
+		logrus.Errorf("fail to remove checkpoint of session %s, error: %v", session.id, err)
+	}
+}
+
+// RebaseSession rebases tidb auto id of the table to the max id allocated by session.
+func (s *SessionManager) RebaseSession(session *WriteSession) (int64, error) {
+	return session.RebaseAutoId(s.store)
+}
+
+// OpenSession opens a session writing to engine over streams write streams, 0 means the configured default.
+// Encoded kv pairs are written to sink, which is SinkImporter or SinkFile, empty means SinkImporter.
+func (s *SessionManager) OpenSession(sessionid string, engineid []byte, schemaName, tableName string, streams int, sink string) (*WriteSession, error) {
 	s.Lock()
 	defer s.Unlock()
 	if session, ok := s.sessions[sessionid]; ok {
+		session.stats.touch()
 		return session, nil
 	}
 
-	tableid, err := TableId(s.cfg.TiDBHttpAddr, schemaName, tableName)
+	dbid, err := s.schemas.DatabaseId(schemaName)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
-	ddl, err := TableDDL(s.db, schemaName, tableName)
+	tableInfo, err := s.schemas.TableInfo(schemaName, tableName)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
-	encoder, err := kvenc.New(schemaName, kvenc.NewAllocator())
+	ddl, err := s.schemas.TableDDL(schemaName, tableName)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
 
+	if streams <= 0 {
+		streams = s.cfg.WriteStreams
+	}
+	if sink == "" {
+		sink = SinkImporter
+	}
+	session, err := s.newSession(sessionid, engineid, schemaName, tableName, dbid, tableInfo, ddl, streams, sink)
 	if err != nil {
 		return nil, err
 	}
+	if err = session.saveCheckpoint(); err != nil {
+		session.Close()
+		s.engines.detach(uuid.FromBytesOrNil(engineid))
+		return nil, err
+	}
+	s.sessions[sessionid] = session
+	return session, nil
+}
+
+// newSession creates a session with an encoder pool of ddl, and opens a writer to importer.
+// The session is attached to its engine, so the engine can't be closed until the session is released.
+func (s *SessionManager) newSession(sessionid string, engineid []byte, schemaName, tableName string, dbid int64, tableInfo *model.TableInfo, ddl string, streams int, sink string) (session *WriteSession, err error) {
+	engineUUID := uuid.FromBytesOrNil(engineid)
+	if err = s.engines.attach(engineUUID); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			s.engines.detach(engineUUID)
+		}
+	}()
 
-	err = encoder.ExecDDLSQL(ddl)
+	indexes, err := indexIdMapping(tableInfo, ddl)
+	if err != nil {
+		return nil, err
+	}
+	tableid := tableInfo.ID
+	allocator := s.allocators.NewSessionAllocator(dbid, tableid)
+	encoders, err := newEncoderPool(schemaName, ddl, allocator, s.cfg.EncodeWorkers)
 	if err != nil {
 		return nil, err
 	}
 
-	writer, err := s.kvimporter.GetImportWriter(engineid)
+	var writer ImportWriter
+	switch sink {
+	case SinkImporter:
+		writer, err = s.kvimporter.GetImportWriter(engineid, streams)
+	case SinkFile:
+		writer, err = s.kvimporter.GetFileSink(engineid, sessionid)
+	default:
+		err = errors.Errorf("unknown sink %s", sink)
+	}
 
 	if err != nil {
-		encoder.Close()
+		closeEncoders(encoders)
 		return nil, err
 	}
 
 	// open write to remote service
 	writer.Open()
 
-	session := &WriteSession{
-		schemaName: schemaName,
-		tableName:  tableName,
-		tableid:    tableid,
-		ddl:        ddl,
-		encoder:    encoder,
-		writer:     writer,
+	now := time.Now()
+	session = &WriteSession{
+		id:          sessionid,
+		engineId:    engineid,
+		createdAt:   now,
+		schemaName:  schemaName,
+		tableName:   tableName,
+		dbid:        dbid,
+		tableid:     tableid,
+		indexes:     indexes,
+		columns:     columnMapping(tableInfo),
+		colNames:    columnNames(tableInfo),
+		ddl:         ddl,
+		allocator:   allocator,
+		encoders:    encoders,
+		writer:      writer,
+		tunnel:      NewWriteTunnel(writer, maxInflightBatches*streams),
+		streams:     streams,
+		sink:        sink,
+		checkpoints: s.checkpoints,
+		batchLimit:  batchLimit{bytes: s.cfg.BatchBytes, kvs: s.cfg.BatchKvs},
 	}
-	s.sessions[sessionid] = session
+	session.stats.lastActive = now
 	return session, nil
 }
 
 type WriteSession struct {
+	id         string
+	engineId   []byte
+	createdAt  time.Time
 	schemaName string
 	tableName  string
+	dbid       int64
 	tableid    int64
 	ddl        string
-	encoder    kvenc.KvEncoder
-	writer     *EngineWriter
+	allocator  *SessionAllocator
+	encoders   []*sessionEncoder
+	writer     ImportWriter
+	// tunnel bounds batches of session queued in writer, writes push batches into it
+	// and wait for their futures, so encoding overlaps with sending.
+	tunnel *WriteTunnel
+	// streams is the number of write streams of writer.
+	streams int
+	// sink is where encoded kv pairs are written, SinkImporter or SinkFile.
+	sink string
+
+	// indexes maps index ids in encoded keys to index infos in tidb.
+	indexes map[int64]*model.IndexInfo
+	// columns maps lower case column names to column infos in tidb.
+	columns map[string]*model.ColumnInfo
+	// colNames is the column names in table order.
+	colNames []string
+
+	// encodeMu serializes writes, an encoder is used by one worker of a write at a time,
+	// since kvencoder is not thread safe.
+	encodeMu sync.Mutex
+	// lastSeq is the last acknowledged write sequence of client, it's updated with encodeMu held,
+	// and can be read atomically without the lock.
+	lastSeq uint64
+	// closed is set by Close with encodeMu held, a handler may still hold the session after
+	// it's closed by reaper, its writes are rejected by SessionClosedError.
+	closed bool
+	// inflightSeqs is the seqs of streaming writes in progress, which release encodeMu between chunks,
+	// it's guarded by encodeMu.
+	inflightSeqs map[uint64]bool
+	// partialSeq is the seq whose write failed after some of its kv pairs were sent, see PartialWriteError.
+	partialSeq  uint64
+	checkpoints CheckpointStore
+	batchLimit  batchLimit
+
+	stats sessionStats
 }
 
-func (s *WriteSession) Write(ctx context.Context, sqls []string, commitTs uint64) (uint64, error) {
-	kvs := make([]*import_kvpb.Mutation, 0, 100)
+// SessionClosedError is returned by writes to a closed session.
+type SessionClosedError struct {
+	Id string
+}
 
-	var rows uint64
-	for _, sql := range sqls {
-		kvPairs, affectedRows, err := s.encoder.Encode(sql, s.tableid)
-		if err != nil {
-			return 0, errors.WithStack(err)
+func (e *SessionClosedError) Error() string {
+	return fmt.Sprintf("session %s is closed", e.Id)
+}
+
+// SeqInFlightError is returned by a write whose seq is being written by another streaming write.
+type SeqInFlightError struct {
+	Seq uint64
+}
+
+func (e *SeqInFlightError) Error() string {
+	return fmt.Sprintf("write of seq %d is in progress", e.Seq)
+}
+
+// PartialWriteError is returned by a write of seq which failed after some of its kv pairs were sent.
+// The write can't be retried, since rows are encoded in parallel and a retry allocates them new
+// row ids, so the rows sent before would be duplicated. Later writes of the seq are rejected too,
+// the engine should be cleaned up and written again.
+type PartialWriteError struct {
+	Seq uint64
+	// Kvs is the kv pairs sent before the write failed, Err is the error of it.
+	Kvs uint64
+	Err error
+}
+
+func (e *PartialWriteError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("write of seq %d failed after its kv pairs were sent, it can't be retried", e.Seq)
+	}
+	return fmt.Sprintf("write of seq %d failed after %d kv pairs were sent, it can't be retried: %v", e.Seq, e.Kvs, e.Err)
+}
+
+// WriteResult is the statistics of a write.
+type WriteResult struct {
+	Rows uint64 `json:"rows"`
+	Kvs  uint64 `json:"kvs"`
+	// Indexes is the count of encoded index kv pairs, keyed by index name.
+	Indexes map[string]uint64 `json:"indexes"`
+	// Seq is the last acknowledged write sequence of the session.
+	// In ack mode, the data of an acknowledged seq is acknowledged by importer.
+	Seq uint64 `json:"seq"`
+	// Acked means the data of this write is acknowledged by importer.
+	Acked bool `json:"acked"`
+	// Skipped means the write sequence is already acknowledged, so the data is not written again.
+	Skipped bool `json:"skipped,omitempty"`
+}
+
+func (r *WriteResult) merge(o *WriteResult) {
+	r.Rows += o.Rows
+	r.Kvs += o.Kvs
+	for name, n := range o.Indexes {
+		r.Indexes[name] += n
+	}
+}
+
+// Write encodes sqls and sends the kv pairs to importer.
+// seq is the write sequence of client, a write whose seq is already acknowledged is skipped, 0 means no seq.
+func (s *WriteSession) Write(ctx context.Context, seq uint64, sqls []string, commitTs uint64) (*WriteResult, error) {
+	s.encodeMu.Lock()
+	defer s.encodeMu.Unlock()
+	if err := s.checkWritable(seq); err != nil {
+		return nil, err
+	}
+	if s.isAcked(seq) {
+		return s.skippedResult(), nil
+	}
+	result, err := s.write(ctx, commitTs, len(sqls), func(encoder *sessionEncoder, i int) ([]kvenc.KvPair, uint64, error) {
+		return encoder.Encode(sqls[i], s.tableid)
+	})
+	return s.finishWrite(ctx, seq, result, err)
+}
+
+// writesAcked returns whether a finished write is acknowledged by importer, coalesced writes are
+// finished before they are sent, so they are only acknowledged by flush. Writers never spill in ack
+// mode, so spilled writes are not acknowledged either.
+func (s *WriteSession) writesAcked() bool {
+	return s.writer.AcksWrites() && !s.writer.Coalesces()
+}
+
+// Flush waits until all written kv pairs of session are sent to importer.
+func (s *WriteSession) Flush(ctx context.Context) error {
+	if err := s.tunnel.Flush(ctx); err != nil {
+		s.stats.onError(err)
+		return err
+	}
+	return nil
+}
+
+// checkWritable checks the session is not closed and seq is not being written by a streaming write,
+// it should be called with encodeMu held.
+func (s *WriteSession) checkWritable(seq uint64) error {
+	if s.closed {
+		return &SessionClosedError{Id: s.id}
+	}
+	if seq != 0 && s.inflightSeqs[seq] {
+		return &SeqInFlightError{Seq: seq}
+	}
+	if seq != 0 && seq == s.partialSeq {
+		return &PartialWriteError{Seq: seq}
+	}
+	return nil
+}
+
+// isAcked checks whether seq is acknowledged, it should be called with encodeMu held.
+func (s *WriteSession) isAcked(seq uint64) bool {
+	return seq != 0 && seq <= s.lastSeq
+}
+
+func (s *WriteSession) skippedResult() *WriteResult {
+	return &WriteResult{
+		Indexes: make(map[string]uint64),
+		Seq:     s.lastSeq,
+		Acked:   s.writer.AcksWrites(),
+		Skipped: true,
+	}
+}
+
+// ack acknowledges seq after a successful write, and saves the checkpoint.
+// The write is flushed first, so an acknowledged seq is never left in the coalescing buffer.
+// It should be called with encodeMu held.
+func (s *WriteSession) ack(ctx context.Context, seq uint64, result *WriteResult) error {
+	if s.closed {
+		return &SessionClosedError{Id: s.id}
+	}
+	if seq != 0 {
+		if err := s.Flush(ctx); err != nil {
+			return err
 		}
-		rows = rows + affectedRows
-		// if affectedRows != uint64(len(sqls)) {
-		// 	logrus.Warnf("affectedRows %d is not equal to incoming sql size %d", affectedRows, len(sqls))
-		// }
-
-		for _, pair := range kvPairs {
-			tableID, handle, err := tablecodec.DecodeRecordKey(pair.Key)
-			if err != nil {
-				return 0, err
-			}
-			if tableID != s.tableid {
-				return 0, errors.Errorf("invalid encoded key, table id(%d) should be %d", tableID, s.tableid)
+		result.Acked = s.writer.AcksWrites()
+		// a streaming write may be acknowledged after writes of later seqs
+		if seq > s.lastSeq {
+			atomic.StoreUint64(&s.lastSeq, seq)
+		}
+	}
+	result.Seq = s.lastSeq
+	return s.saveCheckpoint()
+}
+
+// finishWrite acknowledges seq after a successful write. If the write or its ack fails after some
+// kv pairs are sent, seq is marked partial and PartialWriteError is returned.
+// It should be called with encodeMu held.
+func (s *WriteSession) finishWrite(ctx context.Context, seq uint64, result *WriteResult, err error) (*WriteResult, error) {
+	if err == nil {
+		if err = s.ack(ctx, seq, result); err == nil || s.isAcked(seq) {
+			return result, err
+		}
+	}
+	if seq == 0 || s.closed || result == nil || result.Kvs == 0 {
+		return result, err
+	}
+	s.partialSeq = seq
+	return result, &PartialWriteError{Seq: seq, Kvs: result.Kvs, Err: err}
+}
+
+// encodeFunc encodes the i-th input of a write with encoder, returns kv pairs and affected rows.
+type encodeFunc func(encoder *sessionEncoder, i int) ([]kvenc.KvPair, uint64, error)
+
+// write encodes n inputs with the encoder pool, and sends the kv pairs to importer in size bounded batches.
+// Kvs of the returned result is the kv pairs sent even if error occurs.
+func (s *WriteSession) write(ctx context.Context, commitTs uint64, n int, encode encodeFunc) (*WriteResult, error) {
+	s.stats.touch()
+	pipeline := newBatchPipeline(ctx, s.tunnel, commitTs, s.batchLimit)
+	chunks, stop := s.encodeParallel(n, encode)
+	defer stop()
+
+	result := &WriteResult{Indexes: make(map[string]uint64, len(s.indexes))}
+	fail := func(err error) (*WriteResult, error) {
+		s.stats.onError(err)
+		result.Kvs = pipeline.sentKvs
+		return result, err
+	}
+	for chunk := range chunks {
+		if chunk.err != nil {
+			return fail(chunk.err)
+		}
+		result.merge(chunk.result)
+		for _, m := range chunk.kvs {
+			if err := pipeline.add(m); err != nil {
+				return fail(err)
 			}
-			logrus.Infof("encode handle %d", handle)
-			kvs = append(kvs, &import_kvpb.Mutation{
-				Op:    import_kvpb.Mutation_Put,
-				Key:   pair.Key,
-				Value: pair.Val,
-			})
 		}
 	}
 
-	wb := &import_kvpb.WriteBatch{
-		CommitTs:  commitTs,
-		Mutations: kvs,
+	if err := pipeline.finish(); err != nil {
+		return fail(err)
 	}
-	return rows, s.writer.WriteEngine(ctx, wb)
+	result.Kvs = pipeline.sentKvs
+	s.stats.onWrite(result, pipeline.sentBytes)
+	result.Acked = s.writesAcked()
+	return result, nil
 }
 
+// checkKey checks the encoded key is a record key or an index key of the session's table,
+// and returns the key to write. Index id of an index key is rewritten to the one in tidb.
+func (s *WriteSession) checkKey(key kv.Key, result *WriteResult) (kv.Key, error) {
+	if tableID, _, err := tablecodec.DecodeRecordKey(key); err == nil {
+		if tableID != s.tableid {
+			return nil, errors.Errorf("invalid encoded key, table id(%d) should be %d", tableID, s.tableid)
+		}
+		return key, nil
+	}
+
+	tableID, indexID, _, err := tablecodec.DecodeIndexKey(key)
+	if err != nil {
+		return nil, errors.Errorf("invalid encoded key %v, neither record key nor index key", key)
+	}
+	if tableID != s.tableid {
+		return nil, errors.Errorf("invalid encoded index key, table id(%d) should be %d", tableID, s.tableid)
+	}
+	indexInfo, ok := s.indexes[indexID]
+	if !ok {
+		return nil, errors.Errorf("invalid encoded index key, index id(%d) is unknown in table %d", indexID, s.tableid)
+	}
+	result.Indexes[indexInfo.Name.O]++
+	if indexInfo.ID == indexID {
+		return key, nil
+	}
+	prefixLen := len(tablecodec.EncodeTableIndexPrefix(tableID, indexID))
+	newKey := tablecodec.EncodeTableIndexPrefix(tableID, indexInfo.ID)
+	return append(newKey, key[prefixLen:]...), nil
+}
+
+// indexIdMapping maps index ids of table created by kvencoder from ddl to index infos in tidb.
+// kvencoder creates indexes of ddl with ids 1, 2, ... in order, they are mapped to the public
+// indexes of the same names in tidb, as ids in tidb change when indexes are added and dropped.
+func indexIdMapping(tableInfo *model.TableInfo, ddl string) (map[int64]*model.IndexInfo, error) {
+	local, err := buildTableInfo(ddl, tableInfo.ID, nil)
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]*model.IndexInfo, len(tableInfo.Indices))
+	for _, indexInfo := range tableInfo.Indices {
+		if indexInfo.State == model.StatePublic {
+			byName[indexInfo.Name.L] = indexInfo
+		}
+	}
+	indexes := make(map[int64]*model.IndexInfo, len(local.Indices))
+	for _, localInfo := range local.Indices {
+		indexInfo, ok := byName[localInfo.Name.L]
+		if !ok {
+			return nil, errors.Errorf("index %s of ddl not exists in table %s", localInfo.Name.O, tableInfo.Name.O)
+		}
+		indexes[localInfo.ID] = indexInfo
+	}
+	return indexes, nil
+}
+
+// RebaseAutoId rebases tidb auto id allocator of the table to allocator.End()+1,
+// and returns the new base. It's skipped if the schema id is unknown, which is 0 when the
+// schema catalog doesn't set db-id, and returns 0.
+func (s *WriteSession) RebaseAutoId(store kv.Storage) (int64, error) {
+	if s.dbid == 0 {
+		logrus.Warnf("schema id of %s.%s is unknown, skip rebasing auto id", s.schemaName, s.tableName)
+		return 0, nil
+	}
+	newBase := s.allocator.End() + 1
+	if err := RebaseAutoId(store, s.dbid, s.tableid, newBase); err != nil {
+		return 0, err
+	}
+	logrus.Infof("rebase auto id of %s.%s to %d", s.schemaName, s.tableName, newBase)
+	return newBase, nil
+}
+
+// Close waits in-flight writes, and closes encoders and writer of session.
+// Later writes fail with SessionClosedError, closing a closed session is a no-op.
 func (s *WriteSession) Close() error {
-	err := s.encoder.Close()
+	s.encodeMu.Lock()
+	defer s.encodeMu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	err := closeEncoders(s.encoders)
 	if s.writer != nil {
 		s.writer.Close()
 	}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/lerencao/tidb-light/config"
+	"github.com/pingcap/kvproto/pkg/import_kvpb"
+	"github.com/pkg/errors"
+	"github.com/satori/go.uuid"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// sinkImporter writes kv pairs of all engines to file sinks in dir.
+type sinkImporter struct {
+	dir string
+}
+
+func (i *sinkImporter) GetImportClient() (*KvImportClient, error) {
+	return nil, errors.New("no importer")
+}
+
+func (i *sinkImporter) GetImportWriter(engineid []byte, streams int) (ImportWriter, error) {
+	return i.GetFileSink(engineid, "writer")
+}
+
+func (i *sinkImporter) GetFileSink(engineid []byte, name string) (ImportWriter, error) {
+	return NewFileSink(i.dir, uuid.FromBytesOrNil(engineid).String()+"-"+name, config.SinkFormatKV, 1<<20)
+}
+
+// newTestManager creates a session manager of cfg, which writes to file sinks in the returned temp dir,
+// and reserves row ids in memory. The caller should remove the dir.
+func newTestManager(t *testing.T, cfg *config.Config) (*SessionManager, string) {
+	dir, err := ioutil.TempDir("", "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager := NewSessionManager(cfg, NewEngineRegistry())
+	manager.kvimporter = &sinkImporter{dir: dir}
+	manager.allocators = NewTableAllocators(nil, 10)
+	return manager, dir
+}
+
+// newTestSession opens session id of table test.t with ddl on a new engine, the table has id 45
+// and its schema has dbid.
+func newTestSession(t *testing.T, manager *SessionManager, id string, dbid int64, ddl string) *WriteSession {
+	tableInfo, err := buildTableInfo(ddl, 45, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := manager.newSession(id, uuid.NewV4().Bytes(), "test", "t", dbid, tableInfo, ddl, 1, SinkImporter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager.Lock()
+	manager.sessions[id] = session
+	manager.Unlock()
+	return session
+}
+
+// failingWriter passes the next pushes batches to writer, and fails the ones after them.
+type failingWriter struct {
+	ImportWriter
+	pushes int
+}
+
+func (w *failingWriter) push(ctx context.Context, batch *import_kvpb.WriteBatch, future *WriteFuture) error {
+	if w.pushes <= 0 {
+		return errors.New("push failed")
+	}
+	w.pushes--
+	return w.ImportWriter.push(ctx, batch, future)
+}
+
+// recordingWriter records the kv pairs and bytes of mutations of each batch pushed to writer.
+type recordingWriter struct {
+	ImportWriter
+	batches []int
+	bytes   []int
+}
+
+func (w *recordingWriter) push(ctx context.Context, batch *import_kvpb.WriteBatch, future *WriteFuture) error {
+	size := 0
+	for _, m := range batch.Mutations {
+		size += m.Size()
+	}
+	w.batches = append(w.batches, len(batch.Mutations))
+	w.bytes = append(w.bytes, size)
+	return w.ImportWriter.push(ctx, batch, future)
+}
+
+func TestWriteSession_SplitBatches(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.BatchKvs = 2
+	manager, dir := newTestManager(t, cfg)
+	defer os.RemoveAll(dir)
+
+	session := newTestSession(t, manager, "session", 1, "CREATE TABLE t (id int, name varchar(255), PRIMARY KEY (id))")
+	defer session.Close()
+	writer := &recordingWriter{ImportWriter: session.writer}
+	session.tunnel = NewWriteTunnel(writer, maxInflightBatches)
+
+	ctx := context.Background()
+	write := func(sql string) {
+		if _, err := session.Write(ctx, 0, []string{sql}, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// batches are split by batch-kvs
+	write("INSERT INTO t VALUES (1, 'a'), (2, 'b'), (3, 'c'), (4, 'd'), (5, 'e')")
+	if fmt.Sprint(writer.batches) != "[2 2 1]" {
+		t.Fatalf("expect batches of 2, 2 and 1 kv pairs, got %v", writer.batches)
+	}
+
+	// batches are split by batch-bytes, kv pairs of all the rows are of the same size
+	rowBytes := writer.bytes[0] / 2
+	session.batchLimit = batchLimit{bytes: 2*rowBytes + rowBytes/2, kvs: 100}
+	writer.batches, writer.bytes = nil, nil
+	write("INSERT INTO t VALUES (6, 'a'), (7, 'b'), (8, 'c'), (9, 'd'), (10, 'e')")
+	if fmt.Sprint(writer.batches) != "[2 2 1]" {
+		t.Fatalf("expect batches of 2, 2 and 1 kv pairs, got %v", writer.batches)
+	}
+
+	// a row larger than batch-bytes is sent in a batch of its own
+	writer.batches, writer.bytes = nil, nil
+	write(fmt.Sprintf("INSERT INTO t VALUES (11, 'a'), (12, '%s'), (13, 'c'), (14, 'd')", strings.Repeat("x", 4*rowBytes)))
+	if fmt.Sprint(writer.batches) != "[1 1 2]" || writer.bytes[1] <= session.batchLimit.bytes {
+		t.Fatalf("expect the large row sent alone, got batches %v of %v bytes", writer.batches, writer.bytes)
+	}
+	if err := session.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if stats := session.Info(); stats.Kvs != 14 {
+		t.Fatalf("expect 14 kv pairs written, got %d", stats.Kvs)
+	}
+}
+
+func TestWriteSession_PartialWrite(t *testing.T) {
+	cfg := config.NewConfig()
+	// a batch per row
+	cfg.BatchKvs = 1
+	manager, dir := newTestManager(t, cfg)
+	defer os.RemoveAll(dir)
+
+	session := newTestSession(t, manager, "session", 1, "CREATE TABLE t (id int, name varchar(16), PRIMARY KEY (id))")
+	defer session.Close()
+	writer := &failingWriter{ImportWriter: session.writer, pushes: 1}
+	session.tunnel = NewWriteTunnel(writer, maxInflightBatches)
+
+	ctx := context.Background()
+	sqls := []string{"INSERT INTO t VALUES (1, 'a')", "INSERT INTO t VALUES (2, 'b')"}
+	// a write failed before any kv pair is sent can be retried
+	writer.pushes = 0
+	_, err := session.Write(ctx, 1, sqls, 1)
+	if err == nil {
+		t.Fatal("write should fail")
+	}
+	if _, ok := errors.Cause(err).(*PartialWriteError); ok {
+		t.Fatalf("write failed before sending should be retryable, got %v", err)
+	}
+
+	writer.pushes = 1
+	_, err = session.Write(ctx, 1, sqls, 1)
+	if e, ok := errors.Cause(err).(*PartialWriteError); !ok || e.Seq != 1 || e.Kvs != 1 {
+		t.Fatalf("expect partial write of seq 1 after 1 kv pair, got %v", err)
+	}
+	writer.pushes = 10
+	_, err = session.Write(ctx, 1, sqls, 1)
+	if _, ok := errors.Cause(err).(*PartialWriteError); !ok {
+		t.Fatalf("retry of partial seq should be rejected, got %v", err)
+	}
+
+	result, err := session.Write(ctx, 2, []string{"INSERT INTO t VALUES (3, 'c')"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Seq != 2 || result.Kvs != 1 {
+		t.Fatalf("expect seq 2 acknowledged with 1 kv pair, got %+v", result)
+	}
+}
+
+func TestWriteSession_RebaseUnknownSchema(t *testing.T) {
+	manager, dir := newTestManager(t, config.NewConfig())
+	defer os.RemoveAll(dir)
+
+	// schema catalog without db-id
+	session := newTestSession(t, manager, "session", 0, "CREATE TABLE t (id int, PRIMARY KEY (id))")
+	defer session.Close()
+	if newBase, err := session.RebaseAutoId(nil); err != nil || newBase != 0 {
+		t.Fatalf("rebase should be skipped without schema id, got %d, %v", newBase, err)
+	}
+}
+
+func TestWriteSession_CSVNotNull(t *testing.T) {
+	manager, dir := newTestManager(t, config.NewConfig())
+	defer os.RemoveAll(dir)
+
+	session := newTestSession(t, manager, "session", 1, "CREATE TABLE t (id int, name varchar(16) NOT NULL, PRIMARY KEY (id))")
+	defer session.Close()
+	param := &CSVWriteParam{CSVOptions: DefaultCSVOptions(), ChunkRows: 10}
+	result, err := session.WriteCSV(context.Background(), 1, strings.NewReader("1,a\n2,\\N\n"), param, 1)
+	e, ok := errors.Cause(err).(*CSVError)
+	if !ok || e.Line != 2 {
+		t.Fatalf("expect csv error of line 2, got %v", err)
+	}
+	// the chunk of the bad row is not written
+	if result.Rows != 0 || result.Kvs != 0 {
+		t.Fatalf("expect nothing written, got %+v", result)
+	}
+}
@@ -0,0 +1,281 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/juju/errors"
+	"github.com/pingcap/kvproto/pkg/import_kvpb"
+	"github.com/satori/go.uuid"
+	"github.com/sirupsen/logrus"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// spillHeaderSize is the size of record header in spill segments, which is the length and crc32 of record.
+const spillHeaderSize = 8
+
+// spillQueue is a FIFO of write batches in local segment files. Batches are appended to the last
+// segment, and read from the first one, a segment is removed after all its batches are read.
+//
+// A record is the length and crc32 of the encoded batch in big endian, followed by the batch.
+//
+// Segments are not synced, and a queue is not reopened after restart. Spilled batches are finished
+// before they are sent, like coalesced ones, so they are only durable after a Flush.
+type spillQueue struct {
+	dir          string
+	segmentBytes int64
+
+	mu sync.Mutex
+	// count and bytes are the batches appended but not committed.
+	count int
+	bytes int64
+
+	writeSeg  int
+	writeFile *os.File
+	writeSize int64
+
+	readSeg    int
+	readFile   *os.File
+	readOffset int64
+
+	// changed is closed and replaced when a batch is appended or committed.
+	changed chan struct{}
+}
+
+func newSpillQueue(dir string, segmentBytes int) *spillQueue {
+	return &spillQueue{
+		dir:          dir,
+		segmentBytes: int64(segmentBytes),
+		writeSeg:     -1,
+		changed:      make(chan struct{}),
+	}
+}
+
+func (q *spillQueue) segmentPath(seg int) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%08d.spill", seg))
+}
+
+func (q *spillQueue) notify() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
+
+// push appends batch if the queue is not empty or force is set, so batches after a spilled one
+// are spilled too and drained in order. It returns whether batch is spilled.
+func (q *spillQueue) push(batch *import_kvpb.WriteBatch, force bool) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.count == 0 && !force {
+		return false, nil
+	}
+
+	data, err := batch.Marshal()
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	if q.writeFile == nil || q.writeSize >= q.segmentBytes {
+		if err = q.rotate(); err != nil {
+			return false, err
+		}
+	}
+	record := make([]byte, spillHeaderSize+len(data))
+	binary.BigEndian.PutUint32(record, uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(data))
+	copy(record[spillHeaderSize:], data)
+	if _, err = q.writeFile.Write(record); err != nil {
+		return false, errors.Annotatef(err, "spill batch to %s", q.writeFile.Name())
+	}
+	q.writeSize += int64(len(record))
+	q.count++
+	q.bytes += int64(len(record))
+	q.notify()
+	return true, nil
+}
+
+// rotate creates the next segment to append to, it should be called with mu held.
+func (q *spillQueue) rotate() error {
+	if err := os.MkdirAll(q.dir, 0755); err != nil {
+		return errors.Trace(err)
+	}
+	file, err := os.OpenFile(q.segmentPath(q.writeSeg+1), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if q.writeFile != nil {
+		q.writeFile.Close()
+	}
+	q.writeSeg++
+	q.writeFile, q.writeSize = file, 0
+	return nil
+}
+
+// peek waits until a batch is available, and returns the first batch and its record size.
+// The batch stays in queue until it's committed.
+func (q *spillQueue) peek(ctx context.Context) (*import_kvpb.WriteBatch, int64, error) {
+	for {
+		q.mu.Lock()
+		if q.count > 0 {
+			batch, n, err := q.read()
+			q.mu.Unlock()
+			return batch, n, err
+		}
+		changed := q.changed
+		q.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, 0, errors.Trace(ctx.Err())
+		}
+	}
+}
+
+// read reads the record at read offset, it moves to the next segment if the current one is used up.
+// It should be called with mu held and count > 0.
+func (q *spillQueue) read() (*import_kvpb.WriteBatch, int64, error) {
+	for {
+		if q.readFile == nil {
+			file, err := os.Open(q.segmentPath(q.readSeg))
+			if err != nil {
+				return nil, 0, errors.Trace(err)
+			}
+			q.readFile, q.readOffset = file, 0
+		}
+
+		header := make([]byte, spillHeaderSize)
+		_, err := q.readFile.ReadAt(header, q.readOffset)
+		if err == io.EOF && q.readSeg < q.writeSeg {
+			// all batches of the segment are read
+			q.readFile.Close()
+			os.Remove(q.segmentPath(q.readSeg))
+			q.readFile = nil
+			q.readSeg++
+			continue
+		}
+		if err != nil {
+			return nil, 0, errors.Annotatef(err, "read spill segment %s", q.readFile.Name())
+		}
+
+		data := make([]byte, binary.BigEndian.Uint32(header))
+		if _, err = q.readFile.ReadAt(data, q.readOffset+spillHeaderSize); err != nil {
+			return nil, 0, errors.Annotatef(err, "read spill segment %s", q.readFile.Name())
+		}
+		if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:]) {
+			return nil, 0, errors.Errorf("checksum mismatch in spill segment %s at %d", q.readFile.Name(), q.readOffset)
+		}
+		batch := &import_kvpb.WriteBatch{}
+		if err = batch.Unmarshal(data); err != nil {
+			return nil, 0, errors.Trace(err)
+		}
+		return batch, int64(len(data)) + spillHeaderSize, nil
+	}
+}
+
+// commit removes the first batch peeked, n is its record size.
+func (q *spillQueue) commit(n int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.readOffset += n
+	q.count--
+	q.bytes -= n
+	q.notify()
+}
+
+// discard drops all batches in queue, and returns the number of them.
+func (q *spillQueue) discard() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	count := q.count
+	q.removeSegments()
+	q.count, q.bytes = 0, 0
+	// the next batch is appended to a new segment, which is read from
+	q.readSeg = q.writeSeg + 1
+	q.notify()
+	return count
+}
+
+// removeSegments closes and removes all segments, it should be called with mu held.
+func (q *spillQueue) removeSegments() {
+	if q.readFile != nil {
+		q.readFile.Close()
+		q.readFile = nil
+	}
+	if q.writeFile != nil {
+		q.writeFile.Close()
+		q.writeFile = nil
+	}
+	for seg := q.readSeg; seg <= q.writeSeg; seg++ {
+		os.Remove(q.segmentPath(seg))
+	}
+}
+
+// waitEmpty waits until all batches are committed.
+func (q *spillQueue) waitEmpty(ctx context.Context) error {
+	for {
+		q.mu.Lock()
+		if q.count == 0 {
+			q.mu.Unlock()
+			return nil
+		}
+		changed := q.changed
+		q.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return errors.Trace(ctx.Err())
+		}
+	}
+}
+
+// stats returns the batches and bytes in queue.
+func (q *spillQueue) stats() (int, int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.count, q.bytes
+}
+
+// close removes the spill dir with the batches left, and returns the number of them.
+func (q *spillQueue) close() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	count := q.count
+	q.removeSegments()
+	os.RemoveAll(q.dir)
+	return count
+}
+
+// cleanSpillDir removes spill queues left in dir by a previous process, which are named
+// `<engine uuid>-<writer uuid>`. It should be called before any writer is created.
+func cleanSpillDir(dir string) error {
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+	n := len(uuid.Nil.String())
+	for _, info := range infos {
+		name := info.Name()
+		if !info.IsDir() || len(name) != 2*n+1 || name[n] != '-' {
+			continue
+		}
+		if _, err = uuid.FromString(name[:n]); err != nil {
+			continue
+		}
+		if _, err = uuid.FromString(name[n+1:]); err != nil {
+			continue
+		}
+		logrus.Warnf("remove stale spill queue %s", name)
+		if err = os.RemoveAll(filepath.Join(dir, name)); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
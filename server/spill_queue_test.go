@@ -0,0 +1,41 @@
+package server
+
+import (
+	"github.com/satori/go.uuid"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCleanSpillDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stale := filepath.Join(dir, uuid.NewV4().String()+"-"+uuid.NewV4().String())
+	other := filepath.Join(dir, "other")
+	for _, d := range []string{stale, other} {
+		if err = os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = ioutil.WriteFile(filepath.Join(stale, "00000000.spill"), []byte("batch"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = cleanSpillDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatalf("stale spill queue should be removed, got %v", err)
+	}
+	if _, err = os.Stat(other); err != nil {
+		t.Fatalf("other dirs should be kept, got %v", err)
+	}
+	if err = cleanSpillDir(filepath.Join(dir, "not_exists")); err != nil {
+		t.Fatal(err)
+	}
+}
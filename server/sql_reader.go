@@ -0,0 +1,140 @@
+package server
+
+import (
+	"bufio"
+	"github.com/pkg/errors"
+	"io"
+	"strings"
+)
+
+// SQLReader splits a stream of sql file into statements,
+// semicolons in quoted strings and comments don't end a statement.
+type SQLReader struct {
+	r    *bufio.Reader
+	stmt []byte
+}
+
+func NewSQLReader(r io.Reader) *SQLReader {
+	return &SQLReader{r: bufio.NewReaderSize(r, 64*1024)}
+}
+
+// ReadStmt returns the next statement without the trailing semicolon, comments are kept.
+// It returns io.EOF when there is no more statements.
+func (s *SQLReader) ReadStmt() (string, error) {
+	s.stmt = s.stmt[:0]
+	// quote is the current quote char, 0 if not in quoted string.
+	var quote byte
+	for {
+		c, err := s.r.ReadByte()
+		if err == io.EOF {
+			if quote != 0 {
+				return "", errors.New("unterminated quoted string")
+			}
+			stmt := strings.TrimSpace(string(s.stmt))
+			if stmt == "" {
+				return "", io.EOF
+			}
+			return stmt, nil
+		}
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		s.stmt = append(s.stmt, c)
+
+		switch {
+		case quote != 0:
+			if c == '\\' && quote != '`' {
+				next, err := s.r.ReadByte()
+				if err != nil {
+					return "", errors.New("unexpected end after escape char")
+				}
+				s.stmt = append(s.stmt, next)
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '-' || c == '#':
+			if c == '-' {
+				next, err := s.r.Peek(1)
+				if err != nil || next[0] != '-' {
+					continue
+				}
+			}
+			// line comment
+			line, err := s.r.ReadBytes('\n')
+			s.stmt = append(s.stmt, line...)
+			if err != nil && err != io.EOF {
+				return "", errors.WithStack(err)
+			}
+		case c == '/':
+			next, err := s.r.Peek(1)
+			if err != nil || next[0] != '*' {
+				continue
+			}
+			if err = s.readBlockComment(); err != nil {
+				return "", err
+			}
+		case c == ';':
+			stmt := strings.TrimSpace(string(s.stmt[:len(s.stmt)-1]))
+			if stmt == "" {
+				continue
+			}
+			return stmt, nil
+		}
+	}
+}
+
+// readBlockComment reads a block comment after its leading `/`, the closing `*/` is searched
+// after the opening `/*`, so `/*/` is not a complete comment.
+func (s *SQLReader) readBlockComment() error {
+	c, err := s.r.ReadByte()
+	if err != nil {
+		return errors.New("unterminated comment")
+	}
+	s.stmt = append(s.stmt, c)
+	var last byte
+	for {
+		c, err := s.r.ReadByte()
+		if err != nil {
+			return errors.New("unterminated comment")
+		}
+		s.stmt = append(s.stmt, c)
+		if last == '*' && c == '/' {
+			return nil
+		}
+		last = c
+	}
+}
+
+// isInsertStmt checks whether stmt is an insert or replace statement, leading comments are skipped.
+func isInsertStmt(stmt string) bool {
+	stmt = strings.TrimSpace(stripLeadingComments(stmt))
+	if len(stmt) < 7 {
+		return false
+	}
+	prefix := strings.ToUpper(stmt[:7])
+	return strings.HasPrefix(prefix, "INSERT") || strings.HasPrefix(prefix, "REPLACE")
+}
+
+func stripLeadingComments(stmt string) string {
+	for {
+		stmt = strings.TrimSpace(stmt)
+		switch {
+		case strings.HasPrefix(stmt, "/*"):
+			end := strings.Index(stmt[2:], "*/")
+			if end < 0 {
+				return ""
+			}
+			stmt = stmt[end+4:]
+		case strings.HasPrefix(stmt, "--"), strings.HasPrefix(stmt, "#"):
+			end := strings.IndexByte(stmt, '\n')
+			if end < 0 {
+				return ""
+			}
+			stmt = stmt[end+1:]
+		default:
+			return stmt
+		}
+	}
+}
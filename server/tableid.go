@@ -4,33 +4,72 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/juju/errors"
+	"github.com/pingcap/tidb/model"
 	"io/ioutil"
 	"net/http"
+	"strings"
 )
 
 // TableId send a http req to remote tidb http endpoint to get table info
 func TableId(tidbEndpoint string, schema, table string) (int64, error) {
-	resp, err:= http.DefaultClient.Get(fmt.Sprintf("%s/schema/%s/%s", tidbEndpoint, schema, table))
+	tableInfo, err := TableInfo(tidbEndpoint, schema, table)
 	if err != nil {
-		return 0, errors.Trace(err)
+		return 0, err
+	}
+	return tableInfo.ID, nil
+}
+
+// TableInfo send a http req to remote tidb http endpoint to get table info, including columns and indexes.
+func TableInfo(tidbEndpoint string, schema, table string) (*model.TableInfo, error) {
+	resp, err := http.DefaultClient.Get(fmt.Sprintf("%s/schema/%s/%s", tidbEndpoint, schema, table))
+	if err != nil {
+		return nil, errors.Trace(err)
 	}
 	defer resp.Body.Close()
 	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return 0, errors.Trace(err)
+		return nil, errors.Trace(err)
 	}
 
 	if resp.StatusCode > 300 {
-		return 0, errors.Errorf("request table id failed, status: %s, error: %s", resp.Status, string(data))
+		return nil, errors.Errorf("request table id failed, status: %s, error: %s", resp.Status, string(data))
 	}
 
+	tableInfo := &model.TableInfo{}
+	err = json.Unmarshal(data, tableInfo)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
 
-	respData := make(map[string]interface{})
-	err = json.Unmarshal(data, &respData)
+	return tableInfo, nil
+}
+
+// DatabaseId send a http req to remote tidb http endpoint to get the id of schema
+func DatabaseId(tidbEndpoint string, schema string) (int64, error) {
+	resp, err := http.DefaultClient.Get(fmt.Sprintf("%s/schema", tidbEndpoint))
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return 0, errors.Trace(err)
 	}
 
+	if resp.StatusCode > 300 {
+		return 0, errors.Errorf("request schemas failed, status: %s, error: %s", resp.Status, string(data))
+	}
 
-	return int64(respData["id"].(float64)), nil
+	dbs := make([]*model.DBInfo, 0)
+	err = json.Unmarshal(data, &dbs)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	for _, db := range dbs {
+		if db.Name.L == strings.ToLower(schema) {
+			return db.ID, nil
+		}
+	}
+	return 0, errors.Errorf("schema %s not exists", schema)
 }
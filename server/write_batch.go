@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"github.com/pingcap/kvproto/pkg/import_kvpb"
+)
+
+// maxInflightBatches is the max unresolved batches of a session per write stream,
+// encoding waits until one of them is resolved when it's reached.
+const maxInflightBatches = 4
+
+// batchLimit bounds the size of a write batch.
+type batchLimit struct {
+	bytes int
+	kvs   int
+}
+
+// batchPipeline splits mutations of a write into size bounded batches,
+// and pushes them into tunnel while following mutations are encoded.
+type batchPipeline struct {
+	ctx      context.Context
+	tunnel   *WriteTunnel
+	commitTs uint64
+	limit    batchLimit
+
+	kvs  []*import_kvpb.Mutation
+	size int
+
+	futures []*WriteFuture
+	// sentKvs and sentBytes are the kvs and bytes of sent batches.
+	sentKvs   uint64
+	sentBytes uint64
+}
+
+func newBatchPipeline(ctx context.Context, tunnel *WriteTunnel, commitTs uint64, limit batchLimit) *batchPipeline {
+	return &batchPipeline{
+		ctx:      ctx,
+		tunnel:   tunnel,
+		commitTs: commitTs,
+		limit:    limit,
+	}
+}
+
+// add appends m to current batch, the batch is sent first if m doesn't fit into it.
+// A mutation larger than the limit is sent in a batch of its own.
+func (p *batchPipeline) add(m *import_kvpb.Mutation) error {
+	size := m.Size()
+	if len(p.kvs) > 0 && (p.size+size > p.limit.bytes || len(p.kvs) >= p.limit.kvs) {
+		if err := p.flush(); err != nil {
+			return err
+		}
+	}
+	p.kvs = append(p.kvs, m)
+	p.size += size
+	return nil
+}
+
+func (p *batchPipeline) flush() error {
+	if len(p.kvs) == 0 {
+		return nil
+	}
+	// fail fast if a batch pushed before has failed
+	for len(p.futures) > 0 {
+		select {
+		case <-p.futures[0].Done():
+			if err := p.futures[0].Err(); err != nil {
+				return err
+			}
+			p.futures = p.futures[1:]
+			continue
+		default:
+		}
+		break
+	}
+
+	wb := &import_kvpb.WriteBatch{
+		CommitTs:  p.commitTs,
+		Mutations: p.kvs,
+	}
+	future, err := p.tunnel.Push(p.ctx, wb)
+	if err != nil {
+		return err
+	}
+	p.futures = append(p.futures, future)
+	p.sentKvs += uint64(len(p.kvs))
+	p.sentBytes += uint64(wb.Size())
+	p.kvs, p.size = nil, 0
+	return nil
+}
+
+// finish pushes the last batch, and waits until all batches are resolved.
+func (p *batchPipeline) finish() error {
+	err := p.flush()
+	for _, future := range p.futures {
+		if waitErr := future.Wait(p.ctx); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	p.futures = nil
+	return err
+}
@@ -2,79 +2,93 @@ package server
 
 import (
 	"context"
+	"github.com/juju/errors"
 	"github.com/pingcap/kvproto/pkg/import_kvpb"
-	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
-	"google.golang.org/grpc"
+	"sync"
 )
 
-type result struct {
-	v *import_kvpb.WriteEngineResponse
-	e error
+// WriteFuture is the result of a batch pushed into a WriteTunnel. It resolves when the importer
+// replies, i.e. the batch is sent, or acknowledged by importer in ack mode.
+type WriteFuture struct {
+	once sync.Once
+	done chan struct{}
+	err  error
+	// onResolve is called after the future resolves.
+	onResolve func()
 }
 
-type WriteTunnel struct {
-	conn *grpc.ClientConn
-	client     import_kvpb.ImportKV_WriteEngineClient
-	sourceChan chan *import_kvpb.WriteEngineRequest
-	doneChan   chan *result
+func newWriteFuture() *WriteFuture {
+	return &WriteFuture{done: make(chan struct{})}
 }
 
-func (w *WriteTunnel) NewWriteTunnel(dataChan chan *import_kvpb.WriteEngineRequest, conn *grpc.ClientConn) *WriteTunnel {
-	return &WriteTunnel{
-		sourceChan:dataChan,
-		conn:conn,
-		doneChan: make(chan *result, 1),
-	}
+func (f *WriteFuture) resolve(err error) {
+	f.once.Do(func() {
+		f.err = err
+		close(f.done)
+		if f.onResolve != nil {
+			f.onResolve()
+		}
+	})
 }
 
-func (w *WriteTunnel) Open(ctx context.Context) error {
-	if w.client != nil {
-		return errors.Errorf("write tunnel already opened")
-	}
+// Done returns a channel which is closed when the future resolves.
+func (f *WriteFuture) Done() <-chan struct{} {
+	return f.done
+}
 
-	client,err := import_kvpb.NewImportKVClient(w.conn).WriteEngine(ctx)
+// Err returns the result of the batch, it should be called after Done is closed.
+func (f *WriteFuture) Err() error {
+	return f.err
+}
 
-	if err != nil {
-		return err
+// Wait waits until the future resolves or ctx is done.
+func (f *WriteFuture) Wait(ctx context.Context) error {
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		return errors.Trace(ctx.Err())
 	}
-	w.client = client
-	go w.streamingLoop()
-	return nil
 }
 
-// ResultChan return the channel which caller should loop on this to wait for streaming finish.
-func (w *WriteTunnel) ResultChan() chan *result {
-	return w.doneChan
+// WriteTunnel is the asynchronous streaming API of an engine writer. Producers push batches into it
+// and get futures without waiting, the batches are streamed to importer by writer in background.
+// At most maxInflight batches are unresolved, Push blocks until one resolves when the limit is reached.
+type WriteTunnel struct {
+	writer ImportWriter
+	slots  chan struct{}
 }
 
-func (w *WriteTunnel) streamingLoop() {
-	defer close(w.doneChan)
-	for {
-		select {
-		case req, ok := <-w.sourceChan:
-			if ok {
-				err := w.client.Send(req)
-				if err != nil {
-					if e := w.client.CloseSend(); e != nil {
-						logrus.Errorf("fail to close stream, %v", e)
-					}
-					w.doneChan <- &result{e: err}
-				}
-			} else {
-				// Close chan
-				resp, err := w.client.CloseAndRecv()
-
-				if err != nil {
-					w.doneChan <- &result{e: err}
-				} else if resp.GetError() != nil {
-					w.doneChan <- &result{e: errors.Errorf(resp.GetError().String()) }
-				} else {
-					w.doneChan <- &result{v: resp}
-				}
+func NewWriteTunnel(writer ImportWriter, maxInflight int) *WriteTunnel {
+	return &WriteTunnel{
+		writer: writer,
+		slots:  make(chan struct{}, maxInflight),
+	}
+}
 
-				return
-			}
-		}
+// Push queues batch to be sent, and returns its future. A batch whose ctx is done before it's sent is dropped.
+// It returns BackpressureError if the writer rejects the batch.
+func (t *WriteTunnel) Push(ctx context.Context, batch *import_kvpb.WriteBatch) (*WriteFuture, error) {
+	select {
+	case t.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, errors.Trace(ctx.Err())
+	}
+	future := newWriteFuture()
+	future.onResolve = func() { <-t.slots }
+	if err := t.writer.push(ctx, batch, future); err != nil {
+		future.resolve(err)
+		return nil, err
 	}
+	return future, nil
+}
+
+// Flush waits until all batches pushed before are resolved.
+func (t *WriteTunnel) Flush(ctx context.Context) error {
+	return t.writer.Flush(ctx)
+}
+
+// Writer returns the writer of tunnel.
+func (t *WriteTunnel) Writer() ImportWriter {
+	return t.writer
 }
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/juju/errors"
+	"sync"
+	"time"
+)
+
+// BackpressureError is returned when a write is rejected because the writer can't keep up.
+// Clients should retry the write after RetryAfter.
+type BackpressureError struct {
+	// Unavailable is set if the importer is unreachable, otherwise the write queue is full.
+	Unavailable bool
+	RetryAfter  time.Duration
+	Reason      string
+}
+
+func (e *BackpressureError) Error() string {
+	if e.Unavailable {
+		return fmt.Sprintf("importer is unavailable, retry after %v: %s", e.RetryAfter, e.Reason)
+	}
+	return fmt.Sprintf("write queue is full, retry after %v: %s", e.RetryAfter, e.Reason)
+}
+
+// errEnqueueTimeout is returned by writeQueue.acquire when there's no room in time.
+var errEnqueueTimeout = errors.New("[writer] enqueue timeout")
+
+// writeQueue accounts bytes of batches queued in a writer. A batch is admitted if it fits into
+// the capacity, or the queue is empty, so a batch larger than the capacity is queued alone.
+type writeQueue struct {
+	mu       sync.Mutex
+	capacity int
+	bytes    int
+	// released is closed and replaced when bytes are released, to wake up waiting writes.
+	released chan struct{}
+}
+
+func newWriteQueue(capacity int) *writeQueue {
+	return &writeQueue{capacity: capacity, released: make(chan struct{})}
+}
+
+// acquire waits at most timeout until size bytes are admitted.
+func (q *writeQueue) acquire(ctx context.Context, size int, timeout time.Duration) error {
+	var deadline <-chan time.Time
+	for {
+		q.mu.Lock()
+		if q.bytes == 0 || q.capacity <= 0 || q.bytes+size <= q.capacity {
+			q.bytes += size
+			q.mu.Unlock()
+			return nil
+		}
+		released := q.released
+		q.mu.Unlock()
+
+		if deadline == nil {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			deadline = timer.C
+		}
+		select {
+		case <-released:
+		case <-deadline:
+			return errEnqueueTimeout
+		case <-ctx.Done():
+			return errors.Trace(ctx.Err())
+		}
+	}
+}
+
+func (q *writeQueue) release(size int) {
+	if size == 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.bytes -= size
+	close(q.released)
+	q.released = make(chan struct{})
+}
+
+// size returns the bytes queued.
+func (q *writeQueue) size() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.bytes
+}
@@ -66,6 +66,16 @@ func (c *RpcClient) GetConn(addr string) (*grpc.ClientConn, error) {
 	return connArray.Get(), nil
 }
 
+// GetConns gets n gpc conns to addr, they are different conns if n is not greater than MaxConnectionCount.
+func (c *RpcClient) GetConns(addr string, n int) ([]*grpc.ClientConn, error) {
+	connArray, err := c.getConnArray(addr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return connArray.GetN(n), nil
+}
+
 func (c *RpcClient) Close() error {
 	c.closeConns()
 	return nil
@@ -178,6 +188,16 @@ func (a *connArray) Get() *grpc.ClientConn {
 	return a.v[next]
 }
 
+// GetN gets n conns in consecutive slots.
+func (a *connArray) GetN(n int) []*grpc.ClientConn {
+	end := atomic.AddUint32(&a.index, uint32(n))
+	conns := make([]*grpc.ClientConn, 0, n)
+	for i := end - uint32(n) + 1; len(conns) < n; i++ {
+		conns = append(conns, a.v[i%uint32(len(a.v))])
+	}
+	return conns
+}
+
 func (a *connArray) Close() {
 	for i, c := range a.v {
 		if c != nil {